@@ -7,6 +7,7 @@ import (
 	"github.com/DataDog/datadog-trace-agent/config"
 	"github.com/DataDog/datadog-trace-agent/model"
 	"github.com/DataDog/datadog-trace-agent/quantizer"
+	"github.com/DataDog/datadog-trace-agent/statsd"
 	log "github.com/cihub/seelog"
 )
 
@@ -17,12 +18,35 @@ type processedTrace struct {
 	Sublayers []model.SublayerValue
 }
 
+// withOwnRoot returns a copy of the processed trace whose root span, metrics
+// included, isn't shared with the original one
+func (pt processedTrace) withOwnRoot() processedTrace {
+	t := make(model.Trace, len(pt.Trace))
+	copy(t, pt.Trace)
+	for i := range pt.Trace {
+		if &pt.Trace[i] != pt.Root {
+			continue
+		}
+		t[i].Metrics = make(map[string]float64, len(pt.Root.Metrics))
+		for k, v := range pt.Root.Metrics {
+			t[i].Metrics[k] = v
+		}
+		pt.Root = &t[i]
+	}
+	pt.Trace = t
+	return pt
+}
+
 // Agent struct holds all the sub-routines structs and make the data flow between them
 type Agent struct {
 	Receiver     *HTTPReceiver
+	Scrubber     *Scrubber
 	Concentrator *Concentrator
 	Sampler      *Sampler
 	Writer       *Writer
+	Prometheus   *PrometheusExporter // nil unless enabled
+	StatsdSink   *StatsdSink         // nil unless enabled
+	StatsHistory *StatsHistory       // nil unless enabled
 
 	// config
 	conf *config.AgentConfig
@@ -35,21 +59,49 @@ type Agent struct {
 func NewAgent(conf *config.AgentConfig) *Agent {
 	exit := make(chan struct{})
 
+	quantizer.SetCacheMaxSize(conf.QuantizerCacheMaxSize)
+	quantizer.SetRewriteRules(conf.ResourceRewriteRules)
+	quantizer.SetGraphQLFields(conf.GraphQLFields)
+	model.GlobalAgentPayloadVersion = model.AgentPayloadVersion(conf.APIPayloadVersion)
+
 	r := NewHTTPReceiver(conf)
+	sc := NewScrubber(conf)
 	c := NewConcentrator(
 		conf.ExtraAggregators,
 		conf.BucketInterval.Nanoseconds(),
+		newStatsOptions(conf),
 	)
 	s := NewSampler(conf)
 
 	w := NewWriter(conf)
 	w.inServices = r.services
 
+	var p *PrometheusExporter
+	if conf.PrometheusEnabled {
+		p = NewPrometheusExporter(conf, &r.stats)
+		r.metrics = p
+	}
+
+	var ss *StatsdSink
+	if conf.StatsdSinkEnabled {
+		ss = NewStatsdSink(conf)
+	}
+
+	var sh *StatsHistory
+	if conf.StatsHistoryMinutes > 0 {
+		sh = NewStatsHistory(conf)
+		r.statsQuery = sh
+	}
+
 	return &Agent{
 		Receiver:     r,
+		Scrubber:     sc,
 		Concentrator: c,
 		Sampler:      s,
 		Writer:       w,
+		Prometheus:   p,
+		StatsdSink:   ss,
+		StatsHistory: sh,
 		conf:         conf,
 		exit:         exit,
 	}
@@ -68,6 +120,9 @@ func (a *Agent) Run() {
 		case t := <-a.Receiver.traces:
 			a.Process(t)
 		case <-flushTicker.C:
+			a.Scrubber.Flush()
+			quantizer.FlushCacheStats()
+
 			p := model.AgentPayload{
 				HostName: a.conf.HostName,
 				Env:      a.conf.DefaultEnv,
@@ -84,6 +139,17 @@ func (a *Agent) Run() {
 			}()
 
 			wg.Wait()
+			p.Traces = append(p.Traces, a.Sampler.FlushExemplars(p.Stats)...)
+
+			if a.Prometheus != nil {
+				a.Prometheus.Add(p.Stats)
+			}
+			if a.StatsdSink != nil {
+				a.StatsdSink.Send(p.Stats)
+			}
+			if a.StatsHistory != nil {
+				a.StatsHistory.Add(p.Stats)
+			}
 
 			a.Writer.inPayloads <- p
 		case <-a.exit:
@@ -103,18 +169,14 @@ func (a *Agent) Process(t model.Trace) {
 		return
 	}
 
-	sublayers := model.ComputeSublayers(&t)
 	root := t.GetRoot()
-	model.SetSublayersOnSpan(root, sublayers)
-
-	if root.End() < model.Now()-2*a.conf.BucketInterval.Nanoseconds() {
+	if root.End() < model.Now()-2*a.conf.BucketInterval.Nanoseconds()-a.conf.LateSpanTolerance.Nanoseconds() {
 		log.Debugf("skipping trace with root too far in past, root:%v", *root)
+		statsd.Client.Count("trace_agent.concentrator.late_spans_rejected", int64(len(t)), nil, 1)
 		return
 	}
 
-	for i := range t {
-		t[i] = quantizer.Quantize(t[i])
-	}
+	sublayers := a.processSpans(t, root)
 
 	pt := processedTrace{
 		Trace:     t,
@@ -126,8 +188,28 @@ func (a *Agent) Process(t model.Trace) {
 		pt.Env = tenv
 	}
 
-	// NOTE: right now we don't use the .Metrics map in the concentrator
-	// but if we did, it would be racy with the Sampler that edits it
-	go a.Concentrator.Add(pt)
+	// NOTE: the Sampler edits the .Metrics map of the root, which the
+	// concentrator reads too, so it works on its own copy of the root
+	go a.Concentrator.Add(pt.withOwnRoot())
 	go a.Sampler.Add(pt)
 }
+
+// processSpans quantizes and scrubs the spans of the trace, then computes its
+// sublayers, pinned on the root, and the top-level and self-duration metrics
+func (a *Agent) processSpans(t model.Trace, root *model.Span) []model.SublayerValue {
+	for i := range t {
+		t[i] = quantizer.Quantize(t[i])
+		// scrub after quantizing so that meta added by quantizers is covered too
+		a.Scrubber.Scrub(&t[i])
+	}
+
+	// sublayers are computed from the scrubbed meta, as their values end up
+	// in the metrics of the root and in the tags of the stats
+	sublayers := model.ComputeSublayersWithMeta(&t, a.conf.SublayerMetaKeys)
+	// the critical path is reported and aggregated the same way as sublayers
+	sublayers = append(sublayers, model.ComputeCriticalPath(&t)...)
+	model.SetSublayersOnSpan(root, sublayers)
+	t.ComputeTopLevel()
+	t.ComputeSelfDuration()
+	return sublayers
+}
@@ -3,10 +3,64 @@ package main
 import (
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+
 	"github.com/DataDog/datadog-trace-agent/config"
 	"github.com/DataDog/datadog-trace-agent/fixtures"
+	"github.com/DataDog/datadog-trace-agent/model"
 )
 
+func TestProcessedTraceWithOwnRoot(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := model.Trace{
+		model.Span{SpanID: 2, ParentID: 1, Metrics: map[string]float64{"a": 1}},
+		model.Span{SpanID: 1, Metrics: map[string]float64{"b": 2}},
+	}
+	pt := processedTrace{Trace: trace, Root: &trace[1]}
+
+	cpt := pt.withOwnRoot()
+	assert.Equal(uint64(1), cpt.Root.SpanID)
+	assert.Equal(&cpt.Trace[1], cpt.Root)
+
+	// editing the original root doesn't affect the copy
+	pt.Root.Metrics["b"] = 3
+	assert.Equal(2.0, cpt.Root.Metrics["b"])
+	assert.Equal(pt.Trace[0], cpt.Trace[0])
+}
+
+func TestProcessSpansScrubsSublayers(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.SublayerMetaKeys = []string{"out.host"}
+	conf.ScrubbingEnabled = true
+	conf.ScrubbingRules = []config.ScrubRule{
+		{Name: "ip", Pattern: `\d+\.\d+\.\d+\.\d+`, Keys: []string{"out.host"}, Strategy: "mask"},
+	}
+	a := &Agent{Scrubber: NewScrubber(conf), conf: conf}
+
+	trace := model.Trace{
+		model.Span{SpanID: 1, Start: 0, Duration: 100, Service: "web", Name: "request"},
+		model.Span{SpanID: 2, ParentID: 1, Start: 10, Duration: 30, Service: "pg", Name: "query",
+			Meta: map[string]string{"out.host": "10.0.0.1"}},
+	}
+	sublayers := a.processSpans(trace, &trace[0])
+
+	// the raw values of the meta keys don't leak into the sublayers
+	found := false
+	for _, s := range sublayers {
+		if s.Tag.Name == "sublayer_out.host" {
+			found = true
+			assert.NotContains(s.Tag.Value, "10.0.0.1")
+		}
+	}
+	assert.True(found)
+	for k := range trace[0].Metrics {
+		assert.NotContains(k, "10.0.0.1")
+	}
+}
+
 func BenchmarkAgentTraceProcessing(b *testing.B) {
 	// Disable debug logs in these tests
 	config.NewLoggerLevelCustom("INFO", "/var/log/datadog/trace-agent.log")
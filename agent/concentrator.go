@@ -1,12 +1,16 @@
 package main
 
 import (
+	"runtime"
 	"sort"
 	"sync"
+	"time"
 
 	log "github.com/cihub/seelog"
 
+	"github.com/DataDog/datadog-trace-agent/config"
 	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/quantile"
 	"github.com/DataDog/datadog-trace-agent/statsd"
 )
 
@@ -14,72 +18,298 @@ import (
 // https://en.wikipedia.org/wiki/Knelson_concentrator
 // Gets an imperial shitton of traces, and outputs pre-computed data structures
 // allowing to find the gold (stats) amongst the traces.
+//
+// Stats are computed by shards, each with its own lock, so that traces can be
+// added concurrently. Spans are dispatched to shards by service, name and
+// resource, so that the spans of a single service are spread too, and each
+// grain lives in a single shard. The grain limits are shared by the buckets
+// of a timestamp across shards, and Flush merges the buckets of the shards.
 type Concentrator struct {
 	aggregators []string
 	bsize       int64
+	opts        *model.StatsOptions // optional stats computed by all the buckets
 
-	buckets map[int64]*model.StatsRawBucket // buckets used to aggregate stats per timestamp
-	mu      sync.Mutex
+	shards []*concentratorShard
+
+	// distinct grains per bucket timestamp, shared by the shards for the
+	// grain limits
+	grainCounters map[int64]*model.GrainCounter
+	countersMu    sync.Mutex
+
+	overflowLogger *errorLogger // rate-limited per minute, not per flush
 }
 
-// NewConcentrator initializes a new concentrator ready to be started
-func NewConcentrator(aggregators []string, bsize int64) *Concentrator {
+// concentratorShard holds the stats buckets of a subset of the grains
+type concentratorShard struct {
+	buckets      map[int64]*model.StatsRawBucket // buckets used to aggregate stats per timestamp
+	corrections  map[int64]*model.StatsRawBucket // late spans of already flushed buckets, per timestamp
+	flushedUntil int64                           // buckets up to this timestamp were flushed
+	mu           sync.Mutex
+}
+
+// NewConcentrator initializes a new concentrator ready to be started, with
+// one shard per usable CPU
+func NewConcentrator(aggregators []string, bsize int64, opts *model.StatsOptions) *Concentrator {
+	return newConcentrator(aggregators, bsize, opts, runtime.GOMAXPROCS(0))
+}
+
+// newConcentrator initializes a concentrator with the given number of shards
+func newConcentrator(aggregators []string, bsize int64, opts *model.StatsOptions, shards int) *Concentrator {
+	if shards < 1 {
+		shards = 1
+	}
 	c := Concentrator{
-		aggregators: aggregators,
-		bsize:       bsize,
-		buckets:     make(map[int64]*model.StatsRawBucket),
+		aggregators:   aggregators,
+		bsize:         bsize,
+		opts:          opts,
+		shards:        make([]*concentratorShard, shards),
+		grainCounters: make(map[int64]*model.GrainCounter),
+
+		overflowLogger: &errorLogger{interval: time.Minute},
+	}
+	for i := range c.shards {
+		c.shards[i] = &concentratorShard{
+			buckets:     make(map[int64]*model.StatsRawBucket),
+			corrections: make(map[int64]*model.StatsRawBucket),
+		}
 	}
 	sort.Strings(c.aggregators)
 	return &c
 }
 
-// Add appends to the proper stats bucket this trace's statistics
+// FNV-1a parameters, inlined to hash the span fields without allocating
+const (
+	fnvOffset32 = 2166136261
+	fnvPrime32  = 16777619
+)
+
+// shard returns the shard computing the stats of the grain of the span
+func (c *Concentrator) shard(s *model.Span) *concentratorShard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	h := uint32(fnvOffset32)
+	for _, field := range [...]string{s.Service, s.Name, s.Resource} {
+		for i := 0; i < len(field); i++ {
+			h ^= uint32(field[i])
+			h *= fnvPrime32
+		}
+		// separates the fields
+		h *= fnvPrime32
+	}
+	return c.shards[h%uint32(len(c.shards))]
+}
+
+// Add appends to the proper stats bucket this trace's statistics, computed
+// from its top-level and measured spans only. Whether a late trace is still
+// accepted is decided once by the agent, from its root: all the spans added
+// are counted, those of already flushed buckets in correction buckets.
 func (c *Concentrator) Add(t processedTrace) {
-	c.mu.Lock()
+	var late, maxLateness int64
+	now := model.Now()
 
 	for _, s := range t.Trace {
-		btime := s.End() - s.End()%c.bsize
-		b, ok := c.buckets[btime]
-		if !ok {
-			b = model.NewStatsRawBucket(btime, c.bsize)
-			c.buckets[btime] = b
+		if !s.TopLevel() && !s.Measured() {
+			continue
 		}
 
+		var sublayers *[]model.SublayerValue
 		if t.Root != nil && s.SpanID == t.Root.SpanID && t.Sublayers != nil {
-			// handle sublayers
-			b.HandleSpan(s, t.Env, c.aggregators, &t.Sublayers)
-		} else {
-			b.HandleSpan(s, t.Env, c.aggregators, nil)
+			sublayers = &t.Sublayers
+		}
+
+		if lateness := c.shard(&s).add(c, s, t.Env, sublayers, now); lateness > 0 {
+			late++
+			if lateness > maxLateness {
+				maxLateness = lateness
+			}
+		}
+	}
+
+	if late > 0 {
+		statsd.Client.Count("trace_agent.concentrator.late_spans", late, nil, 1)
+		statsd.Client.Histogram("trace_agent.concentrator.span_lateness", float64(maxLateness)/1e9, nil, 1)
+	}
+}
+
+// add computes the stats of the span in the shard. It returns how late the
+// span was if its bucket was already flushed, 0 if it wasn't.
+func (sh *concentratorShard) add(c *Concentrator, s model.Span, env string, sublayers *[]model.SublayerValue, now int64) int64 {
+	var lateness int64
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	btime := s.End() - s.End()%c.bsize
+	buckets := sh.buckets
+	if btime <= sh.flushedUntil {
+		// the bucket of this span was already flushed, correct it
+		if lateness = now - s.End(); lateness < 1 {
+			lateness = 1
 		}
+		buckets = sh.corrections
 	}
 
-	c.mu.Unlock()
+	b, ok := buckets[btime]
+	if !ok {
+		b = model.NewStatsRawBucketWithOptions(btime, c.bsize, c.opts)
+		if lateness == 0 {
+			// correction buckets are small and only limited by themselves
+			b.SetGrainCounter(c.grainCounter(btime))
+		}
+		buckets[btime] = b
+	}
+	b.HandleSpan(s, env, c.aggregators, sublayers)
+	return lateness
 }
 
-// Flush deletes and returns complete statistic buckets
+// grainCounter returns the grain counter shared by the buckets of timestamp ts
+func (c *Concentrator) grainCounter(ts int64) *model.GrainCounter {
+	c.countersMu.Lock()
+	defer c.countersMu.Unlock()
+
+	gc, ok := c.grainCounters[ts]
+	if !ok {
+		gc = &model.GrainCounter{}
+		c.grainCounters[ts] = gc
+	}
+	return gc
+}
+
+// Flush deletes and returns complete statistic buckets, and the correction
+// buckets of late spans which should be merged into already flushed ones.
+// Buckets of the different shards with the same timestamp are merged.
 func (c *Concentrator) Flush() []model.StatsBucket {
-	var sb []model.StatsBucket
 	now := model.Now()
+	corrections := make(map[int64]model.StatsBucket)
+	buckets := make(map[int64]model.StatsBucket)
+	overflows := make(map[string]int64)
 
-	c.mu.Lock()
-	for ts, srb := range c.buckets {
-		bucket := srb.Export()
+	for _, sh := range c.shards {
+		sh.mu.Lock()
+		for ts, srb := range sh.corrections {
+			addOverflows(overflows, srb)
+			mergeStatsBucket(corrections, srb.Export())
+			delete(sh.corrections, ts)
+		}
+		for ts, srb := range sh.buckets {
+			// always keep one bucket opened
+			// this is a trade-off: we accept slightly late traces (clock skew and stuff)
+			// but we delay flushing by at most 2 buckets
+			if ts > now-2*c.bsize {
+				continue
+			}
+			addOverflows(overflows, srb)
+			mergeStatsBucket(buckets, srb.Export())
+			delete(sh.buckets, ts)
+		}
+		sh.flushedUntil = now - 2*c.bsize
+		sh.mu.Unlock()
+	}
 
-		// always keep one bucket opened
-		// this is a trade-off: we accept slightly late traces (clock skew and stuff)
-		// but we delay flushing by at most 2 buckets
-		if ts > now-2*c.bsize {
-			continue
+	c.countersMu.Lock()
+	for ts := range c.grainCounters {
+		if ts <= now-2*c.bsize {
+			delete(c.grainCounters, ts)
 		}
+	}
+	c.countersMu.Unlock()
+
+	for service, n := range overflows {
+		statsd.Client.Count("trace_agent.concentrator.grains_overflow", n, []string{"service:" + service}, 1)
+		c.overflowLogger.Errorf("too many distinct stats grains for service %q, %d spans were counted under resource:%s", service, n, model.OverflowResource)
+	}
+
+	sb := make([]model.StatsBucket, 0, len(corrections)+len(buckets))
+	for ts, bucket := range corrections {
+		log.Debugf("flushing correction bucket %d", ts)
+		sb = append(sb, bucket)
+	}
+	if len(sb) > 0 {
+		statsd.Client.Count("trace_agent.concentrator.correction_buckets", int64(len(sb)), nil, 1)
+	}
 
+	for ts, bucket := range buckets {
 		log.Debugf("flushing bucket %d", ts)
 		for _, d := range bucket.Distributions {
-			statsd.Client.Histogram("trace_agent.distribution.len", float64(d.Summary.N), nil, 1)
+			statsd.Client.Histogram("trace_agent.distribution.len", float64(d.Summary.Count()), nil, 1)
 		}
 		sb = append(sb, bucket)
-		delete(c.buckets, ts)
 	}
-	c.mu.Unlock()
 
 	return sb
 }
+
+// addOverflows adds the spans folded by the bucket because of the grain
+// limits to the given counts per service
+func addOverflows(overflows map[string]int64, srb *model.StatsRawBucket) {
+	for service, n := range srb.Overflows() {
+		overflows[service] += n
+	}
+}
+
+// mergeStatsBucket merges the bucket into the one of the same timestamp in
+// the given map. Shards compute stats for distinct grains so keys only
+// collide for the overflow grains of the services, whose stats are merged.
+func mergeStatsBucket(buckets map[int64]model.StatsBucket, b model.StatsBucket) {
+	dst, ok := buckets[b.Start]
+	if !ok {
+		buckets[b.Start] = b
+		return
+	}
+	for k, cnt := range b.Counts {
+		if prev, ok := dst.Counts[k]; ok {
+			cnt = prev.Merge(cnt)
+		}
+		dst.Counts[k] = cnt
+	}
+	for k, d := range b.Distributions {
+		if prev, ok := dst.Distributions[k]; ok {
+			if err := prev.Merge(d); err != nil {
+				log.Errorf("cannot merge distribution %s: %v", k, err)
+			}
+			continue
+		}
+		dst.Distributions[k] = d
+	}
+}
+
+// newStatsOptions returns the optional stats the concentrator should compute
+// according to the config
+func newStatsOptions(conf *config.AgentConfig) *model.StatsOptions {
+	opts := &model.StatsOptions{
+		ErrorTypeServices:       model.NewServiceSet(conf.ErrorTypeServices),
+		ErrorTypeMaxCardinality: conf.ErrorTypeMaxCardinality,
+		HTTP5xxErrorServices:    model.NewServiceSet(conf.HTTP5xxErrorServices),
+		MaxGrainsPerService:     conf.MaxGrainsPerService,
+		MaxGrains:               conf.MaxGrains,
+	}
+	if len(conf.SublayerDistributions) > 0 {
+		opts.SublayerDistributions = make(map[string]bool, len(conf.SublayerDistributions))
+		for _, m := range conf.SublayerDistributions {
+			opts.SublayerDistributions[m] = true
+		}
+	}
+	if conf.DistributionSketch == "ddsketch" {
+		alpha := conf.SketchRelativeAccuracy
+		opts.NewSketch = func() quantile.Sketch { return quantile.NewLogSketch(alpha) }
+	}
+	for _, m := range conf.CustomMeasures {
+		opts.CustomMeasures = append(opts.CustomMeasures, model.CustomMeasure{
+			Name:    m.Name,
+			Metric:  m.Metric,
+			Kind:    m.Kind,
+			Service: m.Service,
+			Span:    m.SpanName,
+		})
+	}
+	for _, lt := range conf.LatencyThresholds {
+		opts.LatencyThresholds = append(opts.LatencyThresholds, model.LatencyThreshold{
+			Service:  lt.Service,
+			Resource: lt.Resource,
+			Apdex:    lt.Apdex.Nanoseconds(),
+			SLO:      lt.SLO.Nanoseconds(),
+		})
+	}
+	return opts
+}
@@ -1,18 +1,23 @@
 package main
 
 import (
+	"fmt"
 	"math/rand"
+	"runtime"
+	"sort"
 	"testing"
 	"time"
 
+	"github.com/DataDog/datadog-trace-agent/config"
 	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/quantile"
 	"github.com/stretchr/testify/assert"
 )
 
 var testBucketInterval = time.Duration(2 * time.Second).Nanoseconds()
 
 func NewTestConcentrator() *Concentrator {
-	return NewConcentrator([]string{}, time.Second.Nanoseconds())
+	return NewConcentrator([]string{}, time.Second.Nanoseconds(), nil)
 }
 
 // getTsInBucket gives a timestamp in ns which is `offset` buckets late
@@ -39,7 +44,7 @@ func testSpan(c *Concentrator, spanID uint64, duration, offset int64, service, r
 
 func TestConcentratorStatsCounts(t *testing.T) {
 	assert := assert.New(t)
-	c := NewConcentrator([]string{}, testBucketInterval)
+	c := NewConcentrator([]string{}, testBucketInterval, nil)
 
 	now := model.Now()
 	alignedNow := now - now%c.bsize
@@ -64,6 +69,7 @@ func TestConcentratorStatsCounts(t *testing.T) {
 		},
 	}
 
+	testTrace.Trace.ComputeTopLevel()
 	c.Add(testTrace)
 	stats := c.Flush()
 
@@ -138,3 +144,281 @@ func TestConcentratorStatsCounts(t *testing.T) {
 		assert.Equal(val, int64(count.Value), "Wrong value for count %s", key)
 	}
 }
+
+func TestConcentratorTopLevel(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConcentrator([]string{}, testBucketInterval, nil)
+
+	root := testSpan(c, 1, 100, 3, "web", "GET /users", 0)
+	internal := testSpan(c, 2, 50, 3, "web", "render", 0)
+	internal.ParentID = 1
+	measured := testSpan(c, 3, 20, 3, "web", "serialize", 0)
+	measured.ParentID = 1
+	measured.Meta = map[string]string{model.MeasuredKey: "1"}
+	db := testSpan(c, 4, 30, 3, "db", "SELECT ?", 1)
+	db.ParentID = 2
+	dbInternal := testSpan(c, 5, 10, 3, "db", "fetch", 0)
+	dbInternal.ParentID = 4
+
+	trace := model.Trace{root, internal, measured, db, dbInternal}
+	trace.ComputeTopLevel()
+	c.Add(processedTrace{Env: "none", Trace: trace, Root: &trace[0]})
+
+	stats := c.Flush()
+	if !assert.Equal(1, len(stats), "We should get exactly 1 StatsBucket") {
+		t.FailNow()
+	}
+
+	expectedHits := map[string]float64{
+		"query|hits|env:none,resource:GET /users,service:web": 1,
+		"query|hits|env:none,resource:serialize,service:web":  1,
+		"query|hits|env:none,resource:SELECT ?,service:db":    1,
+	}
+	for key, count := range stats[0].Counts {
+		if count.Measure != model.HITS {
+			continue
+		}
+		expected, ok := expectedHits[key]
+		assert.True(ok, "%s should not have been aggregated", key)
+		assert.Equal(expected, count.Value, key)
+	}
+	assert.Equal(1.0, stats[0].Counts["query|errors|env:none,resource:SELECT ?,service:db"].Value)
+	assert.Equal(3, len(stats[0].Distributions))
+}
+
+func TestConcentratorLateSpans(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConcentrator([]string{}, testBucketInterval, nil)
+
+	now := model.Now()
+	alignedNow := now - now%c.bsize
+
+	trace := func(spans ...model.Span) processedTrace {
+		tr := model.Trace(spans)
+		tr.ComputeTopLevel()
+		return processedTrace{Env: "none", Trace: tr}
+	}
+
+	c.Add(trace(testSpan(c, 1, 10, 3, "A1", "resource1", 0)))
+	stats := c.Flush()
+	if !assert.Equal(1, len(stats)) {
+		t.FailNow()
+	}
+	assert.Equal(alignedNow-3*testBucketInterval, stats[0].Start)
+
+	// late spans, accepted by the agent: one for the flushed bucket, one older
+	c.Add(trace(
+		testSpan(c, 2, 20, 3, "A1", "resource1", 0),
+		testSpan(c, 3, 30, 8, "A1", "resource1", 0),
+	))
+	// a regular one, kept in the opened buckets
+	c.Add(trace(testSpan(c, 5, 50, 0, "A1", "resource1", 0)))
+
+	stats = c.Flush()
+	if !assert.Equal(2, len(stats), "We should get the 2 correction buckets") {
+		t.FailNow()
+	}
+
+	starts := map[int64]float64{}
+	for _, b := range stats {
+		starts[b.Start] = b.Counts["query|duration|env:none,resource:resource1,service:A1"].Value
+	}
+	assert.Equal(map[int64]float64{
+		alignedNow - 3*testBucketInterval: 20,
+		alignedNow - 8*testBucketInterval: 30,
+	}, starts)
+
+	// corrections are only flushed once
+	assert.Equal(0, len(c.Flush()))
+}
+
+func TestConcentratorLongTrace(t *testing.T) {
+	assert := assert.New(t)
+	c := NewConcentrator([]string{}, testBucketInterval, nil)
+
+	now := model.Now()
+	alignedNow := now - now%c.bsize
+
+	c.Add(processedTrace{Env: "none", Trace: model.Trace{testSpan(c, 1, 10, 0, "A1", "resource1", 0)}})
+	assert.Equal(0, len(c.Flush()))
+
+	// the root is recent, but its child of another service ended before the
+	// flushed buckets: the trace is accepted, and so is the child
+	root := testSpan(c, 2, 20, 0, "A1", "resource1", 0)
+	child := testSpan(c, 3, 30, 5, "B1", "resource2", 0)
+	child.ParentID = root.SpanID
+	tr := model.Trace{root, child}
+	tr.ComputeTopLevel()
+	c.Add(processedTrace{Env: "none", Trace: tr, Root: &tr[0]})
+
+	stats := c.Flush()
+	if !assert.Equal(1, len(stats), "We should get the correction bucket of the child") {
+		t.FailNow()
+	}
+	assert.Equal(alignedNow-5*testBucketInterval, stats[0].Start)
+	assert.Equal(30.0, stats[0].Counts["query|duration|env:none,resource:resource2,service:B1"].Value)
+}
+
+// shardTestTraces returns traces spread over the given number of services, and
+// several buckets. With a single service, there are no other top-level spans.
+func shardTestTraces(c *Concentrator, n, services int) []processedTrace {
+	traces := make([]processedTrace, 0, n)
+	for i := 0; i < n; i++ {
+		service := fmt.Sprintf("service%d", i%services)
+		childService := "db"
+		if services == 1 {
+			childService = service
+		}
+		resource := fmt.Sprintf("resource%d", i%3)
+		root := testSpan(c, uint64(2*i+1), int64(100+i), int64(2+i%3), service, resource, int32(i%2))
+		child := testSpan(c, uint64(2*i+2), int64(50+i), int64(2+i%3), childService, "SELECT ?", 0)
+		child.ParentID = root.SpanID
+		tr := model.Trace{root, child}
+		tr.ComputeTopLevel()
+		traces = append(traces, processedTrace{Env: "none", Trace: tr, Root: &tr[0]})
+	}
+	return traces
+}
+
+type bucketsByStart []model.StatsBucket
+
+func (b bucketsByStart) Len() int           { return len(b) }
+func (b bucketsByStart) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b bucketsByStart) Less(i, j int) bool { return b[i].Start < b[j].Start }
+
+func TestConcentratorShards(t *testing.T) {
+	assert := assert.New(t)
+
+	flush := func(shards int, traces []processedTrace) []model.StatsBucket {
+		c := newConcentrator([]string{}, testBucketInterval, nil, shards)
+		for _, tr := range traces {
+			c.Add(tr)
+		}
+		stats := c.Flush()
+		sort.Sort(bucketsByStart(stats))
+		return stats
+	}
+
+	traces := shardTestTraces(newConcentrator([]string{}, testBucketInterval, nil, 1), 200, 7)
+	expected := flush(1, traces)
+	assert.Equal(3, len(expected))
+	for _, shards := range []int{2, 4, 16} {
+		assert.Equal(expected, flush(shards, traces), "%d shards", shards)
+	}
+}
+
+func benchmarkConcentratorAddParallel(b *testing.B, shards, services int) {
+	c := newConcentrator([]string{}, testBucketInterval, nil, shards)
+	traces := shardTestTraces(c, 1000, services)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := rand.Intn(len(traces)); pb.Next(); i++ {
+			c.Add(traces[i%len(traces)])
+		}
+	})
+}
+
+// BenchmarkConcentratorAddParallelSingleShard measures the throughput of a
+// concentrator with a single lock shared by all the goroutines
+func BenchmarkConcentratorAddParallelSingleShard(b *testing.B) {
+	benchmarkConcentratorAddParallel(b, 1, 7)
+}
+
+func BenchmarkConcentratorAddParallelSharded(b *testing.B) {
+	benchmarkConcentratorAddParallel(b, runtime.GOMAXPROCS(0), 7)
+}
+
+// BenchmarkConcentratorAddParallelShardedOneService measures the common case of
+// an agent receiving the traces of a single service, which all go to one shard
+func BenchmarkConcentratorAddParallelShardedOneService(b *testing.B) {
+	benchmarkConcentratorAddParallel(b, runtime.GOMAXPROCS(0), 1)
+}
+
+func TestConcentratorGrainLimits(t *testing.T) {
+	assert := assert.New(t)
+	opts := &model.StatsOptions{MaxGrains: 2}
+	c := newConcentrator([]string{}, testBucketInterval, opts, 4)
+
+	// the global limit is shared by the shards
+	for i, service := range []string{"A1", "A2", "A3", "A4"} {
+		tr := model.Trace{testSpan(c, uint64(i+1), 10, 3, service, "resource1", 0)}
+		tr.ComputeTopLevel()
+		c.Add(processedTrace{Env: "none", Trace: tr})
+	}
+	stats := c.Flush()
+	if !assert.Equal(1, len(stats)) {
+		t.FailNow()
+	}
+
+	resources := map[string]int{}
+	for _, cnt := range stats[0].Counts {
+		if cnt.Measure == model.HITS {
+			resources[cnt.TagSet.Get("resource").Value]++
+		}
+	}
+	assert.Equal(map[string]int{"resource1": 2, model.OverflowResource: 2}, resources)
+	assert.Empty(c.grainCounters)
+}
+
+func TestConcentratorServiceGrainLimit(t *testing.T) {
+	assert := assert.New(t)
+	opts := &model.StatsOptions{MaxGrainsPerService: 3}
+	c := newConcentrator([]string{}, testBucketInterval, opts, 4)
+
+	// the grains of a service are spread over the shards, which share its limit
+	for i := 0; i < 10; i++ {
+		tr := model.Trace{testSpan(c, uint64(i+1), 10, 3, "A1", fmt.Sprintf("resource%d", i), 0)}
+		tr.ComputeTopLevel()
+		c.Add(processedTrace{Env: "none", Trace: tr})
+	}
+	stats := c.Flush()
+	if !assert.Equal(1, len(stats)) {
+		t.FailNow()
+	}
+
+	hits := map[string]float64{}
+	for _, cnt := range stats[0].Counts {
+		if cnt.Measure == model.HITS {
+			hits[cnt.TagSet.Get("resource").Value] += cnt.Value
+		}
+	}
+	assert.Equal(4, len(hits))
+	assert.Equal(7.0, hits[model.OverflowResource])
+}
+
+func TestConcentratorSketch(t *testing.T) {
+	assert := assert.New(t)
+
+	for sketch, typ := range map[string]quantile.Sketch{
+		"gk":       &quantile.SliceSummary{},
+		"ddsketch": &quantile.LogSketch{},
+	} {
+		conf := config.NewDefaultAgentConfig()
+		conf.DistributionSketch = sketch
+		c := NewConcentrator([]string{}, testBucketInterval, newStatsOptions(conf))
+
+		tr := model.Trace{
+			testSpan(c, 1, 10, 2, "A1", "resource1", 0),
+			testSpan(c, 2, 30, 2, "A1", "resource1", 0),
+			testSpan(c, 3, 20, 2, "A2", "resource2", 0),
+		}
+		tr.ComputeTopLevel()
+		c.Add(processedTrace{Env: "none", Trace: tr})
+
+		stats := c.Flush()
+		if !assert.Equal(1, len(stats)) {
+			t.FailNow()
+		}
+		assert.Len(stats[0].Distributions, 2)
+		for _, d := range stats[0].Distributions {
+			assert.IsType(typ, d.Summary, sketch)
+		}
+		d := stats[0].Distributions["query|duration|env:none,resource:resource1,service:A1"]
+		assert.Equal(2, d.Summary.Count(), sketch)
+		max, samples := d.Summary.Quantile(1)
+		assert.Equal(30.0, max, sketch)
+		assert.Equal([]uint64{2}, samples, sketch)
+	}
+}
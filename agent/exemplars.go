@@ -0,0 +1,195 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/sampler"
+)
+
+// exemplarGenerations is the number of flushes the span IDs of the traces are
+// kept for: the concentrator flushes the stats of a span within 3 flushes
+const exemplarGenerations = 4
+
+// exemplarMaxSpans bounds the span IDs indexed over all the generations, sampled
+// traces included, about 100 bytes each
+const exemplarMaxSpans = 100000
+
+// ExemplarMetaKey marks the root of the traces kept as exemplars although the
+// sampler rejected them, so that they aren't counted as sampled traces
+const ExemplarMetaKey = "_dd.exemplar"
+
+// exemplarQuantiles are the quantiles whose samples are kept as exemplars,
+// the tail first as the budget may not allow all of them
+var exemplarQuantiles = []float64{1, 0.999, 0.99, 0.95, 0.9, 0.75, 0.5}
+
+// exemplar is a trace seen by the sampler, found by the IDs of its top-level
+// and measured spans, the ones sampled by the distributions of the stats
+type exemplar struct {
+	trace model.Trace // nil once kept
+	root  *model.Span
+	kept  bool
+}
+
+// exemplarBuffer keeps, for a few flushes, the traces the sampler rejected so
+// that the ones the distributions retained as samples can still be kept
+type exemplarBuffer struct {
+	maxTraces   int                    // max rejected traces buffered
+	maxSpans    int                    // max span IDs indexed
+	generations []map[uint64]*exemplar // by span ID, newest first
+	traces      []int                  // rejected traces buffered in each generation
+	dropped     int64                  // rejected traces not buffered since the last flush
+}
+
+func newExemplarBuffer(maxTraces int) *exemplarBuffer {
+	b := &exemplarBuffer{
+		maxTraces:   maxTraces,
+		maxSpans:    exemplarMaxSpans,
+		generations: make([]map[uint64]*exemplar, exemplarGenerations),
+		traces:      make([]int, exemplarGenerations),
+	}
+	for i := range b.generations {
+		b.generations[i] = make(map[uint64]*exemplar)
+	}
+	return b
+}
+
+// add indexes a trace seen by the sampler, buffering it if it wasn't kept. Once
+// the index is full, sampled traces are not indexed anymore and are missing
+// from the retention.
+func (b *exemplarBuffer) add(t model.Trace, root *model.Span, kept bool) {
+	spans, traces := 0, 0
+	for i := range b.generations {
+		spans += len(b.generations[i])
+		traces += b.traces[i]
+	}
+
+	var ids []uint64
+	for _, s := range t {
+		if s.TopLevel() || s.Measured() {
+			ids = append(ids, s.SpanID)
+		}
+	}
+	if spans+len(ids) > b.maxSpans || (!kept && traces >= b.maxTraces) {
+		if !kept {
+			b.dropped++
+		}
+		return
+	}
+
+	e := &exemplar{kept: kept}
+	if !kept {
+		e.trace = t
+		e.root = root
+		b.traces[0]++
+	}
+	for _, id := range ids {
+		b.generations[0][id] = e
+	}
+}
+
+// markExemplar flags the root of a rejected trace kept as an exemplar and
+// resets its sample rate, as it wasn't sampled and shouldn't be upscaled.
+// Its maps are shared with the copy of the root the concentrator got, so
+// they are replaced rather than edited.
+func markExemplar(root *model.Span) {
+	if root == nil {
+		return
+	}
+	meta := make(map[string]string, len(root.Meta)+1)
+	for k, v := range root.Meta {
+		meta[k] = v
+	}
+	meta[ExemplarMetaKey] = "true"
+	root.Meta = meta
+
+	metrics := make(map[string]float64, len(root.Metrics))
+	for k, v := range root.Metrics {
+		metrics[k] = v
+	}
+	metrics[sampler.SampleRateMetricKey] = 1
+	root.Metrics = metrics
+}
+
+func (b *exemplarBuffer) get(spanID uint64) *exemplar {
+	for _, g := range b.generations {
+		if e, ok := g[spanID]; ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// rotate forgets the oldest generation of traces
+func (b *exemplarBuffer) rotate() {
+	last := len(b.generations) - 1
+	copy(b.generations[1:], b.generations[:last])
+	copy(b.traces[1:], b.traces[:last])
+	b.generations[0] = make(map[uint64]*exemplar)
+	b.traces[0] = 0
+	b.dropped = 0
+}
+
+// exemplarRetention counts the samples of a quantile whose traces were kept
+type exemplarRetention struct {
+	quantile float64
+	total    int64
+	retained int64
+}
+
+// keep returns up to budget buffered traces that the distributions of the
+// stats retained as samples, the ones of the tail quantiles first, and the
+// retention of the samples of each quantile
+func (b *exemplarBuffer) keep(stats []model.StatsBucket, budget int) ([]model.Trace, []exemplarRetention) {
+	var distributions []model.Distribution
+	for _, sb := range stats {
+		for _, d := range sb.Distributions {
+			distributions = append(distributions, d)
+		}
+	}
+	// the order of the maps shouldn't choose which traces fit in the budget
+	sort.Sort(distributionsByKey(distributions))
+
+	var traces []model.Trace
+	retention := make([]exemplarRetention, 0, len(exemplarQuantiles))
+	seen := make(map[uint64]bool)
+	for _, q := range exemplarQuantiles {
+		r := exemplarRetention{quantile: q}
+		for _, d := range distributions {
+			if d.Summary.Count() == 0 {
+				continue
+			}
+			_, samples := d.Summary.Quantile(q)
+			for _, id := range samples {
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+				r.total++
+
+				e := b.get(id)
+				if e == nil {
+					continue
+				}
+				if !e.kept && len(traces) < budget {
+					markExemplar(e.root)
+					traces = append(traces, e.trace)
+					e.kept = true
+					e.trace = nil
+					e.root = nil
+				}
+				if e.kept {
+					r.retained++
+				}
+			}
+		}
+		retention = append(retention, r)
+	}
+	return traces, retention
+}
+
+type distributionsByKey []model.Distribution
+
+func (d distributionsByKey) Len() int           { return len(d) }
+func (d distributionsByKey) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d distributionsByKey) Less(i, j int) bool { return d[i].Key < d[j].Key }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/sampler"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSamplerEngine samples the traces whose root has the given span IDs
+type testSamplerEngine struct {
+	sampled map[uint64]bool
+}
+
+func (e *testSamplerEngine) Run()  {}
+func (e *testSamplerEngine) Stop() {}
+func (e *testSamplerEngine) Sample(t model.Trace, root *model.Span, env string) bool {
+	return e.sampled[root.SpanID]
+}
+
+func addExemplarTrace(b *exemplarBuffer, t processedTrace, kept bool) {
+	b.add(t.Trace, t.Root, kept)
+}
+
+func exemplarTrace(id uint64, duration int64) processedTrace {
+	t := model.Trace{
+		{TraceID: id, SpanID: id, Name: "http.request", Service: "web", Resource: "/", Duration: duration},
+		{TraceID: id, SpanID: id + 1000, ParentID: id, Name: "sql.query", Service: "web", Resource: "SELECT", Duration: duration / 2},
+	}
+	t[0].Meta = map[string]string{"http.method": "GET"}
+	t[0].Metrics = map[string]float64{sampler.SampleRateMetricKey: 0.5}
+	t.ComputeTopLevel()
+	return processedTrace{Trace: t, Root: &t[0], Env: "prod"}
+}
+
+// exemplarStats returns the stats of the traces
+func exemplarStats(traces ...processedTrace) []model.StatsBucket {
+	srb := model.NewStatsRawBucket(0, 1e9)
+	for _, t := range traces {
+		for _, s := range t.Trace {
+			if s.TopLevel() {
+				srb.HandleSpan(s, t.Env, nil, nil)
+			}
+		}
+	}
+	return []model.StatsBucket{srb.Export()}
+}
+
+func TestSamplerExemplars(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.ExemplarMaxTraces = 2
+	s := NewSampler(conf)
+	s.samplerEngine = &testSamplerEngine{sampled: map[uint64]bool{3: true}}
+
+	var traces []processedTrace
+	for i := uint64(1); i <= 5; i++ {
+		traces = append(traces, exemplarTrace(i, int64(i)*100))
+	}
+	// the concentrator works on its own root, sharing its meta
+	concentrated := traces[4].withOwnRoot()
+	for _, tr := range traces {
+		s.Add(tr)
+	}
+	assert.Len(s.Flush(), 1)
+	stats := exemplarStats(traces...)
+
+	// the max of the distribution first, then its p99.9 and p99... until the
+	// budget is exhausted
+	exemplars := s.FlushExemplars(stats)
+	if assert.Len(exemplars, 2) {
+		assert.Equal(uint64(5), exemplars[0][0].TraceID)
+		assert.Equal(uint64(4), exemplars[1][0].TraceID)
+	}
+	// exemplars are flagged and not upscaled by the sample rate of the rejection
+	for _, tr := range exemplars {
+		assert.Equal("true", tr[0].Meta[ExemplarMetaKey])
+		assert.Equal(1.0, tr[0].Metrics[sampler.SampleRateMetricKey])
+		_, ok := tr[1].Meta[ExemplarMetaKey]
+		assert.False(ok)
+	}
+	// the roots the concentrator got are untouched
+	_, ok := concentrated.Root.Meta[ExemplarMetaKey]
+	assert.False(ok)
+	assert.Equal(0.5, concentrated.Root.Metrics[sampler.SampleRateMetricKey])
+
+	// traces are only kept once, and forgotten after a few flushes
+	assert.Len(s.FlushExemplars(stats), 0)
+	s.Add(exemplarTrace(6, 1000))
+	for i := 0; i < exemplarGenerations; i++ {
+		s.FlushExemplars(nil)
+	}
+	assert.Len(s.FlushExemplars(exemplarStats(exemplarTrace(6, 1000))), 0)
+}
+
+func TestExemplarBufferBudget(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newExemplarBuffer(100)
+	var traces []processedTrace
+	for i := uint64(1); i <= 50; i++ {
+		tr := exemplarTrace(i, int64(i)*100)
+		traces = append(traces, tr)
+		b.add(tr.Trace, tr.Root, i%10 == 0)
+	}
+
+	kept, retention := b.keep(exemplarStats(traces...), 3)
+	assert.Len(kept, 3)
+	first := make(map[uint64]bool)
+	for _, tr := range kept {
+		first[tr[0].TraceID] = true
+	}
+	// the tail quantiles are covered first
+	assert.Equal(exemplarQuantiles[0], retention[0].quantile)
+	assert.Equal(retention[0].total, retention[0].retained)
+	total, retained := int64(0), int64(0)
+	for _, r := range retention {
+		total += r.total
+		retained += r.retained
+	}
+	assert.True(retained < total)
+
+	// a second flush doesn't keep them again
+	kept, _ = b.keep(exemplarStats(traces...), 100)
+	assert.NotEmpty(kept)
+	for _, tr := range kept {
+		assert.False(first[tr[0].TraceID])
+	}
+}
+
+func TestExemplarBufferMaxTraces(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newExemplarBuffer(2)
+	for i := uint64(1); i <= 4; i++ {
+		addExemplarTrace(b, exemplarTrace(i, 100), false)
+	}
+	// sampled traces don't count
+	addExemplarTrace(b, exemplarTrace(5, 100), true)
+	assert.Equal(int64(2), b.dropped)
+	assert.NotNil(b.get(1))
+	// only top-level and measured spans are indexed
+	assert.Nil(b.get(1001))
+	assert.Nil(b.get(3))
+	assert.NotNil(b.get(5))
+
+	b.rotate()
+	assert.Equal(int64(0), b.dropped)
+	addExemplarTrace(b, exemplarTrace(6, 100), false)
+	assert.Nil(b.get(6))
+	for i := 1; i < exemplarGenerations; i++ {
+		b.rotate()
+	}
+	assert.Nil(b.get(1))
+	addExemplarTrace(b, exemplarTrace(6, 100), false)
+	assert.NotNil(b.get(6))
+}
+
+func TestExemplarBufferMaxSpans(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newExemplarBuffer(100)
+	b.maxSpans = 2
+	addExemplarTrace(b, exemplarTrace(1, 100), true)
+	addExemplarTrace(b, exemplarTrace(2, 100), false)
+	assert.NotNil(b.get(1))
+	assert.NotNil(b.get(2))
+
+	// the index is bounded, sampled traces included
+	addExemplarTrace(b, exemplarTrace(3, 100), true)
+	addExemplarTrace(b, exemplarTrace(4, 100), false)
+	assert.Nil(b.get(3))
+	assert.Nil(b.get(4))
+	assert.Equal(int64(1), b.dropped)
+}
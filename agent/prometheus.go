@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/quantile"
+)
+
+// PrometheusExporter exposes the hits, errors and duration of the stats grains
+// flushed by the concentrator, and internal counters of the agent, in the
+// Prometheus text format. Prometheus expecting counters, stats are accumulated
+// across flushes.
+type PrometheusExporter struct {
+	buckets   []float64 // upper bounds of the duration histograms, in seconds
+	maxSeries int
+	receiver  *receiverStats
+
+	mu      sync.Mutex
+	grains  map[string]*promGrain // by name and aggregation
+	series  int                   // number of series of the grains
+	dropped int64                 // flushed grains which were not exposed because of maxSeries
+}
+
+// promGrain holds the cumulative stats of a grain
+type promGrain struct {
+	labels string // formatted label pairs, e.g. `env="prod",name="http.request"`
+
+	hits        float64
+	errors      float64
+	durationSum float64   // in seconds
+	count       float64   // number of durations in the histogram
+	bucketCount []float64 // durations up to each bucket bound
+}
+
+// NewPrometheusExporter returns an exporter of the stats, and of the counters of the receiver
+func NewPrometheusExporter(conf *config.AgentConfig, receiver *receiverStats) *PrometheusExporter {
+	return &PrometheusExporter{
+		buckets:   conf.PrometheusBuckets,
+		maxSeries: conf.PrometheusMaxSeries,
+		receiver:  receiver,
+		grains:    make(map[string]*promGrain),
+	}
+}
+
+// seriesPerGrain is the number of series exposed for a grain: hits, errors,
+// and the histogram buckets, +Inf, sum and count
+func (e *PrometheusExporter) seriesPerGrain() int {
+	return 2 + len(e.buckets) + 3
+}
+
+// Add accumulates the stats of flushed buckets
+func (e *PrometheusExporter) Add(buckets []model.StatsBucket) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, b := range buckets {
+		for _, c := range b.Counts {
+			// grains are found by their hits, extra counts such as sublayers
+			// or error types are not exposed
+			if c.Measure != model.HITS {
+				continue
+			}
+			aggr := model.GrainAggregation(c.Key, c.Name, c.Measure)
+
+			g := e.grain(c.Name, aggr, c.TagSet)
+			if g == nil {
+				continue
+			}
+			g.hits += c.Value
+			g.errors += b.Counts[model.GrainKey(c.Name, model.ERRORS, aggr)].Value
+			g.durationSum += b.Counts[model.GrainKey(c.Name, model.DURATION, aggr)].Value / 1e9
+			if d, ok := b.Distributions[model.GrainKey(c.Name, model.DURATION, aggr)]; ok {
+				g.observe(d.Summary, e.buckets)
+			}
+		}
+	}
+}
+
+// grain returns the stats of the grain, nil if it can't be exposed
+func (e *PrometheusExporter) grain(name, aggr string, tags model.TagSet) *promGrain {
+	key := name + "|" + aggr
+	if g, ok := e.grains[key]; ok {
+		return g
+	}
+	if e.series+e.seriesPerGrain() > e.maxSeries {
+		if e.dropped == 0 {
+			log.Warnf("too many series for the Prometheus endpoint, stats of new grains are not exposed (max: %d)", e.maxSeries)
+		}
+		e.dropped++
+		return nil
+	}
+
+	g := &promGrain{
+		labels:      promLabels(name, tags),
+		bucketCount: make([]float64, len(e.buckets)),
+	}
+	e.grains[key] = g
+	e.series += e.seriesPerGrain()
+	return g
+}
+
+// observe adds the durations of the summary, in nanoseconds, to the histogram
+func (g *promGrain) observe(s quantile.Sketch, buckets []float64) {
+	for j, bound := range buckets {
+		g.bucketCount[j] += float64(s.Rank(bound * 1e9))
+	}
+	g.count += float64(s.Count())
+}
+
+// promLabels formats the labels of a grain, tag names being sanitized
+func promLabels(name string, tags model.TagSet) string {
+	pairs := make([]string, 0, len(tags)+1)
+	pairs = append(pairs, promLabel("name", name))
+	seen := map[string]bool{"name": true}
+	for _, t := range tags {
+		label := promTagLabel(t.Name)
+		if seen[label] {
+			// tags only differing by characters not allowed in labels
+			continue
+		}
+		seen[label] = true
+		pairs = append(pairs, promLabel(label, t.Value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// promTagLabel returns the label of a tag, prefixed with tag_ if it is one of
+// the labels set by the exporter or by Prometheus itself
+func promTagLabel(tag string) string {
+	label := promName(tag)
+	if label == "name" || label == "le" || strings.HasPrefix(label, "__") {
+		return "tag_" + label
+	}
+	return label
+}
+
+func promLabel(name, value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return name + `="` + value + `"`
+}
+
+// promName replaces the characters not allowed in Prometheus names by '_'
+func promName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')) {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func promFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format
+func (e *PrometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(e.format())
+}
+
+func (e *PrometheusExporter) format() []byte {
+	var b bytes.Buffer
+
+	family := func(name, typ, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	rs := e.receiver.load()
+	family("trace_agent_receiver_traces_total", "counter", "Traces received by the agent.")
+	fmt.Fprintf(&b, "trace_agent_receiver_traces_total %d\n", rs.TracesReceived)
+	family("trace_agent_receiver_spans_total", "counter", "Spans received by the agent.")
+	fmt.Fprintf(&b, "trace_agent_receiver_spans_total %d\n", rs.SpansReceived)
+	family("trace_agent_receiver_traces_dropped_total", "counter", "Traces dropped by the agent because they were invalid.")
+	fmt.Fprintf(&b, "trace_agent_receiver_traces_dropped_total %d\n", rs.TracesDropped)
+	family("trace_agent_receiver_spans_dropped_total", "counter", "Spans dropped by the agent because they were invalid.")
+	fmt.Fprintf(&b, "trace_agent_receiver_spans_dropped_total %d\n", rs.SpansDropped)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	family("trace_agent_prometheus_series", "gauge", "Series exposed for the stats grains.")
+	fmt.Fprintf(&b, "trace_agent_prometheus_series %d\n", e.series)
+	family("trace_agent_prometheus_series_dropped_total", "counter", "Flushed stats grains not exposed because of the series limit.")
+	fmt.Fprintf(&b, "trace_agent_prometheus_series_dropped_total %d\n", e.dropped)
+
+	grains := make([]*promGrain, 0, len(e.grains))
+	for _, g := range e.grains {
+		grains = append(grains, g)
+	}
+	sort.Sort(promGrainsByLabels(grains))
+
+	family("trace_hits_total", "counter", "Spans of the grain.")
+	for _, g := range grains {
+		fmt.Fprintf(&b, "trace_hits_total{%s} %s\n", g.labels, promFloat(g.hits))
+	}
+	family("trace_errors_total", "counter", "Erroneous spans of the grain.")
+	for _, g := range grains {
+		fmt.Fprintf(&b, "trace_errors_total{%s} %s\n", g.labels, promFloat(g.errors))
+	}
+	family("trace_duration_seconds", "histogram", "Duration of the spans of the grain, estimated from the stats summaries.")
+	for _, g := range grains {
+		for i, bound := range e.buckets {
+			fmt.Fprintf(&b, "trace_duration_seconds_bucket{%s,le=\"%s\"} %s\n", g.labels, promFloat(bound), promFloat(g.bucketCount[i]))
+		}
+		fmt.Fprintf(&b, "trace_duration_seconds_bucket{%s,le=\"+Inf\"} %s\n", g.labels, promFloat(g.count))
+		fmt.Fprintf(&b, "trace_duration_seconds_sum{%s} %s\n", g.labels, promFloat(g.durationSum))
+		fmt.Fprintf(&b, "trace_duration_seconds_count{%s} %s\n", g.labels, promFloat(g.count))
+	}
+
+	return b.Bytes()
+}
+
+type promGrainsByLabels []*promGrain
+
+func (g promGrainsByLabels) Len() int           { return len(g) }
+func (g promGrainsByLabels) Swap(i, j int)      { g[i], g[j] = g[j], g[i] }
+func (g promGrainsByLabels) Less(i, j int) bool { return g[i].labels < g[j].labels }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func testPrometheusBucket(spans ...model.Span) model.StatsBucket {
+	srb := model.NewStatsRawBucket(0, 1e9)
+	for _, s := range spans {
+		srb.HandleSpan(s, "prod", []string{"http.status_class"}, nil)
+	}
+	return srb.Export()
+}
+
+func TestPrometheusExporter(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.PrometheusBuckets = []float64{0.01, 0.1, 1}
+	stats := &receiverStats{TracesReceived: 3, SpansReceived: 12, TracesDropped: 1}
+	e := NewPrometheusExporter(conf, stats)
+
+	span := func(d int64, err int32) model.Span {
+		return model.Span{Name: "http.request", Service: "web", Resource: `GET "/"`, Duration: d, Error: err,
+			Meta: map[string]string{"http.status_code": "200"}}
+	}
+	e.Add([]model.StatsBucket{testPrometheusBucket(span(5e6, 0), span(50e6, 1))})
+	// stats are accumulated across flushes
+	e.Add([]model.StatsBucket{testPrometheusBucket(span(2e9, 0))})
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if !assert.Nil(err) {
+		t.FailNow()
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal("text/plain; version=0.0.4", resp.Header.Get("Content-Type"))
+
+	labels := `env="prod",http_status_class="2xx",name="http.request",resource="GET \"/\"",service="web"`
+	for _, line := range []string{
+		"# TYPE trace_hits_total counter",
+		"trace_hits_total{" + labels + "} 3",
+		"trace_errors_total{" + labels + "} 1",
+		"# TYPE trace_duration_seconds histogram",
+		"trace_duration_seconds_bucket{" + labels + `,le="0.01"} 1`,
+		"trace_duration_seconds_bucket{" + labels + `,le="0.1"} 2`,
+		"trace_duration_seconds_bucket{" + labels + `,le="1"} 2`,
+		"trace_duration_seconds_bucket{" + labels + `,le="+Inf"} 3`,
+		"trace_duration_seconds_sum{" + labels + "} 2.055",
+		"trace_duration_seconds_count{" + labels + "} 3",
+		"trace_agent_receiver_traces_total 3",
+		"trace_agent_receiver_spans_total 12",
+		"trace_agent_receiver_traces_dropped_total 1",
+		"trace_agent_prometheus_series 8",
+		"trace_agent_prometheus_series_dropped_total 0",
+	} {
+		assert.Contains(string(body), line+"\n")
+	}
+}
+
+func TestPrometheusExporterMaxSeries(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.PrometheusBuckets = []float64{1}
+	conf.PrometheusMaxSeries = 13 // room for 2 grains of 6 series
+	e := NewPrometheusExporter(conf, &receiverStats{})
+
+	var spans []model.Span
+	for _, r := range []string{"a", "b", "c"} {
+		spans = append(spans, model.Span{Name: "request", Service: "web", Resource: r})
+	}
+	e.Add([]model.StatsBucket{testPrometheusBucket(spans...)})
+	// known grains are still updated
+	e.Add([]model.StatsBucket{testPrometheusBucket(spans...)})
+
+	out := string(e.format())
+	assert.Equal(2, strings.Count(out, "trace_hits_total{"))
+	assert.Contains(out, "trace_agent_prometheus_series 12\n")
+	assert.Contains(out, "trace_agent_prometheus_series_dropped_total 2\n")
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "trace_hits_total{") {
+			assert.True(strings.HasSuffix(line, "} 2"), line)
+		}
+	}
+}
+
+func TestPromName(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("http_status_class", promName("http.status_class"))
+	assert.Equal("_a_b", promName("1a-b"))
+}
+
+func TestPromLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	// tags can't override the labels of the exporter
+	tags := model.TagSet{
+		{Name: "service", Value: "web"},
+		{Name: "name", Value: "x"},
+		{Name: "le", Value: "y"},
+		{Name: "__meta", Value: "z"},
+		{Name: "a.b", Value: "1"},
+		{Name: "a_b", Value: "2"},
+	}
+	assert.Equal(`a_b="1",name="web.request",service="web",tag___meta="z",tag_le="y",tag_name="x"`,
+		promLabels("web.request", tags))
+}
@@ -57,6 +57,11 @@ type HTTPReceiver struct {
 	logger *errorLogger
 	stats  receiverStats
 
+	// optional handler of the /metrics endpoint
+	metrics http.Handler
+	// optional handler of the /stats/query endpoint
+	statsQuery http.Handler
+
 	exit chan struct{}
 }
 
@@ -87,6 +92,13 @@ func (r *HTTPReceiver) Run() {
 	http.HandleFunc("/v0.3/traces", httpHandleWithVersion(v03, r.handleTraces))
 	http.HandleFunc("/v0.3/services", httpHandleWithVersion(v03, r.handleServices))
 
+	if r.metrics != nil {
+		http.Handle("/metrics", r.metrics)
+	}
+	if r.statsQuery != nil {
+		http.Handle("/stats/query", r.statsQuery)
+	}
+
 	addr := fmt.Sprintf("%s:%d", r.conf.ReceiverHost, r.conf.ReceiverPort)
 	log.Infof("listening for traces at http://%s/", addr)
 
@@ -266,19 +278,16 @@ func (r *HTTPReceiver) handleServices(v APIVersion, w http.ResponseWriter, req *
 
 // logStats periodically submits stats about the receiver to statsd
 func (r *HTTPReceiver) logStats() {
+	var last receiverStats
 	for range time.Tick(60 * time.Second) {
-		// Load counters and reset them for the next flush
-		spans := atomic.LoadInt64(&r.stats.SpansReceived)
-		r.stats.SpansReceived = 0
-
-		traces := atomic.LoadInt64(&r.stats.TracesReceived)
-		r.stats.TracesReceived = 0
+		// counters are cumulative, report what was handled since the last flush
+		cur := r.stats.load()
 
-		sdropped := atomic.LoadInt64(&r.stats.SpansDropped)
-		r.stats.SpansDropped = 0
-
-		tdropped := atomic.LoadInt64(&r.stats.TracesDropped)
-		r.stats.TracesDropped = 0
+		spans := cur.SpansReceived - last.SpansReceived
+		traces := cur.TracesReceived - last.TracesReceived
+		sdropped := cur.SpansDropped - last.SpansDropped
+		tdropped := cur.TracesDropped - last.TracesDropped
+		last = cur
 
 		statsd.Client.Count("trace_agent.receiver.span", spans, nil, 1)
 		statsd.Client.Count("trace_agent.receiver.trace", traces, nil, 1)
@@ -290,9 +299,20 @@ func (r *HTTPReceiver) logStats() {
 	}
 }
 
+// receiverStats are the cumulative counters of the receiver
 type receiverStats struct {
 	SpansReceived  int64
 	TracesReceived int64
 	SpansDropped   int64
 	TracesDropped  int64
 }
+
+// load returns a copy of the counters, safe to use concurrently with their updates
+func (s *receiverStats) load() receiverStats {
+	return receiverStats{
+		SpansReceived:  atomic.LoadInt64(&s.SpansReceived),
+		TracesReceived: atomic.LoadInt64(&s.TracesReceived),
+		SpansDropped:   atomic.LoadInt64(&s.SpansDropped),
+		TracesDropped:  atomic.LoadInt64(&s.TracesDropped),
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"sync"
+	"time"
 
 	log "github.com/cihub/seelog"
 )
@@ -12,11 +13,23 @@ var maxPerInterval int64 = 10
 type errorLogger struct {
 	errors int64
 	sync.Mutex
+
+	// if set, the logger resets itself once this interval elapsed since it
+	// last started counting, instead of waiting for Reset
+	interval time.Duration
+	since    time.Time
 }
 
 func (l *errorLogger) Errorf(format string, params ...interface{}) {
 	l.Lock()
 
+	if l.interval > 0 {
+		if now := time.Now(); now.Sub(l.since) >= l.interval {
+			l.reset()
+			l.since = now
+		}
+	}
+
 	if l.errors < maxPerInterval {
 		log.Errorf(format, params...)
 	}
@@ -30,9 +43,13 @@ func (l *errorLogger) Errorf(format string, params ...interface{}) {
 
 func (l *errorLogger) Reset() {
 	l.Lock()
+	l.reset()
+	l.Unlock()
+}
+
+func (l *errorLogger) reset() {
 	if l.errors > maxPerInterval {
 		log.Infof("skipped %d error messages", l.errors-maxPerInterval)
 	}
 	l.errors = 0
-	l.Unlock()
 }
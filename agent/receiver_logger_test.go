@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorLoggerInterval(t *testing.T) {
+	assert := assert.New(t)
+
+	l := &errorLogger{interval: time.Minute}
+	for i := 0; i < 3; i++ {
+		l.Errorf("error %d", i)
+	}
+	assert.Equal(int64(3), l.errors)
+
+	// counting starts again once the interval elapsed
+	l.since = l.since.Add(-time.Minute)
+	l.Errorf("error")
+	assert.Equal(int64(1), l.errors)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"sync"
+
 	log "github.com/cihub/seelog"
 
 	"github.com/DataDog/datadog-trace-agent/config"
@@ -17,6 +19,12 @@ type Sampler struct {
 	traceCount int
 
 	samplerEngine SamplerEngine
+
+	// rejected traces which may still be kept as exemplars of the stats, nil if disabled
+	exemplars         *exemplarBuffer
+	exemplarMaxTraces int // max exemplars kept per flush
+
+	mu sync.Mutex
 }
 
 // SamplerEngine cares about telling if a trace is a proper sample or not
@@ -28,11 +36,16 @@ type SamplerEngine interface {
 
 // NewSampler creates a new empty sampler ready to be started
 func NewSampler(conf *config.AgentConfig) *Sampler {
-	return &Sampler{
+	s := &Sampler{
 		sampledTraces: []model.Trace{},
 		traceCount:    0,
 		samplerEngine: sampler.NewSampler(conf.ExtraSampleRate, conf.MaxTPS),
 	}
+	if conf.ExemplarMaxTraces > 0 {
+		s.exemplars = newExemplarBuffer(conf.ExemplarBufferSize)
+		s.exemplarMaxTraces = conf.ExemplarMaxTraces
+	}
+	return s
 }
 
 // Run starts sampling traces
@@ -42,10 +55,18 @@ func (s *Sampler) Run() {
 
 // Add samples a trace then keep it until the next flush
 func (s *Sampler) Add(t processedTrace) {
+	sampled := s.samplerEngine.Sample(t.Trace, t.Root, t.Env)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.traceCount++
-	if s.samplerEngine.Sample(t.Trace, t.Root, t.Env) {
+	if sampled {
 		s.sampledTraces = append(s.sampledTraces, t.Trace)
 	}
+	if s.exemplars != nil {
+		s.exemplars.add(t.Trace, t.Root, sampled)
+	}
 }
 
 // Stop stops the sampler
@@ -55,10 +76,12 @@ func (s *Sampler) Stop() {
 
 // Flush returns representative spans based on GetSamples and reset its internal memory
 func (s *Sampler) Flush() []model.Trace {
+	s.mu.Lock()
 	traces := s.sampledTraces
 	s.sampledTraces = []model.Trace{}
 	traceCount := s.traceCount
 	s.traceCount = 0
+	s.mu.Unlock()
 
 	statsd.Client.Count("trace_agent.sampler.trace.kept", int64(len(traces)), nil, 1)
 	statsd.Client.Count("trace_agent.sampler.trace.total", int64(traceCount), nil, 1)
@@ -66,3 +89,29 @@ func (s *Sampler) Flush() []model.Trace {
 
 	return traces
 }
+
+// FlushExemplars returns the rejected traces that the distributions of the
+// flushed stats retained as samples, within the budget of exemplars per flush,
+// and forgets the oldest rejected traces
+func (s *Sampler) FlushExemplars(stats []model.StatsBucket) []model.Trace {
+	if s.exemplars == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	traces, retention := s.exemplars.keep(stats, s.exemplarMaxTraces)
+	dropped := s.exemplars.dropped
+	s.exemplars.rotate()
+	s.mu.Unlock()
+
+	for _, r := range retention {
+		tags := []string{"quantile:" + quantileSuffix(r.quantile)}
+		statsd.Client.Count("trace_agent.sampler.exemplars.total", r.total, tags, 1)
+		statsd.Client.Count("trace_agent.sampler.exemplars.retained", r.retained, tags, 1)
+	}
+	statsd.Client.Count("trace_agent.sampler.exemplars.kept", int64(len(traces)), nil, 1)
+	statsd.Client.Count("trace_agent.sampler.exemplars.dropped", dropped, nil, 1)
+	log.Debugf("kept %d exemplar traces", len(traces))
+
+	return traces
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/statsd"
+)
+
+const (
+	scrubStrategyMask = "mask"
+	scrubStrategyHash = "hash"
+	scrubStrategyDrop = "drop"
+
+	// scrubMask replaces sensitive data when using the mask strategy
+	scrubMask = "?"
+)
+
+// builtinScrubRule is a detector shipped with the agent that can be enabled by name
+type builtinScrubRule struct {
+	pattern  string
+	validate func(match string) bool
+}
+
+var builtinScrubRules = map[string]builtinScrubRule{
+	// 13 to 19 digits, optionally separated by spaces or dashes, Luhn-validated
+	"credit_card":  {`\b(?:\d[ -]?){12,18}\d\b`, isLuhnValid},
+	"email":        {`[a-zA-Z0-9._%+\-]+@[a-zA-Z0-9.\-]+\.[a-zA-Z]{2,}`, nil},
+	"bearer_token": {`(?i)\bbearer\s+[a-z0-9\-._~+/]+=*`, nil},
+	"ssn":          {`\b\d{3}-\d{2}-\d{4}\b`, nil},
+}
+
+type scrubRule struct {
+	name     string
+	re       *regexp.Regexp
+	validate func(match string) bool // optional extra check on each match
+	keys     map[string]struct{}     // meta keys this rule applies to, nil means all of them
+	resource bool                    // whether it applies to the span resource
+	strategy string
+	hashKey  []byte // HMAC key of the hash strategy
+
+	matches int64
+}
+
+// appliesTo tells if this rule should scrub the value of the given meta key
+func (r *scrubRule) appliesTo(key string) bool {
+	if r.keys == nil {
+		return true
+	}
+	_, ok := r.keys[key]
+	return ok
+}
+
+// replace returns v with every sensitive match replaced according to the rule
+// strategy, and whether anything matched at all
+func (r *scrubRule) replace(v string) (string, bool) {
+	matched := false
+	out := r.re.ReplaceAllStringFunc(v, func(m string) string {
+		if r.validate != nil && !r.validate(m) {
+			return m
+		}
+		matched = true
+		r.matches++
+
+		if r.strategy == scrubStrategyHash {
+			// keyed, as the unsalted hash of low-entropy data such as an SSN
+			// could be reversed by brute force
+			h := hmac.New(sha256.New, r.hashKey)
+			h.Write([]byte(m))
+			return hex.EncodeToString(h.Sum(nil)[:8])
+		}
+		return scrubMask
+	})
+	return out, matched
+}
+
+// Scrubber removes sensitive data (PII, credentials...) from spans before
+// they are aggregated or sampled, so that it never leaves the host
+type Scrubber struct {
+	rules []*scrubRule
+}
+
+// NewScrubber creates a scrubber from the built-in and user-defined rules of the config
+func NewScrubber(conf *config.AgentConfig) *Scrubber {
+	s := &Scrubber{}
+	if !conf.ScrubbingEnabled {
+		return s
+	}
+
+	for _, name := range conf.ScrubbingBuiltins {
+		if name == "" {
+			continue
+		}
+		b, ok := builtinScrubRules[name]
+		if !ok {
+			log.Errorf("unknown built-in scrubbing rule %s, skipping it", name)
+			continue
+		}
+		s.rules = append(s.rules, &scrubRule{
+			name:     name,
+			re:       regexp.MustCompile(b.pattern),
+			validate: b.validate,
+			resource: true,
+			strategy: scrubStrategyMask,
+		})
+	}
+
+	hashKey := []byte(conf.ScrubbingHashKey)
+
+	for _, r := range conf.ScrubbingRules {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			log.Errorf("invalid pattern for scrubbing rule %s, skipping it: %v", r.Name, err)
+			continue
+		}
+
+		switch r.Strategy {
+		case scrubStrategyMask, scrubStrategyHash, scrubStrategyDrop:
+		default:
+			log.Errorf("invalid strategy %s for scrubbing rule %s, skipping it", r.Strategy, r.Name)
+			continue
+		}
+
+		rule := &scrubRule{name: r.Name, re: re, resource: r.Resource || len(r.Keys) == 0, strategy: r.Strategy}
+		if r.Strategy == scrubStrategyHash {
+			if len(hashKey) == 0 {
+				log.Warn("no scrubbing hash_key configured, using a random one: hashes won't be stable across restarts")
+				hashKey = make([]byte, 32)
+				rand.Read(hashKey)
+			}
+			rule.hashKey = hashKey
+		}
+		if len(r.Keys) > 0 {
+			rule.keys = make(map[string]struct{}, len(r.Keys))
+			for _, k := range r.Keys {
+				rule.keys[k] = struct{}{}
+			}
+		}
+		s.rules = append(s.rules, rule)
+	}
+
+	return s
+}
+
+// Scrub applies all the rules, in order, to the resource and meta of the span
+func (s *Scrubber) Scrub(span *model.Span) {
+	for _, r := range s.rules {
+		if r.resource {
+			// the resource is mandatory so it can't be dropped, mask it instead
+			if res, ok := r.replace(span.Resource); ok {
+				if r.strategy == scrubStrategyDrop {
+					res = scrubMask
+				}
+				span.Resource = res
+			}
+		}
+
+		for k, v := range span.Meta {
+			if !r.appliesTo(k) {
+				continue
+			}
+			v, ok := r.replace(v)
+			if !ok {
+				continue
+			}
+			if r.strategy == scrubStrategyDrop {
+				delete(span.Meta, k)
+			} else {
+				span.Meta[k] = v
+			}
+		}
+	}
+}
+
+// Flush reports and resets the per-rule match counters
+func (s *Scrubber) Flush() {
+	for _, r := range s.rules {
+		statsd.Client.Count("trace_agent.scrubber.matches", r.matches, []string{"rule:" + r.name}, 1)
+		if r.matches > 0 {
+			log.Debugf("scrubbing rule %s matched %d times", r.name, r.matches)
+		}
+		r.matches = 0
+	}
+}
+
+// isLuhnValid tells if the digits of the given string pass the Luhn checksum,
+// ignoring any separator
+func isLuhnValid(s string) bool {
+	var sum, n int
+	double := false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+		n++
+	}
+	return n >= 13 && n <= 19 && sum%10 == 0
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+func newTestScrubber(rules ...config.ScrubRule) *Scrubber {
+	conf := config.NewDefaultAgentConfig()
+	conf.ScrubbingEnabled = true
+	conf.ScrubbingRules = rules
+	return NewScrubber(conf)
+}
+
+func TestScrubberDisabled(t *testing.T) {
+	assert := assert.New(t)
+	s := NewScrubber(config.NewDefaultAgentConfig())
+
+	span := model.Span{Resource: "GET /users/john@doe.com", Meta: map[string]string{"user": "john@doe.com"}}
+	s.Scrub(&span)
+	assert.Equal("GET /users/john@doe.com", span.Resource)
+	assert.Equal("john@doe.com", span.Meta["user"])
+}
+
+func TestScrubberBuiltins(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestScrubber()
+
+	span := model.Span{
+		Resource: "GET /users/john@doe.com",
+		Meta: map[string]string{
+			"card":      "paid with 4111 1111 1111 1111 today",
+			"not_card":  "order 4111 1111 1111 1112",
+			"auth":      "Authorization: Bearer abc.DEF-123_xyz==",
+			"ssn":       "ssn=078-05-1120",
+			"http.url":  "/health",
+			"sql.query": "SELECT * FROM users WHERE email = ?",
+		},
+	}
+	s.Scrub(&span)
+
+	assert.Equal("GET /users/?", span.Resource)
+	assert.Equal("paid with ? today", span.Meta["card"])
+	assert.Equal("order 4111 1111 1111 1112", span.Meta["not_card"])
+	assert.Equal("Authorization: ?", span.Meta["auth"])
+	assert.Equal("ssn=?", span.Meta["ssn"])
+	assert.Equal("/health", span.Meta["http.url"])
+	assert.Equal("SELECT * FROM users WHERE email = ?", span.Meta["sql.query"])
+}
+
+func TestScrubberUserRules(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestScrubber(
+		config.ScrubRule{Name: "customer", Pattern: `cust-\d+`, Keys: []string{"customer"}, Strategy: "hash"},
+		config.ScrubRule{Name: "secret", Pattern: `s3cr3t`, Strategy: "drop"},
+	)
+
+	span := model.Span{
+		Resource: "POST /login s3cr3t",
+		Meta: map[string]string{
+			"customer": "cust-42",
+			"other":    "cust-42",
+			"password": "s3cr3t",
+		},
+	}
+	s.Scrub(&span)
+
+	assert.Equal("?", span.Resource)
+	assert.NotEqual("cust-42", span.Meta["customer"])
+	assert.Len(span.Meta["customer"], 16)
+	assert.Equal("cust-42", span.Meta["other"])
+	_, ok := span.Meta["password"]
+	assert.False(ok)
+
+	// hashing is stable so that values can still be correlated
+	span2 := model.Span{Meta: map[string]string{"customer": "cust-42"}}
+	s.Scrub(&span2)
+	assert.Equal(span.Meta["customer"], span2.Meta["customer"])
+
+	// per-rule match counters
+	counts := make(map[string]int64)
+	for _, r := range s.rules {
+		counts[r.name] = r.matches
+	}
+	assert.Equal(int64(2), counts["customer"])
+	assert.Equal(int64(2), counts["secret"])
+
+	s.Flush()
+	for _, r := range s.rules {
+		assert.Equal(int64(0), r.matches)
+	}
+}
+
+func TestScrubberHashKey(t *testing.T) {
+	assert := assert.New(t)
+
+	hash := func(key string) string {
+		conf := config.NewDefaultAgentConfig()
+		conf.ScrubbingEnabled = true
+		conf.ScrubbingBuiltins = nil
+		conf.ScrubbingHashKey = key
+		conf.ScrubbingRules = []config.ScrubRule{{Name: "ssn", Pattern: `\d{3}-\d{2}-\d{4}`, Strategy: "hash"}}
+		span := model.Span{Meta: map[string]string{"ssn": "078-05-1120"}}
+		NewScrubber(conf).Scrub(&span)
+		return span.Meta["ssn"]
+	}
+
+	// hashes are keyed, and stable for a given key
+	assert.Equal(hash("k1"), hash("k1"))
+	assert.NotEqual(hash("k1"), hash("k2"))
+	// a random key is used if none is configured
+	assert.NotEqual(hash(""), hash(""))
+	assert.Len(hash(""), 16)
+}
+
+func TestScrubberResource(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestScrubber(
+		config.ScrubRule{Name: "keyed", Pattern: `cust-\d+`, Keys: []string{"customer"}, Strategy: "mask"},
+		config.ScrubRule{Name: "with_resource", Pattern: `acct-\d+`, Keys: []string{"account"}, Resource: true, Strategy: "mask"},
+	)
+
+	span := model.Span{
+		Resource: "GET /customers/cust-42/accounts/acct-7",
+		Meta:     map[string]string{"resource": "cust-42", "customer": "cust-42"},
+	}
+	s.Scrub(&span)
+
+	assert.Equal("GET /customers/cust-42/accounts/?", span.Resource)
+	assert.Equal("?", span.Meta["customer"])
+	// a meta key named resource is just a meta key
+	assert.Equal("cust-42", span.Meta["resource"])
+}
+
+func TestScrubberInvalidRules(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestScrubber(
+		config.ScrubRule{Name: "bad_pattern", Pattern: `(`, Strategy: "mask"},
+		config.ScrubRule{Name: "bad_strategy", Pattern: `a`, Strategy: "shred"},
+	)
+
+	// only the built-ins remain
+	assert.Len(s.rules, len(builtinScrubRules))
+}
+
+func TestLuhn(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(isLuhnValid("4111111111111111"))
+	assert.True(isLuhnValid("4111-1111-1111-1111"))
+	assert.True(isLuhnValid("378282246310005"))
+	assert.False(isLuhnValid("4111111111111112"))
+	assert.False(isLuhnValid("0"))
+}
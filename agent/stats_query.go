@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/quantile"
+)
+
+// defaultQueryQuantiles are the quantiles returned when a query doesn't ask for any
+var defaultQueryQuantiles = []float64{0.5, 0.95, 0.99}
+
+// StatsHistory keeps the stats buckets flushed during the last minutes so that
+// they can be queried locally on the /stats/query endpoint of the receiver
+type StatsHistory struct {
+	history int64 // in nanoseconds
+
+	mu      sync.RWMutex
+	buckets []model.StatsBucket // sorted by end
+}
+
+// NewStatsHistory returns a history keeping the stats of the configured number of minutes
+func NewStatsHistory(conf *config.AgentConfig) *StatsHistory {
+	return &StatsHistory{history: (time.Duration(conf.StatsHistoryMinutes) * time.Minute).Nanoseconds()}
+}
+
+// end returns the end of the newest bucket, the history has to be locked
+func (h *StatsHistory) end() int64 {
+	if len(h.buckets) == 0 {
+		return 0
+	}
+	b := h.buckets[len(h.buckets)-1]
+	return b.Start + b.Duration
+}
+
+// Add adds flushed buckets to the history, and forgets the ones older than the
+// history relatively to the newest bucket
+func (h *StatsHistory) Add(buckets []model.StatsBucket) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, b := range buckets {
+		// buckets are flushed in order, except for late spans corrections
+		i := len(h.buckets)
+		for i > 0 && h.buckets[i-1].Start+h.buckets[i-1].Duration > b.Start+b.Duration {
+			i--
+		}
+		h.buckets = append(h.buckets, model.StatsBucket{})
+		copy(h.buckets[i+1:], h.buckets[i:])
+		h.buckets[i] = b
+	}
+
+	cutoff := h.end() - h.history
+	i := 0
+	for i < len(h.buckets) && h.buckets[i].Start+h.buckets[i].Duration <= cutoff {
+		i++
+	}
+	h.buckets = h.buckets[i:]
+}
+
+// statsQuery selects the grains of the stats in the history
+type statsQuery struct {
+	name      string
+	tags      model.TagSet // including service and resource
+	measure   string       // of the distribution
+	quantiles []float64
+	window    int64 // in nanoseconds before the newest bucket, 0 for the whole history
+}
+
+// statsQueryResult is the JSON answer to a query
+type statsQueryResult struct {
+	Name      string             `json:"name"`
+	Start     int64              `json:"start"`
+	End       int64              `json:"end"`
+	Buckets   int                `json:"buckets"`
+	Counts    map[string]float64 `json:"counts"` // by measure
+	Measure   string             `json:"measure"`
+	N         int                `json:"n"` // number of values of the distribution
+	Quantiles map[string]float64 `json:"quantiles"`
+}
+
+// match returns whether the query selects the grain
+func (q *statsQuery) match(name string, tags model.TagSet) bool {
+	if name != q.name {
+		return false
+	}
+	for _, t := range q.tags {
+		if tags.Get(t.Name) != t {
+			return false
+		}
+	}
+	return true
+}
+
+// Query sums the counts and merges the distributions of the grains selected
+// by the query
+func (h *StatsHistory) Query(q statsQuery) statsQueryResult {
+	res := statsQueryResult{
+		Name:      q.name,
+		Counts:    make(map[string]float64),
+		Measure:   q.measure,
+		Quantiles: make(map[string]float64),
+	}
+	var summary quantile.Sketch
+
+	h.mu.RLock()
+	end := h.end()
+	for _, b := range h.buckets {
+		if q.window > 0 && b.Start+b.Duration <= end-q.window {
+			continue
+		}
+		if res.Buckets == 0 || b.Start < res.Start {
+			res.Start = b.Start
+		}
+		if b.Start+b.Duration > res.End {
+			res.End = b.Start + b.Duration
+		}
+		res.Buckets++
+
+		for _, c := range b.Counts {
+			if q.match(c.Name, c.TagSet) {
+				res.Counts[c.Measure] += c.Value
+			}
+		}
+		for _, d := range b.Distributions {
+			if d.Measure == q.measure && q.match(d.Name, d.TagSet) {
+				// merging into a copy leaves the summaries of the history untouched
+				if summary == nil {
+					summary = d.Summary.Copy()
+				} else if err := summary.Merge(d.Summary); err != nil {
+					// sketches of another kind can't be merged, skip them
+					log.Debugf("stats query skipping distribution %s: %v", d.Key, err)
+				}
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	if summary != nil && summary.Count() > 0 {
+		res.N = summary.Count()
+		for _, qt := range q.quantiles {
+			v, _ := summary.Quantile(qt)
+			res.Quantiles[strconv.FormatFloat(qt, 'f', -1, 64)] = v
+		}
+	}
+	return res
+}
+
+// parseStatsQuery reads the query from the URL parameters: name (required),
+// service, resource, tag (repeated, as name:value), measure (default: duration),
+// quantiles (comma separated) and minutes
+func parseStatsQuery(r *http.Request) (statsQuery, error) {
+	params := r.URL.Query()
+	q := statsQuery{
+		name:      params.Get("name"),
+		measure:   params.Get("measure"),
+		quantiles: defaultQueryQuantiles,
+	}
+	if q.name == "" {
+		return q, fmt.Errorf("missing name")
+	}
+	if q.measure == "" {
+		q.measure = model.DURATION
+	}
+	if v := params.Get("service"); v != "" {
+		q.tags = append(q.tags, model.Tag{Name: "service", Value: v})
+	}
+	if v := params.Get("resource"); v != "" {
+		q.tags = append(q.tags, model.Tag{Name: "resource", Value: v})
+	}
+	for _, v := range params["tag"] {
+		t := model.NewTagFromString(v)
+		if t.Name == "" || t.Value == "" {
+			return q, fmt.Errorf("invalid tag %q, expected name:value", v)
+		}
+		q.tags = append(q.tags, t)
+	}
+	if v := params.Get("quantiles"); v != "" {
+		quantiles, err := config.ParseQuantiles(strings.Split(v, ","))
+		if err != nil {
+			return q, err
+		}
+		q.quantiles = quantiles
+	}
+	if v := params.Get("minutes"); v != "" {
+		minutes, err := strconv.ParseFloat(v, 64)
+		if err != nil || minutes <= 0 {
+			return q, fmt.Errorf("invalid minutes %q", v)
+		}
+		q.window = int64(minutes * float64(time.Minute))
+	}
+	return q, nil
+}
+
+// ServeHTTP answers a query of the stats, e.g.
+// /stats/query?name=web.request&service=X&minutes=1&quantiles=0.99
+func (h *StatsHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := parseStatsQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Query(q))
+}
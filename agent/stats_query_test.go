@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/quantile"
+	"github.com/stretchr/testify/assert"
+)
+
+func testHistoryBucket(start int64, spans ...model.Span) model.StatsBucket {
+	srb := model.NewStatsRawBucket(start, int64(time.Minute))
+	for _, s := range spans {
+		srb.HandleSpan(s, "prod", []string{"http.status_code"}, nil)
+	}
+	return srb.Export()
+}
+
+func testHistorySpan(service string, d int64, err int32) model.Span {
+	return model.Span{Name: "web.request", Service: service, Resource: "/", Duration: d, Error: err,
+		Meta: map[string]string{"http.status_code": "200"}}
+}
+
+func queryStatsHistory(t *testing.T, h *StatsHistory, query string) (int, statsQueryResult) {
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	var res statsQueryResult
+	resp, err := http.Get(server.URL + "/stats/query?" + query)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&res))
+	}
+	return resp.StatusCode, res
+}
+
+func TestStatsHistoryQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.StatsHistoryMinutes = 5
+	h := NewStatsHistory(conf)
+
+	minute := int64(time.Minute)
+	h.Add([]model.StatsBucket{testHistoryBucket(0,
+		testHistorySpan("web", 100, 0), testHistorySpan("web", 200, 1), testHistorySpan("db", 5, 0))})
+	h.Add([]model.StatsBucket{testHistoryBucket(minute,
+		testHistorySpan("web", 300, 0), testHistorySpan("web", 400, 0))})
+
+	code, res := queryStatsHistory(t, h, "name=web.request&service=web&quantiles=0,1")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(2, res.Buckets)
+	assert.Equal(int64(0), res.Start)
+	assert.Equal(2*minute, res.End)
+	assert.Equal(4.0, res.Counts[model.HITS])
+	assert.Equal(1.0, res.Counts[model.ERRORS])
+	assert.Equal(1000.0, res.Counts[model.DURATION])
+	assert.Equal(4, res.N)
+	assert.Equal(map[string]float64{"0": 100, "1": 400}, res.Quantiles)
+
+	// the window is relative to the newest bucket
+	_, res = queryStatsHistory(t, h, "name=web.request&service=web&minutes=1&quantiles=0.5")
+	assert.Equal(1, res.Buckets)
+	assert.Equal(2.0, res.Counts[model.HITS])
+	assert.Equal(2, res.N)
+
+	// tags filter the grains
+	_, res = queryStatsHistory(t, h, "name=web.request&tag=http.status_code:200")
+	assert.Equal(5.0, res.Counts[model.HITS])
+	_, res = queryStatsHistory(t, h, "name=web.request&resource=/&tag=http.status_code:500")
+	assert.Equal(0.0, res.Counts[model.HITS])
+	assert.Equal(0, res.N)
+	assert.Len(res.Quantiles, 0)
+
+	// merging doesn't alter the summaries of the history
+	_, res = queryStatsHistory(t, h, "name=web.request&service=web&quantiles=0,1")
+	assert.Equal(4, res.N)
+
+	code, _ = queryStatsHistory(t, h, "service=web")
+	assert.Equal(http.StatusBadRequest, code)
+	code, _ = queryStatsHistory(t, h, "name=web.request&quantiles=2")
+	assert.Equal(http.StatusBadRequest, code)
+	code, _ = queryStatsHistory(t, h, "name=web.request&tag=env")
+	assert.Equal(http.StatusBadRequest, code)
+}
+
+func TestStatsHistoryMixedSketches(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.StatsHistoryMinutes = 5
+	h := NewStatsHistory(conf)
+
+	minute := int64(time.Minute)
+	logSketches := &model.StatsOptions{NewSketch: func() quantile.Sketch { return quantile.NewLogSketch(0.01) }}
+	srb := model.NewStatsRawBucketWithOptions(minute, minute, logSketches)
+	srb.HandleSpan(testHistorySpan("web", 300, 0), "prod", nil, nil)
+	h.Add([]model.StatsBucket{testHistoryBucket(0, testHistorySpan("web", 100, 0)), srb.Export()})
+
+	// sketches of another kind are skipped rather than merged
+	code, res := queryStatsHistory(t, h, "name=web.request&service=web")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(2.0, res.Counts[model.HITS])
+	assert.Equal(1, res.N)
+}
+
+func TestStatsHistoryExpiration(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.StatsHistoryMinutes = 2
+	h := NewStatsHistory(conf)
+
+	minute := int64(time.Minute)
+	for i := int64(0); i < 5; i++ {
+		h.Add([]model.StatsBucket{testHistoryBucket(i*minute, testHistorySpan("web", 100, 0))})
+	}
+	assert.Len(h.buckets, 2)
+	assert.Equal(3*minute, h.buckets[0].Start)
+
+	// late buckets are kept in order, and expire with their time
+	h.Add([]model.StatsBucket{testHistoryBucket(3*minute, testHistorySpan("web", 100, 0))})
+	h.Add([]model.StatsBucket{testHistoryBucket(0, testHistorySpan("web", 100, 0))})
+	assert.Len(h.buckets, 3)
+	for i := 1; i < len(h.buckets); i++ {
+		assert.True(h.buckets[i-1].Start <= h.buckets[i].Start)
+	}
+}
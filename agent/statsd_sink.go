@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/DataDog/datadog-trace-agent/statsd"
+)
+
+// statsdClient is the part of the DogStatsD client used by the stats sink
+type statsdClient interface {
+	Count(name string, value int64, tags []string, rate float64) error
+	Gauge(name string, value float64, tags []string, rate float64) error
+}
+
+// StatsdSink sends the stats flushed by the concentrator to DogStatsD: counts
+// as counts, and distributions as gauges of some of their quantiles, all of
+// them tagged with their grain
+type StatsdSink struct {
+	metricName string    // template of the metric names, see metric
+	quantiles  []float64 // quantiles of the distributions sent as gauges
+	client     statsdClient
+}
+
+// NewStatsdSink returns a sink sending the stats through the global statsd client
+func NewStatsdSink(conf *config.AgentConfig) *StatsdSink {
+	return &StatsdSink{
+		metricName: conf.StatsdSinkMetricName,
+		quantiles:  conf.StatsdSinkQuantiles,
+		client:     statsd.Client,
+	}
+}
+
+// metric returns the name of the metric of a measure, from the template where
+// {name} is replaced by the span name and {measure} by the measure, e.g.
+// trace.{name}.{measure} gives trace.http.request.hits
+func (s *StatsdSink) metric(name, measure string) string {
+	m := strings.Replace(s.metricName, "{name}", name, -1)
+	return strings.Replace(m, "{measure}", measure, -1)
+}
+
+// quantileSuffix returns the suffix of the gauge of a quantile, e.g. p99 for 0.99
+// and p999 for 0.999
+func quantileSuffix(q float64) string {
+	return "p" + strings.Replace(strconv.FormatFloat(q*100, 'f', -1, 64), ".", "", -1)
+}
+
+// Send sends the stats of the buckets
+func (s *StatsdSink) Send(buckets []model.StatsBucket) {
+	for _, b := range buckets {
+		for _, c := range b.Counts {
+			s.client.Count(s.metric(c.Name, c.Measure), int64(c.Value), statsdTags(c.TagSet), 1)
+		}
+		for _, d := range b.Distributions {
+			if d.Summary.Count() == 0 {
+				continue
+			}
+			name := s.metric(d.Name, d.Measure)
+			tags := statsdTags(d.TagSet)
+			for _, q := range s.quantiles {
+				v, _ := d.Summary.Quantile(q)
+				s.client.Gauge(name+"."+quantileSuffix(q), v, tags, 1)
+			}
+		}
+	}
+}
+
+// statsdTags formats the tag set as DogStatsD tags
+func statsdTags(tags model.TagSet) []string {
+	t := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		t = append(t, tag.Name+":"+tag.Value)
+	}
+	return t
+}
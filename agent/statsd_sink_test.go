@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+	"github.com/stretchr/testify/assert"
+)
+
+// testStatsdClient records the metrics sent to statsd
+type testStatsdClient struct {
+	metrics []string
+}
+
+func (c *testStatsdClient) Count(name string, value int64, tags []string, rate float64) error {
+	c.metrics = append(c.metrics, fmt.Sprintf("count %s %d %v", name, value, tags))
+	return nil
+}
+
+func (c *testStatsdClient) Gauge(name string, value float64, tags []string, rate float64) error {
+	c.metrics = append(c.metrics, fmt.Sprintf("gauge %s %v %v", name, value, tags))
+	return nil
+}
+
+func TestStatsdSink(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := config.NewDefaultAgentConfig()
+	conf.StatsdSinkQuantiles = []float64{0.5, 0.999}
+	client := &testStatsdClient{}
+	sink := NewStatsdSink(conf)
+	sink.client = client
+
+	srb := model.NewStatsRawBucket(0, 1e9)
+	for _, d := range []int64{100, 200, 300} {
+		srb.HandleSpan(model.Span{Name: "http.request", Service: "web", Resource: "/", Duration: d, Error: int32(d / 300)}, "prod", nil, nil)
+	}
+	sink.Send([]model.StatsBucket{srb.Export()})
+
+	sort.Strings(client.metrics)
+	tags := "[env:prod resource:/ service:web]"
+	assert.Equal([]string{
+		"count trace.http.request.duration 600 " + tags,
+		"count trace.http.request.errors 1 " + tags,
+		"count trace.http.request.hits 3 " + tags,
+		"gauge trace.http.request.duration.p50 200 " + tags,
+		"gauge trace.http.request.duration.p999 300 " + tags,
+	}, client.metrics)
+}
+
+func TestStatsdSinkMetricName(t *testing.T) {
+	assert := assert.New(t)
+
+	sink := &StatsdSink{metricName: "apm.{measure}.by_span.{name}"}
+	assert.Equal("apm.hits.by_span.http.request", sink.metric("http.request", "hits"))
+
+	assert.Equal("p50", quantileSuffix(0.5))
+	assert.Equal("p99", quantileSuffix(0.99))
+	assert.Equal("p999", quantileSuffix(0.999))
+}
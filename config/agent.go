@@ -24,21 +24,63 @@ type AgentConfig struct {
 	APIKeys                 []string
 	APIEnabled              bool
 	APIPayloadBufferMaxSize int
+	APIPayloadVersion       string // "v0.1", or "v0.2" for the compact encoding of the distributions
 
 	// Concentrator
-	BucketInterval   time.Duration // the size of our pre-aggregation per bucket
-	ExtraAggregators []string
+	BucketInterval        time.Duration // the size of our pre-aggregation per bucket
+	LateSpanTolerance     time.Duration // how late traces are still accepted after the bucket of their root was flushed
+	ExtraAggregators      []string
+	SublayerMetaKeys      []string           // meta keys the root time is also broken down by, on top of type and service
+	SublayerDistributions []string           // sublayer metrics also kept as distributions, e.g. _sublayers.duration.by_type
+	CustomMeasures        []CustomMeasure    // computed from span metrics on top of hits, errors and duration
+	LatencyThresholds     []LatencyThreshold // Apdex and latency SLO thresholds per service or resource
+
+	ErrorTypeServices       []string // services whose errors are broken down by error.type, "*" for all
+	ErrorTypeMaxCardinality int      // max distinct error types per service in a bucket
+	HTTP5xxErrorServices    []string // services whose 5xx spans count as errors, "*" for all
+
+	MaxGrainsPerService int // max distinct grains per service in a bucket, others fold into resource:_other, 0 for no limit
+	MaxGrains           int // max distinct grains of all services in a bucket, 0 for no limit
+
+	DistributionSketch     string  // "gk" for GK summaries, "ddsketch" for relative-error sketches
+	SketchRelativeAccuracy float64 // relative accuracy of the quantiles of the ddsketch distributions
+
+	// Quantizer
+	QuantizerCacheMaxSize int                   // memory cap in bytes of the quantized resources cache, 0 disables it
+	GraphQLFields         bool                  // record the top-level fields of GraphQL operations in meta
+	ResourceRewriteRules  []ResourceRewriteRule // evaluated in order after the built-in quantizers
+
+	// Scrubber
+	ScrubbingEnabled  bool
+	ScrubbingBuiltins []string    // names of the built-in detectors to enable
+	ScrubbingRules    []ScrubRule // user-defined rules, evaluated in order
+	ScrubbingHashKey  string      // HMAC key of the hash strategy, random if empty
 
 	// Sampler configuration
 	ExtraSampleRate float64
 	MaxTPS          float64
 
+	ExemplarMaxTraces  int // max rejected traces kept per flush because the stats retained them as samples, 0 disables it
+	ExemplarBufferSize int // max rejected traces buffered until their stats are flushed
+
 	// Receiver
 	ReceiverHost    string
 	ReceiverPort    int
 	ConnectionLimit int // for rate-limiting, how many unique connections to allow in a lease period (30s)
 	ReceiverTimeout int
 
+	PrometheusEnabled   bool      // expose the stats on the /metrics endpoint of the receiver
+	PrometheusBuckets   []float64 // upper bounds, in seconds, of the duration histograms
+	PrometheusMaxSeries int       // max number of series exposed, new grains beyond it are dropped
+
+	// DogStatsD stats sink
+	StatsdSinkEnabled    bool      // send the flushed stats to DogStatsD
+	StatsdSinkMetricName string    // template of the metric names, with {name} and {measure} placeholders
+	StatsdSinkQuantiles  []float64 // quantiles of the distributions sent as gauges
+
+	// stats query API
+	StatsHistoryMinutes int // minutes of flushed stats kept for the /stats/query endpoint, 0 disables it
+
 	// internal telemetry
 	StatsdHost string
 	StatsdPort int
@@ -48,6 +90,46 @@ type AgentConfig struct {
 	LogFilePath string
 }
 
+// ScrubRule is a user-defined scrubbing rule applied to span meta and resources
+type ScrubRule struct {
+	Name     string
+	Pattern  string   // regular expression matching the sensitive data
+	Keys     []string // meta keys this rule applies to, all of them if empty
+	Resource bool     // whether it also applies to the span resource when Keys are set, always otherwise
+	Strategy string   // what to do with matches: "mask", "hash" or "drop"
+}
+
+// CustomMeasure is a user-defined measure computed by the concentrator from a
+// span metric, for the spans matching its service and name (empty criteria match any span)
+type CustomMeasure struct {
+	Name     string
+	Metric   string // key of the span metric
+	Kind     string // "count", "sum" or "distribution"
+	Service  string
+	SpanName string
+}
+
+// LatencyThreshold declares the Apdex and latency SLO thresholds of the spans
+// of a service, or of one of its resources if set. A zero threshold is not counted.
+type LatencyThreshold struct {
+	Name     string
+	Service  string
+	Resource string
+	Apdex    time.Duration // Apdex T: satisfied up to T, tolerating up to 4T
+	SLO      time.Duration // hits within the SLO last at most this
+}
+
+// ResourceRewriteRule is a user-defined regex replacement applied to the resource
+// of the spans matching its service, name and type (empty criteria match any span)
+type ResourceRewriteRule struct {
+	Name        string
+	Service     string
+	SpanName    string
+	Type        string
+	Pattern     string
+	Replacement string
+}
+
 // mergeEnv applies overrides from environment variables to the trace agent configuration
 func mergeEnv(c *AgentConfig) {
 	if v := os.Getenv("DD_HOSTNAME"); v != "" {
@@ -104,17 +186,53 @@ func NewDefaultAgentConfig() *AgentConfig {
 		APIKeys:                 []string{},
 		APIEnabled:              true,
 		APIPayloadBufferMaxSize: 16 * 1024 * 1024,
+		APIPayloadVersion:       "v0.1",
+
+		BucketInterval:        time.Duration(10) * time.Second,
+		LateSpanTolerance:     0,
+		ExtraAggregators:      []string{},
+		SublayerMetaKeys:      []string{},
+		SublayerDistributions: []string{},
+		CustomMeasures:        []CustomMeasure{},
+		LatencyThresholds:     []LatencyThreshold{},
+
+		ErrorTypeServices:       []string{},
+		ErrorTypeMaxCardinality: 50,
+		HTTP5xxErrorServices:    []string{},
+
+		MaxGrainsPerService: 0,
+		MaxGrains:           0,
+
+		DistributionSketch:     "gk",
+		SketchRelativeAccuracy: 0.01,
 
-		BucketInterval:   time.Duration(10) * time.Second,
-		ExtraAggregators: []string{},
+		QuantizerCacheMaxSize: 4 * 1024 * 1024,
+		ResourceRewriteRules:  []ResourceRewriteRule{},
+
+		ScrubbingEnabled:  false,
+		ScrubbingBuiltins: []string{"credit_card", "email", "bearer_token", "ssn"},
+		ScrubbingRules:    []ScrubRule{},
 
 		ExtraSampleRate: 1.0,
 		MaxTPS:          10,
 
+		ExemplarMaxTraces:  0,
+		ExemplarBufferSize: 1000,
+
 		ReceiverHost:    "localhost",
 		ReceiverPort:    7777,
 		ConnectionLimit: 2000,
 
+		PrometheusEnabled:   false,
+		PrometheusBuckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		PrometheusMaxSeries: 10000,
+
+		StatsdSinkEnabled:    false,
+		StatsdSinkMetricName: "trace.{name}.{measure}",
+		StatsdSinkQuantiles:  []float64{0.5, 0.95, 0.99},
+
+		StatsHistoryMinutes: 0,
+
 		StatsdHost: "localhost",
 		StatsdPort: 8125,
 
@@ -205,23 +323,104 @@ APM_CONF:
 	if v, e := conf.GetInt("trace.api", "payload_buffer_max_size"); e == nil {
 		c.APIPayloadBufferMaxSize = v
 	}
+	if v, e := conf.Get("trace.api", "payload_version"); e == nil {
+		switch v = strings.TrimSpace(v); v {
+		case "v0.1", "v0.2":
+			c.APIPayloadVersion = v
+		default:
+			log.Errorf("invalid payload_version %q, expected v0.1 or v0.2, using %s", v, c.APIPayloadVersion)
+		}
+	}
 
 	if v, e := conf.GetInt("trace.concentrator", "bucket_size_seconds"); e == nil {
 		c.BucketInterval = time.Duration(v) * time.Second
 	}
 
+	if v, e := conf.GetInt("trace.concentrator", "late_span_tolerance_seconds"); e == nil {
+		c.LateSpanTolerance = time.Duration(v) * time.Second
+	}
+
 	if v, e := conf.GetStrArray("trace.concentrator", "extra_aggregators", ","); e == nil {
 		c.ExtraAggregators = v
 	} else {
 		log.Debug("No aggregator configuration, using defaults")
 	}
 
+	if v, e := conf.GetStrArray("trace.concentrator", "sublayer_meta_keys", ","); e == nil {
+		c.SublayerMetaKeys = trimStrings(v)
+	}
+	if v, e := conf.GetStrArray("trace.concentrator", "sublayer_distributions", ","); e == nil {
+		c.SublayerDistributions = trimStrings(v)
+	}
+
+	c.CustomMeasures = append(c.CustomMeasures, readCustomMeasures(conf)...)
+	c.LatencyThresholds = append(c.LatencyThresholds, readLatencyThresholds(conf)...)
+
+	if v, e := conf.GetStrArray("trace.concentrator", "error_type_services", ","); e == nil {
+		c.ErrorTypeServices = trimStrings(v)
+	}
+	if v, e := conf.GetInt("trace.concentrator", "error_type_max_cardinality"); e == nil {
+		c.ErrorTypeMaxCardinality = v
+	}
+	if v, e := conf.GetStrArray("trace.concentrator", "http_5xx_error_services", ","); e == nil {
+		c.HTTP5xxErrorServices = trimStrings(v)
+	}
+	if v, e := conf.GetInt("trace.concentrator", "max_grains_per_service"); e == nil {
+		c.MaxGrainsPerService = v
+	}
+	if v, e := conf.GetInt("trace.concentrator", "max_grains"); e == nil {
+		c.MaxGrains = v
+	}
+	if v, e := conf.Get("trace.concentrator", "distribution_sketch"); e == nil {
+		switch v = strings.ToLower(strings.TrimSpace(v)); v {
+		case "gk", "ddsketch":
+			c.DistributionSketch = v
+		default:
+			log.Errorf("invalid distribution_sketch %q, expected gk or ddsketch, using %s", v, c.DistributionSketch)
+		}
+	}
+	if v, e := conf.GetFloat("trace.concentrator", "sketch_relative_accuracy"); e == nil {
+		if v > 0 && v < 1 {
+			c.SketchRelativeAccuracy = v
+		} else {
+			log.Errorf("invalid sketch_relative_accuracy %v, expected a value between 0 and 1, using %v", v, c.SketchRelativeAccuracy)
+		}
+	}
+
+	if v, e := conf.GetInt("trace.quantizer", "cache_max_size"); e == nil {
+		c.QuantizerCacheMaxSize = v
+	}
+	if v, e := conf.GetBool("trace.quantizer", "graphql_fields"); e == nil {
+		c.GraphQLFields = v
+	}
+
+	c.ResourceRewriteRules = append(c.ResourceRewriteRules, readResourceRewriteRules(conf)...)
+
+	if v, e := conf.GetBool("trace.scrubber", "enabled"); e == nil {
+		c.ScrubbingEnabled = v
+	}
+
+	if v, e := conf.GetStrArray("trace.scrubber", "builtin_rules", ","); e == nil {
+		c.ScrubbingBuiltins = trimStrings(v)
+	}
+	if v, e := conf.Get("trace.scrubber", "hash_key"); e == nil {
+		c.ScrubbingHashKey = v
+	}
+
+	c.ScrubbingRules = append(c.ScrubbingRules, readScrubRules(conf)...)
+
 	if v, e := conf.GetFloat("trace.sampler", "extra_sample_rate"); e == nil {
 		c.ExtraSampleRate = v
 	}
 	if v, e := conf.GetFloat("trace.sampler", "max_traces_per_second"); e == nil {
 		c.MaxTPS = v
 	}
+	if v, e := conf.GetInt("trace.sampler", "exemplar_max_traces"); e == nil {
+		c.ExemplarMaxTraces = v
+	}
+	if v, e := conf.GetInt("trace.sampler", "exemplar_buffer_size"); e == nil {
+		c.ExemplarBufferSize = v
+	}
 
 	if v, e := conf.GetInt("trace.receiver", "receiver_port"); e == nil {
 		c.ReceiverPort = v
@@ -235,6 +434,38 @@ APM_CONF:
 		c.ReceiverTimeout = v
 	}
 
+	if v, e := conf.GetBool("trace.receiver", "prometheus_enabled"); e == nil {
+		c.PrometheusEnabled = v
+	}
+	if v, e := conf.GetStrArray("trace.receiver", "prometheus_buckets", ","); e == nil {
+		if buckets, err := parseBuckets(v); err == nil {
+			c.PrometheusBuckets = buckets
+		} else {
+			log.Errorf("invalid prometheus_buckets, using defaults: %v", err)
+		}
+	}
+	if v, e := conf.GetInt("trace.receiver", "prometheus_max_series"); e == nil {
+		c.PrometheusMaxSeries = v
+	}
+
+	if v, e := conf.GetInt("trace.receiver", "stats_history_minutes"); e == nil {
+		c.StatsHistoryMinutes = v
+	}
+
+	if v, e := conf.GetBool("trace.statsd_sink", "enabled"); e == nil {
+		c.StatsdSinkEnabled = v
+	}
+	if v, e := conf.Get("trace.statsd_sink", "metric_name"); e == nil && v != "" {
+		c.StatsdSinkMetricName = v
+	}
+	if v, e := conf.GetStrArray("trace.statsd_sink", "quantiles", ","); e == nil {
+		if quantiles, err := ParseQuantiles(v); err == nil {
+			c.StatsdSinkQuantiles = quantiles
+		} else {
+			log.Errorf("invalid statsd sink quantiles, using defaults: %v", err)
+		}
+	}
+
 ENV_CONF:
 	// environment variables have precedence among defaults and the config file
 	mergeEnv(c)
@@ -249,3 +480,216 @@ ENV_CONF:
 	}
 	return c, nil
 }
+
+// customMeasureSectionPrefix prefixes the sections declaring custom measures,
+// e.g. [trace.concentrator.measure.rows_returned]
+const customMeasureSectionPrefix = "trace.concentrator.measure."
+
+// reservedMeasures are the names of the measures the stats buckets compute
+// themselves, which custom measures can't override
+var reservedMeasures = map[string]bool{
+	"hits":          true,
+	"errors":        true,
+	"duration":      true,
+	"self_duration": true,
+}
+
+// reservedMeasurePrefixes prefix the measures of latency thresholds, and of
+// the sublayers and critical path metrics
+var reservedMeasurePrefixes = []string{"apdex.", "slo.", "_"}
+
+// isReservedMeasure returns true if the stats buckets may compute a measure
+// of this name themselves
+func isReservedMeasure(name string) bool {
+	if reservedMeasures[name] {
+		return true
+	}
+	for _, prefix := range reservedMeasurePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// readCustomMeasures extracts the custom measures from the config
+func readCustomMeasures(conf *File) []CustomMeasure {
+	var measures []CustomMeasure
+
+	for _, section := range conf.GetSectionsWithPrefix(customMeasureSectionPrefix) {
+		name := strings.TrimPrefix(section.Name(), customMeasureSectionPrefix)
+		if isReservedMeasure(name) {
+			log.Errorf("custom measure %s would override a default measure, skipping it", name)
+			continue
+		}
+
+		metric := section.Key("metric").String()
+		if metric == "" {
+			log.Errorf("custom measure %s has no metric, skipping it", name)
+			continue
+		}
+
+		kind := section.Key("kind").MustString("sum")
+		switch kind {
+		case "count", "sum", "distribution":
+		default:
+			log.Errorf("invalid kind %s for custom measure %s, skipping it", kind, name)
+			continue
+		}
+
+		measures = append(measures, CustomMeasure{
+			Name:     name,
+			Metric:   metric,
+			Kind:     kind,
+			Service:  section.Key("service").String(),
+			SpanName: section.Key("name").String(),
+		})
+	}
+
+	return measures
+}
+
+// latencyThresholdSectionPrefix prefixes the sections declaring latency
+// thresholds, e.g. [trace.concentrator.latency.checkout]
+const latencyThresholdSectionPrefix = "trace.concentrator.latency."
+
+// readLatencyThresholds extracts the latency thresholds from the config
+func readLatencyThresholds(conf *File) []LatencyThreshold {
+	var thresholds []LatencyThreshold
+
+	for _, section := range conf.GetSectionsWithPrefix(latencyThresholdSectionPrefix) {
+		name := strings.TrimPrefix(section.Name(), latencyThresholdSectionPrefix)
+		service := section.Key("service").String()
+		if service == "" {
+			log.Errorf("latency threshold %s has no service, skipping it", name)
+			continue
+		}
+
+		apdex := section.Key("apdex_threshold_ms").MustInt(0)
+		slo := section.Key("slo_threshold_ms").MustInt(0)
+		if apdex <= 0 && slo <= 0 {
+			log.Errorf("latency threshold %s has neither apdex_threshold_ms nor slo_threshold_ms, skipping it", name)
+			continue
+		}
+		if apdex < 0 || slo < 0 {
+			log.Errorf("latency threshold %s has a negative threshold, skipping it", name)
+			continue
+		}
+
+		thresholds = append(thresholds, LatencyThreshold{
+			Name:     name,
+			Service:  service,
+			Resource: section.Key("resource").String(),
+			Apdex:    time.Duration(apdex) * time.Millisecond,
+			SLO:      time.Duration(slo) * time.Millisecond,
+		})
+	}
+
+	return thresholds
+}
+
+// rewriteRuleSectionPrefix prefixes the sections declaring resource rewrite rules,
+// e.g. [trace.quantizer.rule.user_ids]
+const rewriteRuleSectionPrefix = "trace.quantizer.rule."
+
+// readResourceRewriteRules extracts the resource rewrite rules from the config, in
+// the order they were declared
+func readResourceRewriteRules(conf *File) []ResourceRewriteRule {
+	var rules []ResourceRewriteRule
+
+	for _, section := range conf.GetSectionsWithPrefix(rewriteRuleSectionPrefix) {
+		name := strings.TrimPrefix(section.Name(), rewriteRuleSectionPrefix)
+		pattern := section.Key("pattern").String()
+		if pattern == "" {
+			log.Errorf("resource rewrite rule %s has no pattern, skipping it", name)
+			continue
+		}
+
+		rules = append(rules, ResourceRewriteRule{
+			Name:        name,
+			Service:     section.Key("service").String(),
+			SpanName:    section.Key("name").String(),
+			Type:        section.Key("type").String(),
+			Pattern:     pattern,
+			Replacement: section.Key("replacement").String(),
+		})
+	}
+
+	return rules
+}
+
+// scrubRuleSectionPrefix prefixes the sections declaring user-defined scrubbing rules,
+// e.g. [trace.scrubber.rule.customer_ids]
+const scrubRuleSectionPrefix = "trace.scrubber.rule."
+
+// readScrubRules extracts the user-defined scrubbing rules from the config, in
+// the order they were declared
+func readScrubRules(conf *File) []ScrubRule {
+	var rules []ScrubRule
+
+	for _, section := range conf.GetSectionsWithPrefix(scrubRuleSectionPrefix) {
+		name := strings.TrimPrefix(section.Name(), scrubRuleSectionPrefix)
+		pattern := section.Key("pattern").String()
+		if pattern == "" {
+			log.Errorf("scrubbing rule %s has no pattern, skipping it", name)
+			continue
+		}
+
+		rule := ScrubRule{
+			Name:     name,
+			Pattern:  pattern,
+			Strategy: section.Key("strategy").MustString("mask"),
+		}
+		if section.HasKey("keys") {
+			rule.Keys = trimStrings(section.Key("keys").Strings(","))
+		}
+		rule.Resource = section.Key("resource").MustBool(false)
+
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// trimStrings trims the spaces around every value of the given slice
+func trimStrings(vals []string) []string {
+	for i := range vals {
+		vals[i] = strings.TrimSpace(vals[i])
+	}
+	return vals
+}
+
+// parseBuckets parses histogram bucket bounds, which must be positive and increasing
+func parseBuckets(vals []string) ([]float64, error) {
+	buckets := make([]float64, 0, len(vals))
+	for _, v := range vals {
+		b, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, err
+		}
+		if b <= 0 || (len(buckets) > 0 && b <= buckets[len(buckets)-1]) {
+			return nil, errors.New("bucket bounds must be positive and increasing")
+		}
+		buckets = append(buckets, b)
+	}
+	if len(buckets) == 0 {
+		return nil, errors.New("no bucket")
+	}
+	return buckets, nil
+}
+
+// ParseQuantiles parses a list of quantiles, between 0 and 1
+func ParseQuantiles(vals []string) ([]float64, error) {
+	quantiles := make([]float64, 0, len(vals))
+	for _, v := range vals {
+		q, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, err
+		}
+		if q < 0 || q > 1 {
+			return nil, errors.New("quantiles must be between 0 and 1")
+		}
+		quantiles = append(quantiles, q)
+	}
+	return quantiles, nil
+}
@@ -76,6 +76,16 @@ func (c *File) GetFloat(section, name string) (float64, error) {
 	return value, nil
 }
 
+// GetBool gets a boolean value from section/name, or an error if it is missing
+// or cannot be converted to a boolean.
+func (c *File) GetBool(section, name string) (bool, error) {
+	value, err := c.instance.Section(section).Key(name).Bool()
+	if err != nil {
+		return false, fmt.Errorf("missing `%s` value in [%s] section", name, section)
+	}
+	return value, nil
+}
+
 // GetStrArray returns the value split across `sep` into an array of strings.
 func (c *File) GetStrArray(section, name, sep string) ([]string, error) {
 	if exists := c.instance.Section(section).HasKey(name); !exists {
@@ -90,3 +100,15 @@ func (c *File) GetStrArray(section, name, sep string) ([]string, error) {
 func (c *File) GetSection(key string) (*ini.Section, error) {
 	return c.instance.GetSection(key)
 }
+
+// GetSectionsWithPrefix returns all the sections whose name starts with prefix,
+// in the order they appear in the file
+func (c *File) GetSectionsWithPrefix(prefix string) []*ini.Section {
+	var sections []*ini.Section
+	for _, s := range c.instance.Sections() {
+		if strings.HasPrefix(s.Name(), prefix) {
+			sections = append(sections, s)
+		}
+	}
+	return sections
+}
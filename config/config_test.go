@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"strings"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -130,3 +131,207 @@ func TestDDAgentConfigWithNewOpts(t *testing.T) {
 	assert.Equal([]string{"resource", "error"}, agentConfig.ExtraAggregators)
 	assert.Equal(0.33, agentConfig.ExtraSampleRate)
 }
+
+func TestDDAgentConfigWithTraceOpts(t *testing.T) {
+	assert := assert.New(t)
+	// check the trace.* options added to the dd-agent conf file
+	dd, _ := ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"api_key = apikey_12",
+		"[trace.api]",
+		"payload_version=v0.2",
+		"[trace.concentrator]",
+		"error_type_services=web, api",
+		"error_type_max_cardinality=10",
+		"http_5xx_error_services=*",
+		"late_span_tolerance_seconds=600",
+		"max_grains_per_service=100",
+		"max_grains=1000",
+		"distribution_sketch=DDSketch",
+		"sketch_relative_accuracy=0.005",
+		"sublayer_meta_keys=db.instance, out.host",
+		"sublayer_distributions=_sublayers.duration.by_type, _sublayers.span_count",
+		"[trace.receiver]",
+		"prometheus_enabled=true",
+		"prometheus_buckets=0.1, 1,10",
+		"prometheus_max_series=100",
+		"stats_history_minutes=5",
+		"[trace.statsd_sink]",
+		"enabled=true",
+		"metric_name=apm.{measure}",
+		"quantiles=0.5, 0.999",
+		"[trace.sampler]",
+		"exemplar_max_traces=20",
+		"exemplar_buffer_size=500",
+		"[trace.quantizer]",
+		"cache_max_size=1024",
+		"graphql_fields=true",
+	}, "\n")))
+
+	conf := &File{instance: dd, Path: "whatever"}
+	agentConfig, _ := NewAgentConfig(conf, nil)
+	assert.Equal(20, agentConfig.ExemplarMaxTraces)
+	assert.Equal(500, agentConfig.ExemplarBufferSize)
+	assert.Equal([]string{"web", "api"}, agentConfig.ErrorTypeServices)
+	assert.Equal(10, agentConfig.ErrorTypeMaxCardinality)
+	assert.Equal([]string{"*"}, agentConfig.HTTP5xxErrorServices)
+	assert.Equal(10*time.Minute, agentConfig.LateSpanTolerance)
+	assert.Equal(100, agentConfig.MaxGrainsPerService)
+	assert.Equal(1000, agentConfig.MaxGrains)
+	assert.Equal("ddsketch", agentConfig.DistributionSketch)
+	assert.Equal("v0.2", agentConfig.APIPayloadVersion)
+	assert.Equal(0.005, agentConfig.SketchRelativeAccuracy)
+	assert.Equal([]string{"db.instance", "out.host"}, agentConfig.SublayerMetaKeys)
+	assert.Equal([]string{"_sublayers.duration.by_type", "_sublayers.span_count"}, agentConfig.SublayerDistributions)
+	assert.True(agentConfig.PrometheusEnabled)
+	assert.Equal([]float64{0.1, 1, 10}, agentConfig.PrometheusBuckets)
+	assert.Equal(100, agentConfig.PrometheusMaxSeries)
+	assert.Equal(5, agentConfig.StatsHistoryMinutes)
+	assert.True(agentConfig.StatsdSinkEnabled)
+	assert.Equal("apm.{measure}", agentConfig.StatsdSinkMetricName)
+	assert.Equal([]float64{0.5, 0.999}, agentConfig.StatsdSinkQuantiles)
+	assert.Equal(1024, agentConfig.QuantizerCacheMaxSize)
+	assert.True(agentConfig.GraphQLFields)
+}
+
+func TestScrubbingConfig(t *testing.T) {
+	assert := assert.New(t)
+	dd, _ := ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"api_key = apikey_12",
+		"[trace.scrubber]",
+		"enabled = true",
+		"builtin_rules = email, ssn",
+		"hash_key = s3cr3t",
+		"[trace.scrubber.rule.customer_ids]",
+		"pattern = cust-[0-9]+",
+		"keys = customer, account",
+		"resource = true",
+		"strategy = hash",
+		"[trace.scrubber.rule.no_pattern]",
+		"strategy = drop",
+		"[trace.scrubber.rule.tokens]",
+		"pattern = tok_[a-z]+",
+	}, "\n")))
+
+	conf := &File{instance: dd, Path: "whatever"}
+	agentConfig, _ := NewAgentConfig(conf, nil)
+
+	assert.True(agentConfig.ScrubbingEnabled)
+	assert.Equal([]string{"email", "ssn"}, agentConfig.ScrubbingBuiltins)
+	assert.Equal("s3cr3t", agentConfig.ScrubbingHashKey)
+	assert.Equal([]ScrubRule{
+		{Name: "customer_ids", Pattern: "cust-[0-9]+", Keys: []string{"customer", "account"}, Resource: true, Strategy: "hash"},
+		{Name: "tokens", Pattern: "tok_[a-z]+", Strategy: "mask"},
+	}, agentConfig.ScrubbingRules)
+}
+
+func TestResourceRewriteConfig(t *testing.T) {
+	assert := assert.New(t)
+	dd, _ := ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"api_key = apikey_12",
+		"[trace.quantizer.rule.user_ids]",
+		"service = web",
+		"pattern = /users/[0-9]+",
+		"replacement = /users/?",
+		"[trace.quantizer.rule.no_pattern]",
+		"service = web",
+		"[trace.quantizer.rule.tables]",
+		"name = pg.query",
+		"type = sql",
+		"pattern = events_[0-9]+",
+		"replacement = events_?",
+	}, "\n")))
+
+	conf := &File{instance: dd, Path: "whatever"}
+	agentConfig, _ := NewAgentConfig(conf, nil)
+
+	assert.Equal([]ResourceRewriteRule{
+		{Name: "user_ids", Service: "web", Pattern: "/users/[0-9]+", Replacement: "/users/?"},
+		{Name: "tables", SpanName: "pg.query", Type: "sql", Pattern: "events_[0-9]+", Replacement: "events_?"},
+	}, agentConfig.ResourceRewriteRules)
+}
+
+func TestCustomMeasuresConfig(t *testing.T) {
+	assert := assert.New(t)
+	dd, _ := ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"api_key = apikey_12",
+		"[trace.concentrator.measure.rows_returned]",
+		"metric = db.rows_returned",
+		"kind = distribution",
+		"service = pg",
+		"[trace.concentrator.measure.cost]",
+		"metric = cost.usd",
+		"name = checkout",
+		"[trace.concentrator.measure.no_metric]",
+		"kind = count",
+		"[trace.concentrator.measure.bad_kind]",
+		"metric = cost.usd",
+		"kind = average",
+		"[trace.concentrator.measure.hits]",
+		"metric = cost.usd",
+	}, "\n")))
+
+	conf := &File{instance: dd, Path: "whatever"}
+	agentConfig, _ := NewAgentConfig(conf, nil)
+
+	assert.Equal([]CustomMeasure{
+		{Name: "rows_returned", Metric: "db.rows_returned", Kind: "distribution", Service: "pg"},
+		{Name: "cost", Metric: "cost.usd", Kind: "sum", SpanName: "checkout"},
+	}, agentConfig.CustomMeasures)
+}
+
+func TestCustomMeasuresReservedNames(t *testing.T) {
+	assert := assert.New(t)
+
+	lines := []string{"[Main]", "api_key = apikey_12"}
+	for _, name := range []string{
+		"hits", "errors", "duration", "self_duration",
+		"apdex.satisfied", "slo.breaching",
+		"_sublayers.duration.by_service", "_critical_path.duration.by_name",
+		"rows_returned",
+	} {
+		lines = append(lines, "[trace.concentrator.measure."+name+"]", "metric = db.rows_returned")
+	}
+	dd, _ := ini.Load([]byte(strings.Join(lines, "\n")))
+
+	conf := &File{instance: dd, Path: "whatever"}
+	agentConfig, _ := NewAgentConfig(conf, nil)
+
+	assert.Equal([]CustomMeasure{
+		{Name: "rows_returned", Metric: "db.rows_returned", Kind: "sum"},
+	}, agentConfig.CustomMeasures)
+}
+
+func TestLatencyThresholdsConfig(t *testing.T) {
+	assert := assert.New(t)
+	dd, _ := ini.Load([]byte(strings.Join([]string{
+		"[Main]",
+		"api_key = apikey_12",
+		"[trace.concentrator.latency.web]",
+		"service = web",
+		"apdex_threshold_ms = 500",
+		"[trace.concentrator.latency.checkout]",
+		"service = web",
+		"resource = POST /checkout",
+		"apdex_threshold_ms = 100",
+		"slo_threshold_ms = 300",
+		"[trace.concentrator.latency.no_service]",
+		"slo_threshold_ms = 300",
+		"[trace.concentrator.latency.no_threshold]",
+		"service = db",
+		"[trace.concentrator.latency.negative]",
+		"service = db",
+		"slo_threshold_ms = -1",
+	}, "\n")))
+
+	conf := &File{instance: dd, Path: "whatever"}
+	agentConfig, _ := NewAgentConfig(conf, nil)
+
+	assert.Equal([]LatencyThreshold{
+		{Name: "web", Service: "web", Apdex: 500 * time.Millisecond},
+		{Name: "checkout", Service: "web", Resource: "POST /checkout", Apdex: 100 * time.Millisecond, SLO: 300 * time.Millisecond},
+	}, agentConfig.LatencyThresholds)
+}
@@ -0,0 +1,112 @@
+package model
+
+import "sort"
+
+// ComputeCriticalPath returns the contribution of each service and span name
+// to the critical path of the trace: the chain of spans the root had to wait
+// for, the last one to end being picked among concurrent children. The
+// contributions add up to the root duration. Span names beyond
+// MaxSublayerMetaValues are folded into SublayerOther, like meta sublayers.
+func ComputeCriticalPath(t *Trace) []SublayerValue {
+	spans, parents := reachableSpans(t)
+	if len(spans) == 0 {
+		return []SublayerValue{}
+	}
+
+	children := make([][]int, len(spans))
+	for i, p := range parents {
+		if p >= 0 {
+			children[p] = append(children[p], i)
+		}
+	}
+
+	cp := criticalPath{
+		spans:     spans,
+		children:  children,
+		byService: make(map[string]int64),
+		byName:    make(map[string]int64),
+	}
+	root := spans[0]
+	cp.walk(0, root.Start, root.End())
+
+	s := make([]SublayerValue, 0, len(cp.byService)+len(cp.byName))
+	s = appendCriticalPath(s, "service", cp.byService)
+	s = appendCriticalPath(s, "name", foldSublayers(cp.byName, MaxSublayerMetaValues))
+	return s
+}
+
+// appendCriticalPath appends the contributions of a dimension, as
+// `_critical_path.duration.by_<dimension>` values tagged with `critical_path_<dimension>`
+func appendCriticalPath(s []SublayerValue, dimension string, times map[string]int64) []SublayerValue {
+	for k, v := range times {
+		if k == "" || v == 0 {
+			continue
+		}
+		s = append(s, SublayerValue{
+			Metric: "_critical_path.duration.by_" + dimension,
+			Tag:    Tag{"critical_path_" + dimension, k},
+			Value:  float64(v),
+		})
+	}
+	return s
+}
+
+type criticalPath struct {
+	spans     []*Span
+	children  [][]int
+	byService map[string]int64
+	byName    map[string]int64
+}
+
+func (cp *criticalPath) add(s *Span, d int64) {
+	cp.byService[s.Service] += d
+	cp.byName[s.Name] += d
+}
+
+// walk attributes the [start, end] window of the span to the critical path,
+// going backwards from its end: the time up to the end of the last child
+// ending belongs to the span, the child's own window to the child, and so on
+// with the children which ended before it started
+func (cp *criticalPath) walk(i int, start, end int64) {
+	s := cp.spans[i]
+	sort.Sort(childrenByEnd{cp.spans, cp.children[i]})
+
+	cursor := end
+	for _, c := range cp.children[i] {
+		if cursor <= start {
+			break
+		}
+		cStart, cEnd := cp.spans[c].Start, cp.spans[c].End()
+		if cStart >= cursor {
+			// overlapped by the child on the path, which ended later
+			continue
+		}
+		if cEnd > cursor {
+			cEnd = cursor
+		}
+		if cStart < start {
+			cStart = start
+		}
+		if cEnd <= cStart {
+			continue
+		}
+		cp.add(s, cursor-cEnd)
+		cp.walk(c, cStart, cEnd)
+		cursor = cStart
+	}
+	if cursor > start {
+		cp.add(s, cursor-start)
+	}
+}
+
+// childrenByEnd sorts the indexes of children spans by decreasing end
+type childrenByEnd struct {
+	spans    []*Span
+	children []int
+}
+
+func (c childrenByEnd) Len() int      { return len(c.children) }
+func (c childrenByEnd) Swap(i, j int) { c.children[i], c.children[j] = c.children[j], c.children[i] }
+func (c childrenByEnd) Less(i, j int) bool {
+	return c.spans[c.children[i]].End() > c.spans[c.children[j]].End()
+}
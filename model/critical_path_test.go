@@ -0,0 +1,115 @@
+package model
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func criticalPathMetrics(tr Trace) map[string]float64 {
+	var s Span
+	SetSublayersOnSpan(&s, ComputeCriticalPath(&tr))
+	return s.Metrics
+}
+
+func TestCriticalPath(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tc := range []struct {
+		name     string
+		trace    Trace
+		expected map[string]float64
+	}{
+		{
+			// >================================< web
+			//    >==============<                 db
+			//       >=================<           cache
+			//                            >===<    db
+			name: "fan-out",
+			trace: Trace{
+				Span{SpanID: 1, Start: 0, Duration: 100, Service: "web", Name: "request"},
+				Span{SpanID: 2, ParentID: 1, Start: 10, Duration: 50, Service: "db", Name: "query"},
+				Span{SpanID: 3, ParentID: 1, Start: 20, Duration: 60, Service: "cache", Name: "get"},
+				Span{SpanID: 4, ParentID: 1, Start: 85, Duration: 5, Service: "db", Name: "query"},
+			},
+			expected: map[string]float64{
+				// only the part of the first query the root waited for is on the path
+				"_critical_path.duration.by_service.critical_path_service:web":   10 + 5 + 10,
+				"_critical_path.duration.by_service.critical_path_service:db":    10 + 5,
+				"_critical_path.duration.by_service.critical_path_service:cache": 60,
+				"_critical_path.duration.by_name.critical_path_name:request":     25,
+				"_critical_path.duration.by_name.critical_path_name:query":       15,
+				"_critical_path.duration.by_name.critical_path_name:get":         60,
+			},
+		},
+		{
+			// nested, with an async child outliving its parent
+			name: "nested",
+			trace: Trace{
+				Span{SpanID: 1, Start: 0, Duration: 100, Service: "web", Name: "request"},
+				Span{SpanID: 2, ParentID: 1, Start: 10, Duration: 40, Service: "web", Name: "render"},
+				Span{SpanID: 3, ParentID: 2, Start: 20, Duration: 10, Service: "db", Name: "query"},
+				Span{SpanID: 4, ParentID: 1, Start: 60, Duration: 100, Service: "worker", Name: "job"},
+			},
+			expected: map[string]float64{
+				"_critical_path.duration.by_service.critical_path_service:web":    10 + 10 + 20 + 10,
+				"_critical_path.duration.by_service.critical_path_service:db":     10,
+				"_critical_path.duration.by_service.critical_path_service:worker": 40,
+				"_critical_path.duration.by_name.critical_path_name:request":      20,
+				"_critical_path.duration.by_name.critical_path_name:render":       30,
+				"_critical_path.duration.by_name.critical_path_name:query":        10,
+				"_critical_path.duration.by_name.critical_path_name:job":          40,
+			},
+		},
+	} {
+		assert.Equal(tc.expected, criticalPathMetrics(tc.trace), tc.name)
+	}
+
+	assert.Empty(ComputeCriticalPath(&Trace{Span{SpanID: 2, ParentID: 1}}))
+}
+
+func TestCriticalPathMaxNames(t *testing.T) {
+	assert := assert.New(t)
+
+	// sequential children of distinct names, the longest last
+	tr := Trace{Span{SpanID: 1, Start: 0, Duration: 1000, Service: "web", Name: "request"}}
+	start := int64(0)
+	for i := 1; i <= 20; i++ {
+		tr = append(tr, Span{SpanID: uint64(i + 1), ParentID: 1, Start: start, Duration: int64(i), Service: "web", Name: fmt.Sprintf("step%d", i)})
+		start += int64(i)
+	}
+
+	names := make(map[string]float64)
+	for k, v := range criticalPathMetrics(tr) {
+		if strings.HasPrefix(k, "_critical_path.duration.by_name.") {
+			names[strings.TrimPrefix(k, "_critical_path.duration.by_name.critical_path_name:")] = v
+		}
+	}
+	assert.Equal(MaxSublayerMetaValues, len(names))
+	// the root has the most time, then the 8 longest steps, the others folded
+	assert.Equal(float64(1000-210), names["request"])
+	assert.Equal(20.0, names["step20"])
+	assert.Equal(13.0, names["step13"])
+	assert.Equal(float64(12*13/2), names[SublayerOther])
+}
+
+func TestCriticalPathProperties(t *testing.T) {
+	assert := assert.New(t)
+	r := rand.New(rand.NewSource(42))
+
+	for i := 0; i < 500; i++ {
+		tr := randomSublayerTrace(r, 1+r.Intn(30), i%2 == 0)
+
+		totals := map[string]float64{}
+		for _, v := range ComputeCriticalPath(&tr) {
+			assert.True(v.Value > 0, "empty contribution %v", v)
+			totals[v.Metric] += v.Value
+		}
+		// the critical path is the root duration, split
+		assert.Equal(float64(tr[0].Duration), totals["_critical_path.duration.by_service"])
+		assert.Equal(float64(tr[0].Duration), totals["_critical_path.duration.by_name"])
+	}
+}
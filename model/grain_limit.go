@@ -0,0 +1,96 @@
+package model
+
+import "sync"
+
+// GrainCounter counts the distinct grains of the stats buckets sharing it,
+// per service and for all of them, so that buckets of a same timestamp
+// computed concurrently share the grain limits. It also keeps the distinct
+// error types per service, which are capped the same way.
+type GrainCounter struct {
+	n          int
+	services   map[string]int
+	errorTypes map[string]map[string]struct{}
+	mu         sync.Mutex
+}
+
+// reserve counts a new grain of the service, unless maxPerService grains of
+// the service or max grains were already counted, 0 being no limit
+func (gc *GrainCounter) reserve(service string, maxPerService, max int) bool {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	if maxPerService > 0 && gc.services[service] >= maxPerService {
+		return false
+	}
+	if max > 0 && gc.n >= max {
+		return false
+	}
+	if gc.services == nil {
+		gc.services = make(map[string]int)
+	}
+	gc.n++
+	gc.services[service]++
+	return true
+}
+
+// errorType returns the error type if it's known for the service, or if
+// less than max were seen, in which case it's counted. Otherwise it returns
+// ErrorTypeOther.
+func (gc *GrainCounter) errorType(service, errType string, max int) string {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	seen, ok := gc.errorTypes[service]
+	if !ok {
+		if gc.errorTypes == nil {
+			gc.errorTypes = make(map[string]map[string]struct{})
+		}
+		seen = make(map[string]struct{})
+		gc.errorTypes[service] = seen
+	}
+	if _, ok := seen[errType]; ok {
+		return errType
+	}
+	if len(seen) >= max {
+		return ErrorTypeOther
+	}
+	seen[errType] = struct{}{}
+	return errType
+}
+
+// allowGrain tells if the span can be aggregated in the given grain, which
+// is the case of known grains and of new ones while under the limits
+func (sb *StatsRawBucket) allowGrain(s *Span, grain string) bool {
+	if sb.opts.MaxGrainsPerService <= 0 && sb.opts.MaxGrains <= 0 {
+		return true
+	}
+	if _, ok := sb.data[statsKey{name: s.Name, aggr: grain}]; ok {
+		return true
+	}
+	return sb.grains.reserve(s.Service, sb.opts.MaxGrainsPerService, sb.opts.MaxGrains)
+}
+
+// allowSublayer tells if the span can be aggregated in the given sublayer
+// grain, which is the case of known ones and of new ones while under the
+// grain limits they count for too
+func (sb *StatsRawBucket) allowSublayer(s *Span, key statsSubKey) bool {
+	if sb.opts.MaxGrainsPerService <= 0 && sb.opts.MaxGrains <= 0 {
+		return true
+	}
+	if _, ok := sb.sublayerData[key]; ok {
+		return true
+	}
+	return sb.grains.reserve(s.Service, sb.opts.MaxGrainsPerService, sb.opts.MaxGrains)
+}
+
+// SetGrainCounter makes the bucket count its grains and error types with the
+// given counter, shared with other buckets, for their limits
+func (sb *StatsRawBucket) SetGrainCounter(gc *GrainCounter) {
+	sb.grains = gc
+}
+
+// Overflows returns the number of spans per service which were folded into
+// the overflow grain because of the grain limits
+func (sb *StatsRawBucket) Overflows() map[string]int64 {
+	return sb.overflows
+}
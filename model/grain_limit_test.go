@@ -0,0 +1,91 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGrainLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	opts := &StatsOptions{MaxGrainsPerService: 2, MaxGrains: 3}
+	gc := &GrainCounter{}
+	srb1 := NewStatsRawBucketWithOptions(0, 1e9, opts)
+	srb1.SetGrainCounter(gc)
+	srb2 := NewStatsRawBucketWithOptions(0, 1e9, opts)
+	srb2.SetGrainCounter(gc)
+
+	span := func(service, resource string) Span {
+		return Span{Service: service, Name: "request", Resource: resource, Meta: map[string]string{"user": resource}}
+	}
+	for _, s := range []Span{
+		span("web", "/a"),
+		span("web", "/b"),
+		span("web", "/c"), // over the limit of the service
+		span("web", "/a"), // known grains are still counted
+		span("web", "/d"),
+		span("api", "/x"),
+	} {
+		srb1.HandleSpan(s, "default", []string{"user"}, nil)
+	}
+	// over the global limit, shared with the first bucket
+	srb2.HandleSpan(span("db", "/q"), "default", []string{"user"}, nil)
+
+	hits := func(srb *StatsRawBucket) map[string]float64 {
+		m := make(map[string]float64)
+		for _, c := range srb.Export().Counts {
+			if c.Measure == HITS {
+				m[c.Key] = c.Value
+			}
+		}
+		return m
+	}
+	assert.Equal(map[string]float64{
+		"request|hits|env:default,resource:/a,service:web,user:/a": 2,
+		"request|hits|env:default,resource:/b,service:web,user:/b": 1,
+		"request|hits|env:default,resource:_other,service:web":     2,
+		"request|hits|env:default,resource:/x,service:api,user:/x": 1,
+	}, hits(srb1))
+	assert.Equal(map[string]float64{
+		"request|hits|env:default,resource:_other,service:db": 1,
+	}, hits(srb2))
+
+	assert.Equal(map[string]int64{"web": 2}, srb1.Overflows())
+	assert.Equal(map[string]int64{"db": 1}, srb2.Overflows())
+}
+
+func TestGrainLimitsDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucket(0, 1e9)
+	for _, r := range []string{"/a", "/b", "/c"} {
+		srb.HandleSpan(Span{Service: "web", Name: "request", Resource: r}, "default", nil, nil)
+	}
+	assert.Equal(3*3, len(srb.Export().Counts))
+	assert.Empty(srb.Overflows())
+}
+
+func TestGrainLimitsSublayers(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucketWithOptions(0, 1e9, &StatsOptions{MaxGrainsPerService: 3})
+	span := Span{Service: "web", Name: "request", Resource: "/a"}
+	for _, host := range []string{"h1", "h2", "h3", "h1"} {
+		sublayers := []SublayerValue{{
+			Metric: "_sublayers.duration.by_out.host",
+			Tag:    Tag{Name: "sublayer_out.host", Value: host},
+			Value:  10,
+		}}
+		srb.HandleSpan(span, "default", nil, &sublayers)
+	}
+
+	values := make(map[string]float64)
+	for _, c := range srb.Export().Counts {
+		if c.Measure == "_sublayers.duration.by_out.host" {
+			values[c.TagSet.Get("sublayer_out.host").Value] = c.Value
+		}
+	}
+	// the grain of the span and 2 sublayers fit in the limit
+	assert.Equal(map[string]float64{"h1": 20, "h2": 10, SublayerOther: 10}, values)
+}
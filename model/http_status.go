@@ -0,0 +1,32 @@
+package model
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	// HTTPStatusCodeKey is the meta holding the status code of HTTP spans
+	HTTPStatusCodeKey = "http.status_code"
+	// HTTPStatusClassKey is the built-in aggregator grouping HTTP spans by
+	// status code class, e.g. 2xx or 5xx
+	HTTPStatusClassKey = "http.status_class"
+)
+
+// httpStatusCode returns the HTTP status code of the span, 0 if it has none
+func httpStatusCode(s *Span) int {
+	v, ok := s.Meta[HTTPStatusCodeKey]
+	if !ok {
+		return 0
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || code < 100 || code > 599 {
+		return 0
+	}
+	return code
+}
+
+// httpStatusClass returns the class of the given status code, e.g. 4xx for 404
+func httpStatusClass(code int) string {
+	return strconv.Itoa(code/100) + "xx"
+}
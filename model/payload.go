@@ -31,6 +31,9 @@ type AgentPayloadVersion string
 const (
 	// AgentPayloadV01 is a simple json'd/gzip'd dump of the payload
 	AgentPayloadV01 AgentPayloadVersion = "v0.1"
+	// AgentPayloadV02 is AgentPayloadV01 with the summaries of the distributions
+	// in their compact binary encoding, as base64 strings
+	AgentPayloadV02 AgentPayloadVersion = "v0.2"
 )
 
 var (
@@ -50,6 +53,14 @@ func EncodeAgentPayload(p AgentPayload) ([]byte, error) {
 		gz := gzip.NewWriter(&b)
 		err = json.NewEncoder(gz).Encode(p)
 		gz.Close()
+	case AgentPayloadV02:
+		var cp compactAgentPayload
+		if cp, err = newCompactAgentPayload(p); err != nil {
+			break
+		}
+		gz := gzip.NewWriter(&b)
+		err = json.NewEncoder(gz).Encode(cp)
+		gz.Close()
 	default:
 		err = errors.New("unknown payload version")
 	}
@@ -57,6 +68,53 @@ func EncodeAgentPayload(p AgentPayload) ([]byte, error) {
 	return b.Bytes(), err
 }
 
+// compactAgentPayload is the AgentPayload of AgentPayloadV02
+type compactAgentPayload struct {
+	AgentPayload
+	Stats []compactStatsBucket `json:"stats"`
+}
+
+type compactStatsBucket struct {
+	StatsBucket
+	Distributions map[string]compactDistribution
+}
+
+type compactDistribution struct {
+	Key     string `json:"key"`
+	Name    string `json:"name"`
+	Measure string `json:"measure"`
+	TagSet  TagSet `json:"tagset"`
+	Summary []byte `json:"summary"` // binary encoding of the sketch
+}
+
+func newCompactAgentPayload(p AgentPayload) (compactAgentPayload, error) {
+	cp := compactAgentPayload{
+		AgentPayload: p,
+		Stats:        make([]compactStatsBucket, 0, len(p.Stats)),
+	}
+	for _, b := range p.Stats {
+		cb := compactStatsBucket{
+			StatsBucket:   b,
+			Distributions: make(map[string]compactDistribution, len(b.Distributions)),
+		}
+		for k, d := range b.Distributions {
+			summary, err := d.Summary.MarshalBinary()
+			if err != nil {
+				return cp, err
+			}
+			cb.Distributions[k] = compactDistribution{
+				Key:     d.Key,
+				Name:    d.Name,
+				Measure: d.Measure,
+				TagSet:  d.TagSet,
+				Summary: summary,
+			}
+		}
+		cp.Stats = append(cp.Stats, cb)
+	}
+	return cp, nil
+}
+
 // AgentPayloadAPIPath returns the path (after the first slash) to which
 // the payload should be sent to be understood by the API given the
 // configured payload version.
@@ -68,7 +126,7 @@ func AgentPayloadAPIPath() string {
 // header keys for the API to be able to decode the data.
 func SetAgentPayloadHeaders(h http.Header) {
 	switch GlobalAgentPayloadVersion {
-	case AgentPayloadV01:
+	case AgentPayloadV01, AgentPayloadV02:
 		h.Set("Content-Type", "application/json")
 		h.Set("Content-Encoding", "gzip")
 	default:
@@ -0,0 +1,67 @@
+package model
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/DataDog/datadog-trace-agent/quantile"
+	"github.com/stretchr/testify/assert"
+)
+
+func testPayload() AgentPayload {
+	srb := NewStatsRawBucket(0, 1e9)
+	for i, d := range []int64{100, 200, 300} {
+		srb.HandleSpan(Span{SpanID: uint64(i + 1), Name: "http.request", Service: "web", Resource: "/", Duration: d}, "prod", nil, nil)
+	}
+	return AgentPayload{HostName: "host", Env: "prod", Stats: []StatsBucket{srb.Export()}}
+}
+
+func TestEncodeAgentPayloadV02(t *testing.T) {
+	assert := assert.New(t)
+	defer func(v AgentPayloadVersion) { GlobalAgentPayloadVersion = v }(GlobalAgentPayloadVersion)
+	GlobalAgentPayloadVersion = AgentPayloadV02
+
+	p := testPayload()
+	data, err := EncodeAgentPayload(p)
+	assert.Nil(err)
+
+	h := http.Header{}
+	SetAgentPayloadHeaders(h)
+	assert.Equal("application/json", h.Get("Content-Type"))
+	assert.Equal("gzip", h.Get("Content-Encoding"))
+	assert.Equal("/api/v0.2/collector", AgentPayloadAPIPath())
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	assert.Nil(err)
+	var decoded struct {
+		HostName string `json:"hostname"`
+		Stats    []struct {
+			Start         int64
+			Counts        map[string]Count
+			Distributions map[string]struct {
+				Name    string `json:"name"`
+				TagSet  TagSet `json:"tagset"`
+				Summary []byte `json:"summary"`
+			}
+		} `json:"stats"`
+	}
+	assert.Nil(json.NewDecoder(gz).Decode(&decoded))
+
+	assert.Equal("host", decoded.HostName)
+	if !assert.Len(decoded.Stats, 1) {
+		t.FailNow()
+	}
+	b := decoded.Stats[0]
+	assert.Equal(p.Stats[0].Counts, b.Counts)
+	assert.Len(b.Distributions, len(p.Stats[0].Distributions))
+	for k, d := range p.Stats[0].Distributions {
+		assert.Equal(d.Name, b.Distributions[k].Name)
+		assert.Equal(d.TagSet, b.Distributions[k].TagSet)
+		summary, err := quantile.UnmarshalSketchBinary(b.Distributions[k].Summary)
+		assert.Nil(err)
+		assert.Equal(d.Summary, summary)
+	}
+}
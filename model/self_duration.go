@@ -0,0 +1,78 @@
+package model
+
+import "sort"
+
+// SelfDurationKey is the span metric holding the exclusive time of a span, in
+// nanoseconds: its duration minus the time covered by its children
+const SelfDurationKey = "_self_duration"
+
+// ComputeSelfDuration sets the self duration of every span of the trace.
+// Children running concurrently are only deducted once, and only while the
+// span lasts.
+func (t Trace) ComputeSelfDuration() {
+	children := make(map[uint64][]int, len(t))
+	for i, s := range t {
+		if s.ParentID != 0 && s.ParentID != s.SpanID {
+			children[s.ParentID] = append(children[s.ParentID], i)
+		}
+	}
+
+	var covered timeIntervals
+	for i := range t {
+		s := &t[i]
+		covered = covered[:0]
+		for _, c := range children[s.SpanID] {
+			start, end := t[c].Start, t[c].End()
+			if start < s.Start {
+				start = s.Start
+			}
+			if end > s.End() {
+				end = s.End()
+			}
+			if start < end {
+				covered = append(covered, timeInterval{start, end})
+			}
+		}
+
+		if s.Metrics == nil {
+			s.Metrics = make(map[string]float64, 1)
+		}
+		s.Metrics[SelfDurationKey] = float64(s.Duration - unionLength(covered))
+	}
+}
+
+// SelfDuration returns the self duration computed by ComputeSelfDuration, if any
+func (s *Span) SelfDuration() (int64, bool) {
+	v, ok := s.Metrics[SelfDurationKey]
+	return int64(v), ok
+}
+
+// timeInterval is a [start, end) time interval in nanoseconds
+type timeInterval struct {
+	start, end int64
+}
+
+type timeIntervals []timeInterval
+
+func (t timeIntervals) Len() int           { return len(t) }
+func (t timeIntervals) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t timeIntervals) Less(i, j int) bool { return t[i].start < t[j].start }
+
+// unionLength returns the time covered by the intervals, which it sorts
+func unionLength(intervals timeIntervals) int64 {
+	sort.Sort(intervals)
+
+	var total int64
+	var cur timeInterval
+	for i, iv := range intervals {
+		if i > 0 && iv.start <= cur.end {
+			if iv.end > cur.end {
+				cur.end = iv.end
+			}
+			continue
+		}
+		total += cur.end - cur.start
+		cur = iv
+	}
+	return total + cur.end - cur.start
+}
@@ -0,0 +1,73 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputeSelfDuration(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := Trace{
+		Span{SpanID: 1, Start: 0, Duration: 100},
+		// concurrent children only count once
+		Span{SpanID: 2, ParentID: 1, Start: 10, Duration: 30},
+		Span{SpanID: 3, ParentID: 1, Start: 20, Duration: 40},
+		// disjoint one
+		Span{SpanID: 4, ParentID: 1, Start: 70, Duration: 10},
+		// grandchildren are not deducted from the root
+		Span{SpanID: 5, ParentID: 3, Start: 30, Duration: 10},
+		// async child, only deducted while its parent lasts
+		Span{SpanID: 6, ParentID: 4, Start: 75, Duration: 100},
+		// unknown parent
+		Span{SpanID: 7, ParentID: 42, Start: 0, Duration: 5},
+	}
+	tr.ComputeSelfDuration()
+
+	expected := map[uint64]int64{
+		1: 100 - 50 - 10,
+		2: 30,
+		3: 40 - 10,
+		4: 10 - 5,
+		5: 10,
+		6: 100,
+		7: 5,
+	}
+	for _, s := range tr {
+		self, ok := s.SelfDuration()
+		assert.True(ok)
+		assert.Equal(expected[s.SpanID], self, "span %d", s.SpanID)
+	}
+}
+
+func TestSelfDurationStats(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := Trace{
+		Span{SpanID: 1, Start: 0, Duration: 100, Service: "web", Name: "request", Resource: "/"},
+		Span{SpanID: 2, ParentID: 1, Start: 10, Duration: 30, Service: "db", Name: "query", Resource: "SELECT ?"},
+	}
+
+	srb := NewStatsRawBucket(0, 1e9)
+	srb.HandleSpan(tr[0], "default", nil, nil)
+	_, ok := srb.Export().Distributions["request|self_duration|env:default,resource:/,service:web"]
+	assert.False(ok, "no distribution without self duration")
+
+	tr.ComputeSelfDuration()
+	srb = NewStatsRawBucket(0, 1e9)
+	for _, s := range tr {
+		srb.HandleSpan(s, "default", nil, nil)
+	}
+	sb := srb.Export()
+
+	d, ok := sb.Distributions["request|self_duration|env:default,resource:/,service:web"]
+	if assert.True(ok) {
+		assert.Equal(SELF_DURATION, d.Measure)
+		v, _ := d.Summary.Quantile(0.5)
+		assert.Equal(70.0, v)
+	}
+	d = sb.Distributions["query|self_duration|env:default,resource:SELECT ?,service:db"]
+	v, _ := d.Summary.Quantile(0.5)
+	assert.Equal(30.0, v)
+}
@@ -1,16 +1,19 @@
 package model
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/DataDog/datadog-trace-agent/quantile"
 )
 
 // Hardcoded measures names for ease of reference
 const (
-	HITS     string = "hits"
-	ERRORS          = "errors"
-	DURATION        = "duration"
+	HITS          string = "hits"
+	ERRORS               = "errors"
+	DURATION             = "duration"
+	SELF_DURATION        = "self_duration"
 )
 
 var (
@@ -38,7 +41,7 @@ type Distribution struct {
 	Measure string `json:"measure"` // represents the entity we count, e.g. "hits", "errors", "time"
 	TagSet  TagSet `json:"tagset"`  // set of tags for which we account this Distribution
 
-	Summary *quantile.SliceSummary `json:"summary"` // actual representation of data
+	Summary quantile.Sketch `json:"summary"` // actual representation of data
 }
 
 // GrainKey generates the key used to aggregate counts and distributions
@@ -48,6 +51,12 @@ func GrainKey(name, measure, aggr string) string {
 	return name + "|" + measure + "|" + aggr
 }
 
+// GrainAggregation returns the aggr part of a key generated by GrainKey for the
+// given name and measure
+func GrainAggregation(key, name, measure string) string {
+	return strings.TrimPrefix(key, name+"|"+measure+"|")
+}
+
 // NewCount returns a new Count for a metric and a given tag set
 func NewCount(m, ckey, name string, tgs TagSet) Count {
 	return Count{
@@ -92,10 +101,35 @@ func (d Distribution) Add(v float64, sampleID uint64) {
 	d.Summary.Insert(v, sampleID)
 }
 
-// Merge is used when 2 Distributions represent the same thing and it merges the 2 underlying summaries
-func (d Distribution) Merge(d2 Distribution) {
+// Merge is used when 2 Distributions represent the same thing and it merges the 2 underlying summaries,
+// returning an error if they are sketches of different kinds
+func (d Distribution) Merge(d2 Distribution) error {
 	// We don't check tagsets for distributions as we reaggregate without reallocating new structs
-	d.Summary.Merge(d2.Summary)
+	return d.Summary.Merge(d2.Summary)
+}
+
+// distribution avoids the recursion of UnmarshalJSON
+type distribution Distribution
+
+// UnmarshalJSON decodes a distribution and the sketch of its summary
+func (d *Distribution) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		distribution
+		Summary json.RawMessage `json:"summary"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	*d = Distribution(raw.distribution)
+	if len(raw.Summary) == 0 || string(raw.Summary) == "null" {
+		return nil
+	}
+	s, err := quantile.UnmarshalSketchJSON(raw.Summary)
+	if err != nil {
+		return err
+	}
+	d.Summary = s
+	return nil
 }
 
 // Copy returns a distro with the same data but a different underlying summary
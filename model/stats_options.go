@@ -0,0 +1,142 @@
+package model
+
+import "github.com/DataDog/datadog-trace-agent/quantile"
+
+// Kinds of custom measures
+const (
+	// MeasureCount counts the spans having the metric
+	MeasureCount = "count"
+	// MeasureSum sums the values of the metric
+	MeasureSum = "sum"
+	// MeasureDistribution keeps the distribution of the values of the metric
+	MeasureDistribution = "distribution"
+)
+
+// Measures counting the hits against latency thresholds
+const (
+	// MeasureApdexSatisfied counts the hits lasting at most the Apdex threshold
+	MeasureApdexSatisfied = "apdex.satisfied"
+	// MeasureApdexTolerating counts the hits lasting at most 4 times the Apdex threshold
+	MeasureApdexTolerating = "apdex.tolerating"
+	// MeasureApdexFrustrated counts the slower hits and the errors
+	MeasureApdexFrustrated = "apdex.frustrated"
+	// MeasureSLOWithin counts the hits lasting at most the SLO threshold
+	MeasureSLOWithin = "slo.within"
+	// MeasureSLOBreaching counts the hits lasting more than the SLO threshold
+	MeasureSLOBreaching = "slo.breaching"
+)
+
+const (
+	// ErrorTypeKey is the meta holding the type of the error of a span, e.g. the exception class
+	ErrorTypeKey = "error.type"
+	// ErrorTypeUnknown is the error type of erroring spans without error.type
+	ErrorTypeUnknown = "unknown"
+	// ErrorTypeOther is the error type the errors are folded into once the
+	// maximum number of distinct error types of a service is reached
+	ErrorTypeOther = "_other"
+
+	// OverflowResource is the resource of the grain spans are folded into
+	// once the maximum number of distinct grains is reached
+	OverflowResource = "_other"
+)
+
+// StatsOptions are the optional stats computed by a StatsRawBucket on top of
+// hits, errors and duration. They are shared by all the buckets of a concentrator.
+type StatsOptions struct {
+	CustomMeasures []CustomMeasure
+
+	// LatencyThresholds are the Apdex and SLO thresholds the hits are counted against
+	LatencyThresholds []LatencyThreshold
+
+	// ErrorTypeServices are the services whose errors are also counted by error type
+	ErrorTypeServices ServiceSet
+	// ErrorTypeMaxCardinality is the maximum number of distinct error types
+	// counted per service and bucket
+	ErrorTypeMaxCardinality int
+
+	// HTTP5xxErrorServices are the services whose spans with a 5xx status
+	// code are counted as errors, even if the tracer didn't flag them
+	HTTP5xxErrorServices ServiceSet
+
+	// MaxGrainsPerService is the maximum number of distinct grains per
+	// service and bucket, 0 for no limit
+	MaxGrainsPerService int
+	// MaxGrains is the maximum number of distinct grains per bucket, all
+	// services included, 0 for no limit
+	MaxGrains int
+
+	// SublayerDistributions are the sublayer metrics, e.g.
+	// _sublayers.duration.by_type, whose values are also kept as distributions
+	SublayerDistributions map[string]bool
+
+	// NewSketch returns the sketches keeping the distributions, GK summaries if nil
+	NewSketch func() quantile.Sketch
+}
+
+// newSketch returns a new sketch for a distribution
+func (opts *StatsOptions) newSketch() quantile.Sketch {
+	if opts.NewSketch == nil {
+		return quantile.NewSliceSummary()
+	}
+	return opts.NewSketch()
+}
+
+// ServiceSet is a set of service names, "*" standing for all of them
+type ServiceSet map[string]bool
+
+// NewServiceSet returns a set of the given services
+func NewServiceSet(services []string) ServiceSet {
+	set := make(ServiceSet, len(services))
+	for _, s := range services {
+		set[s] = true
+	}
+	return set
+}
+
+// Contains tells if the given service is part of the set
+func (set ServiceSet) Contains(service string) bool {
+	return set[service] || set["*"]
+}
+
+// CustomMeasure is a user-defined measure computed from a span metric
+type CustomMeasure struct {
+	Name    string // measure name in the exported Counts/Distributions
+	Metric  string // key of the span metric it is computed from
+	Kind    string // MeasureCount, MeasureSum or MeasureDistribution
+	Service string // only spans of this service are measured, any if empty
+	Span    string // only spans with this name are measured, any if empty
+}
+
+// matches tells if the measure applies to the given span
+func (m *CustomMeasure) matches(s *Span) bool {
+	return (m.Service == "" || m.Service == s.Service) &&
+		(m.Span == "" || m.Span == s.Name)
+}
+
+// LatencyThreshold holds the Apdex and latency SLO thresholds of the spans of
+// a service, or of one of its resources if set
+type LatencyThreshold struct {
+	Service  string
+	Resource string // any resource of the service if empty
+	Apdex    int64  // Apdex T in nanoseconds, 0 if not counted
+	SLO      int64  // SLO threshold in nanoseconds, 0 if not counted
+}
+
+// latencyThreshold returns the threshold applying to the span, if any, those
+// of its resource taking precedence over those of its service
+func (opts *StatsOptions) latencyThreshold(s *Span) *LatencyThreshold {
+	var match *LatencyThreshold
+	for i := range opts.LatencyThresholds {
+		lt := &opts.LatencyThresholds[i]
+		if lt.Service != s.Service {
+			continue
+		}
+		if lt.Resource == s.Resource {
+			return lt
+		}
+		if lt.Resource == "" && match == nil {
+			match = lt
+		}
+	}
+	return match
+}
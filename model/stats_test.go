@@ -2,6 +2,7 @@ package model
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
@@ -45,6 +46,7 @@ func TestGrainKey(t *testing.T) {
 	assert := assert.New(t)
 	gk := GrainKey("serve", "duration", "service:webserver")
 	assert.Equal("serve|duration|service:webserver", gk)
+	assert.Equal("service:webserver", GrainAggregation(gk, "serve", "duration"))
 }
 
 func TestStatsBucketDefault(t *testing.T) {
@@ -103,7 +105,7 @@ func TestStatsBucketDefault(t *testing.T) {
 	}
 
 	for k, v := range sb.Distributions {
-		t.Logf("%v: %v", k, v.Summary.Entries)
+		t.Logf("%v: %v", k, v.Summary.(*quantile.SliceSummary).Entries)
 	}
 	assert.Len(sb.Distributions, len(expectedDistributions), "Missing distributions!")
 	for dkey, c := range sb.Distributions {
@@ -111,7 +113,7 @@ func TestStatsBucketDefault(t *testing.T) {
 		if !ok {
 			assert.Fail("Unexpected distribution %s", dkey)
 		}
-		assert.Equal(val, len(c.Summary.Entries), "Distribution %s wrong value", dkey)
+		assert.Equal(val, len(c.Summary.(*quantile.SliceSummary).Entries), "Distribution %s wrong value", dkey)
 	}
 }
 
@@ -283,7 +285,7 @@ func TestStatsBucketSublayers(t *testing.T) {
 		if !ok {
 			assert.Fail("Unexpected distribution %s", dkey)
 		}
-		assert.Equal(val, d.Summary.Entries, "Distribution %s wrong value", dkey)
+		assert.Equal(val, d.Summary.(*quantile.SliceSummary).Entries, "Distribution %s wrong value", dkey)
 		keyFields := strings.Split(dkey, "|")
 		tags := NewTagSetFromString(keyFields[2])
 		assert.Equal(tags, d.TagSet, "bad tagset for distribution %s", dkey)
@@ -432,3 +434,27 @@ func BenchmarkStringsJoin(b *testing.B) {
 		_ = strings.Join(a, "|")
 	}
 }
+
+func TestDistributionJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, s := range []quantile.Sketch{quantile.NewSliceSummary(), quantile.NewLogSketch(0.02)} {
+		d := NewDistribution(DURATION, "A|duration|service:A", "A", NewTagSetFromString("service:A"))
+		d.Summary = s
+		d.Add(10, 1)
+		d.Add(20, 2)
+
+		js, err := json.Marshal(d)
+		assert.Nil(err)
+		var d2 Distribution
+		assert.Nil(json.Unmarshal(js, &d2))
+
+		assert.Equal(d.Key, d2.Key)
+		assert.Equal(d.TagSet, d2.TagSet)
+		assert.IsType(s, d2.Summary)
+		assert.Equal(2, d2.Summary.Count())
+		v, samples := d2.Summary.Quantile(1)
+		assert.Equal(20.0, v)
+		assert.Equal([]uint64{2}, samples)
+	}
+}
@@ -15,24 +15,48 @@ type groupedStats struct {
 	hits                 int64
 	errors               int64
 	duration             int64
-	durationDistribution *quantile.SliceSummary
+	durationDistribution quantile.Sketch
+
+	// only set once spans with a computed self duration were seen
+	selfDurationDistribution quantile.Sketch
 }
 
 type sublayerStats struct {
-	tags  TagSet
-	value int64
+	tags         TagSet
+	value        int64
+	distribution quantile.Sketch // only for the metrics of StatsOptions.SublayerDistributions
+}
+
+type extraStats struct {
+	tags         TagSet
+	kind         string
+	value        float64
+	distribution quantile.Sketch // only for distributions
 }
 
-func newGroupedStats(tags TagSet) groupedStats {
+func newGroupedStats(tags TagSet, durations quantile.Sketch) groupedStats {
 	return groupedStats{
 		tags:                 tags,
-		durationDistribution: quantile.NewSliceSummary(),
+		durationDistribution: durations,
 	}
 }
 
-func newSublayerStats(tags TagSet) sublayerStats {
+// newSublayerStats returns new sublayer stats, their values being also kept
+// in the given sketch if not nil
+func newSublayerStats(tags TagSet, distribution quantile.Sketch) sublayerStats {
 	return sublayerStats{
-		tags: tags,
+		tags:         tags,
+		distribution: distribution,
+	}
+}
+
+// newExtraStats returns new stats of the given kind, distributions being
+// kept in the given sketch
+func newExtraStats(tags TagSet, kind string, distribution quantile.Sketch) extraStats {
+	return extraStats{
+		tags:         tags,
+		kind:         kind,
+		distribution: distribution,
 	}
 }
 
@@ -56,9 +80,17 @@ type StatsRawBucket struct {
 	start    int64 // timestamp of start in our format
 	duration int64 // duration of a bucket in nanoseconds
 
+	opts *StatsOptions
+
 	// this should really remain private as it's subject to refactoring
 	data         map[statsKey]groupedStats
 	sublayerData map[statsSubKey]sublayerStats
+	extraData    map[statsSubKey]extraStats // custom measures, error types...
+
+	// distinct grains and error types, to enforce their limits, and the
+	// spans per service which were folded because of the grain limits
+	grains    *GrainCounter
+	overflows map[string]int64
 
 	// internal buffer for aggregate strings - not threadsafe
 	keyBuf bytes.Buffer
@@ -66,12 +98,26 @@ type StatsRawBucket struct {
 
 // NewStatsRawBucket opens a new calculation bucket for time ts and initializes it properly
 func NewStatsRawBucket(ts, d int64) *StatsRawBucket {
+	return NewStatsRawBucketWithOptions(ts, d, nil)
+}
+
+// NewStatsRawBucketWithOptions opens a new calculation bucket for time ts which
+// computes the optional stats of opts, if any
+func NewStatsRawBucketWithOptions(ts, d int64, opts *StatsOptions) *StatsRawBucket {
+	if opts == nil {
+		opts = &StatsOptions{}
+	}
 	// The only non-initialized value is the Duration which should be set by whoever closes that bucket
 	return &StatsRawBucket{
 		start:        ts,
 		duration:     d,
+		opts:         opts,
 		data:         make(map[statsKey]groupedStats),
 		sublayerData: make(map[statsSubKey]sublayerStats),
+		extraData:    make(map[statsSubKey]extraStats),
+
+		grains:    &GrainCounter{},
+		overflows: make(map[string]int64),
 	}
 }
 
@@ -112,6 +158,16 @@ func (sb *StatsRawBucket) Export() StatsBucket {
 			TagSet:  v.tags,
 			Summary: v.durationDistribution,
 		}
+		if v.selfDurationDistribution != nil {
+			selfKey := GrainKey(k.name, SELF_DURATION, k.aggr)
+			ret.Distributions[selfKey] = Distribution{
+				Key:     selfKey,
+				Name:    k.name,
+				Measure: SELF_DURATION,
+				TagSet:  v.tags,
+				Summary: v.selfDurationDistribution,
+			}
+		}
 	}
 	for k, v := range sb.sublayerData {
 		key := GrainKey(k.name, k.measure, k.aggr)
@@ -122,6 +178,35 @@ func (sb *StatsRawBucket) Export() StatsBucket {
 			TagSet:  v.tags,
 			Value:   float64(v.value),
 		}
+		if v.distribution != nil {
+			ret.Distributions[key] = Distribution{
+				Key:     key,
+				Name:    k.name,
+				Measure: k.measure,
+				TagSet:  v.tags,
+				Summary: v.distribution,
+			}
+		}
+	}
+	for k, v := range sb.extraData {
+		key := GrainKey(k.name, k.measure, k.aggr)
+		if v.kind == MeasureDistribution {
+			ret.Distributions[key] = Distribution{
+				Key:     key,
+				Name:    k.name,
+				Measure: k.measure,
+				TagSet:  v.tags,
+				Summary: v.distribution,
+			}
+			continue
+		}
+		ret.Counts[key] = Count{
+			Key:     key,
+			Name:    k.name,
+			Measure: k.measure,
+			TagSet:  v.tags,
+			Value:   v.value,
+		}
 	}
 	return ret
 }
@@ -168,9 +253,20 @@ func (sb *StatsRawBucket) HandleSpan(s Span, env string, aggregators []string, s
 		panic("env should never be empty")
 	}
 
+	code := httpStatusCode(&s)
+	if s.Error == 0 && code >= 500 && sb.opts.HTTP5xxErrorServices.Contains(s.Service) {
+		// only affects the stats, the span itself is left untouched
+		s.Error = 1
+	}
+
 	m := make(map[string]string)
 
 	for _, agg := range aggregators {
+		if agg == HTTPStatusClassKey && code != 0 {
+			// built-in aggregator, derived from the status code
+			m[agg] = httpStatusClass(code)
+			continue
+		}
 		if agg != "env" && agg != "resource" && agg != "service" {
 			if v, ok := s.Meta[agg]; ok {
 				m[agg] = v
@@ -179,6 +275,12 @@ func (sb *StatsRawBucket) HandleSpan(s Span, env string, aggregators []string, s
 	}
 
 	grain, tags := assembleGrain(&sb.keyBuf, env, s.Resource, s.Service, m)
+	if !sb.allowGrain(&s, grain) {
+		// the resource and extra aggregators being the likely culprits, fold
+		// the span into a single grain of its service
+		sb.overflows[s.Service]++
+		grain, tags = assembleGrain(&sb.keyBuf, env, OverflowResource, s.Service, nil)
+	}
 	sb.add(s, grain, tags)
 
 	// sublayers - special case
@@ -195,7 +297,7 @@ func (sb *StatsRawBucket) add(s Span, aggr string, tags TagSet) {
 
 	key := statsKey{name: s.Name, aggr: aggr}
 	if gs, ok = sb.data[key]; !ok {
-		gs = newGroupedStats(tags)
+		gs = newGroupedStats(tags, sb.opts.newSketch())
 	}
 
 	gs.hits++
@@ -204,12 +306,113 @@ func (sb *StatsRawBucket) add(s Span, aggr string, tags TagSet) {
 	}
 	gs.duration += s.Duration
 
-	// TODO add for s.Metrics ability to define arbitrary counts and distros, check some config?
 	// alter resolution of duration distro
 	trundur := nsTimestampToFloat(s.Duration)
 	gs.durationDistribution.Insert(trundur, s.SpanID)
 
+	if self, ok := s.SelfDuration(); ok {
+		if gs.selfDurationDistribution == nil {
+			gs.selfDurationDistribution = sb.opts.newSketch()
+		}
+		gs.selfDurationDistribution.Insert(nsTimestampToFloat(self), s.SpanID)
+	}
+
 	sb.data[key] = gs
+
+	for i := range sb.opts.CustomMeasures {
+		sb.addCustomMeasure(s, aggr, tags, &sb.opts.CustomMeasures[i])
+	}
+
+	if s.Error != 0 && sb.opts.ErrorTypeServices.Contains(s.Service) {
+		sb.addErrorType(s, aggr, tags)
+	}
+
+	if lt := sb.opts.latencyThreshold(&s); lt != nil {
+		sb.addLatencyThreshold(s, aggr, tags, lt)
+	}
+}
+
+// addLatencyThreshold counts the hit against the Apdex and SLO thresholds,
+// errors being frustrated whatever their duration as Apdex goes
+func (sb *StatsRawBucket) addLatencyThreshold(s Span, aggr string, tags TagSet, lt *LatencyThreshold) {
+	if lt.Apdex > 0 {
+		switch {
+		case s.Error != 0 || s.Duration > 4*lt.Apdex:
+			sb.addCount(s.Name, MeasureApdexFrustrated, aggr, tags)
+		case s.Duration > lt.Apdex:
+			sb.addCount(s.Name, MeasureApdexTolerating, aggr, tags)
+		default:
+			sb.addCount(s.Name, MeasureApdexSatisfied, aggr, tags)
+		}
+	}
+	if lt.SLO > 0 {
+		if s.Duration > lt.SLO {
+			sb.addCount(s.Name, MeasureSLOBreaching, aggr, tags)
+		} else {
+			sb.addCount(s.Name, MeasureSLOWithin, aggr, tags)
+		}
+	}
+}
+
+// addCount increments the extra count of the given measure in the grain
+func (sb *StatsRawBucket) addCount(name, measure, aggr string, tags TagSet) {
+	key := statsSubKey{name: name, measure: measure, aggr: aggr}
+	cs, ok := sb.extraData[key]
+	if !ok {
+		cs = newExtraStats(tags, MeasureCount, nil)
+	}
+	cs.value++
+	sb.extraData[key] = cs
+}
+
+// addErrorType counts the error of the span by its error type, as an extra
+// errors count with an error.type tag
+func (sb *StatsRawBucket) addErrorType(s Span, aggr string, tags TagSet) {
+	errType := NormalizeTag(s.Meta[ErrorTypeKey])
+	if errType == "" {
+		errType = ErrorTypeUnknown
+	}
+
+	errType = sb.grains.errorType(s.Service, errType, sb.opts.ErrorTypeMaxCardinality)
+
+	key := statsSubKey{name: s.Name, measure: ERRORS, aggr: aggr + "," + ErrorTypeKey + ":" + errType}
+	es, ok := sb.extraData[key]
+	if !ok {
+		errTags := make(TagSet, len(tags)+1)
+		copy(errTags, tags)
+		errTags[len(tags)] = Tag{ErrorTypeKey, errType}
+		es = newExtraStats(errTags, MeasureCount, nil)
+	}
+	es.value++
+	sb.extraData[key] = es
+}
+
+func (sb *StatsRawBucket) addCustomMeasure(s Span, aggr string, tags TagSet, m *CustomMeasure) {
+	v, ok := s.Metrics[m.Metric]
+	if !ok || !m.matches(&s) {
+		return
+	}
+
+	key := statsSubKey{name: s.Name, measure: m.Name, aggr: aggr}
+	cs, ok := sb.extraData[key]
+	if !ok {
+		var d quantile.Sketch
+		if m.Kind == MeasureDistribution {
+			d = sb.opts.newSketch()
+		}
+		cs = newExtraStats(tags, m.Kind, d)
+	}
+
+	switch m.Kind {
+	case MeasureCount:
+		cs.value++
+	case MeasureSum:
+		cs.value += v
+	case MeasureDistribution:
+		cs.distribution.Insert(v, s.SpanID)
+	}
+
+	sb.extraData[key] = cs
 }
 
 func (sb *StatsRawBucket) addSublayer(s Span, aggr string, tags TagSet, sub SublayerValue) {
@@ -221,17 +424,33 @@ func (sb *StatsRawBucket) addSublayer(s Span, aggr string, tags TagSet, sub Subl
 	var ss sublayerStats
 	var ok bool
 
-	subAggr := aggr + "," + sub.Tag.Name + ":" + sub.Tag.Value
-	subTags := make(TagSet, len(tags)+1)
-	copy(subTags, tags)
-	subTags[len(tags)] = sub.Tag
+	tag := sub.Tag
+	key := statsSubKey{name: s.Name, measure: sub.Metric, aggr: aggr + "," + tag.Name + ":" + tag.Value}
+	if tag.Name != "" && !sb.allowSublayer(&s, key) {
+		// fold the values of the sublayer past the grain limits, like the
+		// ones of the sublayers of a trace past MaxSublayerMetaValues
+		tag.Value = SublayerOther
+		key.aggr = aggr + "," + tag.Name + ":" + tag.Value
+	}
 
-	key := statsSubKey{name: s.Name, measure: sub.Metric, aggr: subAggr}
 	if ss, ok = sb.sublayerData[key]; !ok {
-		ss = newSublayerStats(subTags)
+		subTags := make(TagSet, len(tags)+1)
+		copy(subTags, tags)
+		subTags[len(tags)] = tag
+
+		var d quantile.Sketch
+		if sb.opts.SublayerDistributions[sub.Metric] {
+			d = sb.opts.newSketch()
+		}
+		ss = newSublayerStats(subTags, d)
 	}
 
 	ss.value += int64(sub.Value)
+	if ss.distribution != nil {
+		// sublayers are only computed for root spans, so there is one value
+		// per trace, sampled by the ID of its root
+		ss.distribution.Insert(nsTimestampToFloat(int64(sub.Value)), s.SpanID)
+	}
 
 	sb.sublayerData[key] = ss
 }
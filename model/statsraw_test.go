@@ -27,3 +27,259 @@ func TestGrainWithExtraTags(t *testing.T) {
 	assert.Equal("env:default,resource:yo,service:thing,meta1:ONE,meta2:two", aggr)
 	assert.Equal(TagSet{Tag{"env", "default"}, Tag{"resource", "yo"}, Tag{"service", "thing"}, Tag{"meta1", "ONE"}, Tag{"meta2", "two"}}, tgs)
 }
+
+func TestCustomMeasures(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucketWithOptions(0, 1e9, &StatsOptions{
+		CustomMeasures: []CustomMeasure{
+			{Name: "rows", Metric: "db.rows_returned", Kind: MeasureDistribution},
+			{Name: "cost", Metric: "cost.usd", Kind: MeasureSum, Service: "checkout"},
+			{Name: "billed", Metric: "cost.usd", Kind: MeasureCount, Span: "charge"},
+		},
+	})
+
+	spans := []Span{
+		{SpanID: 1, Service: "pg", Name: "query", Resource: "SELECT", Metrics: map[string]float64{"db.rows_returned": 10}},
+		{SpanID: 2, Service: "pg", Name: "query", Resource: "SELECT", Metrics: map[string]float64{"db.rows_returned": 30}},
+		{SpanID: 3, Service: "pg", Name: "query", Resource: "SELECT"},
+		{SpanID: 4, Service: "checkout", Name: "charge", Resource: "/pay", Metrics: map[string]float64{"cost.usd": 1.5}},
+		{SpanID: 5, Service: "checkout", Name: "charge", Resource: "/pay", Metrics: map[string]float64{"cost.usd": 2}},
+		{SpanID: 6, Service: "billing", Name: "charge", Resource: "/pay", Metrics: map[string]float64{"cost.usd": 4}},
+	}
+	for _, s := range spans {
+		srb.HandleSpan(s, "default", nil, nil)
+	}
+	sb := srb.Export()
+
+	rows, ok := sb.Distributions["query|rows|env:default,resource:SELECT,service:pg"]
+	assert.True(ok)
+	assert.Equal("rows", rows.Measure)
+	assert.Equal(2, rows.Summary.Count())
+	min, _ := rows.Summary.Quantile(0)
+	assert.Equal(10.0, min)
+	max, samples := rows.Summary.Quantile(1)
+	assert.Equal(30.0, max)
+	assert.Equal([]uint64{2}, samples)
+
+	assert.Equal(3.5, sb.Counts["charge|cost|env:default,resource:/pay,service:checkout"].Value)
+	_, ok = sb.Counts["charge|cost|env:default,resource:/pay,service:billing"]
+	assert.False(ok)
+
+	assert.Equal(2.0, sb.Counts["charge|billed|env:default,resource:/pay,service:checkout"].Value)
+	assert.Equal(1.0, sb.Counts["charge|billed|env:default,resource:/pay,service:billing"].Value)
+
+	// 3 default counts per grain, and the custom ones
+	assert.Equal(3*3+3, len(sb.Counts))
+	assert.Equal(3+1, len(sb.Distributions))
+}
+
+func TestErrorTypes(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucketWithOptions(0, 1e9, &StatsOptions{
+		ErrorTypeServices:       NewServiceSet([]string{"web"}),
+		ErrorTypeMaxCardinality: 2,
+	})
+
+	errSpan := func(service, errType string) Span {
+		s := Span{Service: service, Name: "request", Resource: "/", Error: 1}
+		if errType != "" {
+			s.Meta = map[string]string{"error.type": errType}
+		}
+		return s
+	}
+	spans := []Span{
+		errSpan("web", "java.lang.NullPointerException"),
+		errSpan("web", "  java.lang.NullPointerException "),
+		errSpan("web", ""),
+		errSpan("web", "TimeoutError"),
+		errSpan("web", "ValueError"),
+		errSpan("db", "TimeoutError"),
+		{Service: "web", Name: "request", Resource: "/", Meta: map[string]string{"error.type": "ignored"}},
+	}
+	for _, s := range spans {
+		srb.HandleSpan(s, "default", nil, nil)
+	}
+	sb := srb.Export()
+
+	aggr := "request|errors|env:default,resource:/,service:web"
+	assert.Equal(5.0, sb.Counts[aggr].Value)
+
+	expected := map[string]float64{
+		"java.lang.nullpointerexception": 2,
+		"unknown":                        1,
+		// cardinality cap reached
+		"_other": 2,
+	}
+	for errType, v := range expected {
+		c, ok := sb.Counts[aggr+",error.type:"+errType]
+		if !assert.True(ok, errType) {
+			continue
+		}
+		assert.Equal(v, c.Value, errType)
+		assert.Equal(ERRORS, c.Measure)
+		assert.Equal(errType, c.TagSet.Get("error.type").Value)
+		assert.Equal("web", c.TagSet.Get("service").Value)
+	}
+
+	// 3 default counts for each of the 2 grains, and the error types of web
+	assert.Equal(3*2+len(expected), len(sb.Counts))
+}
+
+func TestHTTPStatusClass(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucketWithOptions(0, 1e9, &StatsOptions{
+		HTTP5xxErrorServices: NewServiceSet([]string{"web"}),
+	})
+
+	httpSpan := func(service, code string, err int32) Span {
+		return Span{Service: service, Name: "request", Resource: "/", Error: err, Meta: map[string]string{"http.status_code": code}}
+	}
+	spans := []Span{
+		httpSpan("web", "200", 0),
+		httpSpan("web", "204", 0),
+		httpSpan("web", "404", 0),
+		httpSpan("web", "500", 0),
+		httpSpan("web", "503", 1),
+		httpSpan("api", "502", 0),
+		httpSpan("api", "not a code", 0),
+		{Service: "api", Name: "request", Resource: "/"},
+	}
+	aggr := []string{"http.status_class"}
+	for _, s := range spans {
+		srb.HandleSpan(s, "default", aggr, nil)
+	}
+	sb := srb.Export()
+
+	expected := map[string]float64{
+		"request|hits|env:default,resource:/,service:web,http.status_class:2xx":   2,
+		"request|hits|env:default,resource:/,service:web,http.status_class:4xx":   1,
+		"request|hits|env:default,resource:/,service:web,http.status_class:5xx":   2,
+		"request|errors|env:default,resource:/,service:web,http.status_class:5xx": 2,
+		"request|hits|env:default,resource:/,service:api,http.status_class:5xx":   1,
+		"request|errors|env:default,resource:/,service:api,http.status_class:5xx": 0,
+		"request|hits|env:default,resource:/,service:api":                         2,
+	}
+	for key, v := range expected {
+		c, ok := sb.Counts[key]
+		if assert.True(ok, key) {
+			assert.Equal(v, c.Value, key)
+		}
+	}
+	assert.Equal("5xx", sb.Counts["request|hits|env:default,resource:/,service:web,http.status_class:5xx"].TagSet.Get("http.status_class").Value)
+	assert.Equal(3*5, len(sb.Counts))
+}
+
+func TestLatencyThresholds(t *testing.T) {
+	assert := assert.New(t)
+
+	srb := NewStatsRawBucketWithOptions(0, 1e9, &StatsOptions{
+		LatencyThresholds: []LatencyThreshold{
+			{Service: "web", Apdex: 100, SLO: 300},
+			{Service: "web", Resource: "/checkout", SLO: 50},
+		},
+	})
+
+	span := func(resource string, duration int64, err int32) Span {
+		return Span{Service: "web", Name: "request", Resource: resource, Duration: duration, Error: err}
+	}
+	for _, s := range []Span{
+		span("/", 100, 0),
+		span("/", 101, 0),
+		span("/", 400, 0),
+		span("/", 401, 0),
+		span("/", 10, 1),
+		span("/checkout", 50, 0),
+		span("/checkout", 60, 0),
+		{Service: "db", Name: "query", Resource: "SELECT ?", Duration: 1000},
+	} {
+		srb.HandleSpan(s, "default", nil, nil)
+	}
+	sb := srb.Export()
+
+	aggr := "env:default,resource:/,service:web"
+	expected := map[string]float64{
+		MeasureApdexSatisfied:  1,
+		MeasureApdexTolerating: 2, // up to 4T included
+		MeasureApdexFrustrated: 2, // errors included
+		MeasureSLOWithin:       3,
+		MeasureSLOBreaching:    2,
+	}
+	for measure, v := range expected {
+		c, ok := sb.Counts[GrainKey("request", measure, aggr)]
+		if !assert.True(ok, measure) {
+			continue
+		}
+		assert.Equal(v, c.Value, measure)
+		assert.Equal(measure, c.Measure)
+	}
+
+	// the thresholds of the resource take precedence
+	aggr = "env:default,resource:/checkout,service:web"
+	assert.Equal(1.0, sb.Counts[GrainKey("request", MeasureSLOWithin, aggr)].Value)
+	assert.Equal(1.0, sb.Counts[GrainKey("request", MeasureSLOBreaching, aggr)].Value)
+	_, ok := sb.Counts[GrainKey("request", MeasureApdexSatisfied, aggr)]
+	assert.False(ok)
+
+	// other services are not counted
+	_, ok = sb.Counts[GrainKey("query", MeasureSLOWithin, "env:default,resource:SELECT ?,service:db")]
+	assert.False(ok)
+}
+
+func TestSublayersByMeta(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := Trace{
+		Span{SpanID: 1, Start: 0, Duration: 100, Service: "web", Name: "request", Resource: "/"},
+		Span{SpanID: 2, ParentID: 1, Start: 10, Duration: 30, Service: "pg", Meta: map[string]string{"db.instance": "users"}},
+	}
+	sublayers := ComputeSublayersWithMeta(&tr, []string{"db.instance"})
+
+	srb := NewStatsRawBucket(0, 1e9)
+	srb.HandleSpan(tr[0], "default", nil, &sublayers)
+	sb := srb.Export()
+
+	key := "request|_sublayers.duration.by_db.instance|env:default,resource:/,service:web,sublayer_db.instance:users"
+	c, ok := sb.Counts[key]
+	if assert.True(ok) {
+		assert.Equal(30.0, c.Value)
+		assert.Equal("users", c.TagSet.Get("sublayer_db.instance").Value)
+	}
+}
+
+func TestSublayerDistributions(t *testing.T) {
+	assert := assert.New(t)
+
+	opts := &StatsOptions{SublayerDistributions: map[string]bool{"_sublayers.duration.by_type": true}}
+	srb := NewStatsRawBucketWithOptions(0, 1e9, opts)
+	for i := uint64(1); i <= 10; i++ {
+		tr := Trace{
+			Span{SpanID: i * 10, Start: 0, Duration: 1000, Service: "web", Name: "request", Resource: "/", Type: "web"},
+			Span{SpanID: i*10 + 1, ParentID: i * 10, Start: 10, Duration: int64(i) * 50, Service: "pg", Name: "query", Type: "db"},
+		}
+		sublayers := ComputeSublayers(&tr)
+		srb.HandleSpan(tr[0], "default", nil, &sublayers)
+	}
+	sb := srb.Export()
+
+	// one value per trace, sampled by its root
+	key := "request|_sublayers.duration.by_type|env:default,resource:/,service:web,sublayer_type:db"
+	d, ok := sb.Distributions[key]
+	if assert.True(ok) {
+		assert.Equal(10, d.Summary.Count())
+		assert.Equal("db", d.TagSet.Get("sublayer_type").Value)
+		v, samples := d.Summary.Quantile(1)
+		assert.Equal(500.0, v)
+		assert.Equal([]uint64{100}, samples)
+	}
+	// the sums are still counted
+	assert.Equal(2750.0, sb.Counts[key].Value)
+
+	// other sublayer metrics aren't kept as distributions
+	_, ok = sb.Distributions["request|_sublayers.duration.by_service|env:default,resource:/,service:web,sublayer_service:pg"]
+	assert.False(ok)
+	_, ok = sb.Counts["request|_sublayers.duration.by_service|env:default,resource:/,service:web,sublayer_service:pg"]
+	assert.True(ok)
+}
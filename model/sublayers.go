@@ -1,6 +1,17 @@
 package model
 
-import "bytes"
+import (
+	"bytes"
+	"sort"
+)
+
+const (
+	// MaxSublayerMetaValues is the maximum number of distinct values of a meta
+	// key reported as sublayers of a trace, the ones with the most time
+	MaxSublayerMetaValues = 10
+	// SublayerOther is the sublayer the time of the other values is folded into
+	SublayerOther = "_other"
+)
 
 // SublayerValue is just a span-metric placeholder for a given
 // sublayer val
@@ -12,23 +23,25 @@ type SublayerValue struct {
 
 // ComputeSublayers extracts sublayer values by type & service for a trace
 func ComputeSublayers(t *Trace) []SublayerValue {
-	iter := NewTraceLevelIterator(*t)
-	root, err := iter.NextSpan()
-	if err != nil {
+	return ComputeSublayersWithMeta(t, nil)
+}
+
+// ComputeSublayersWithMeta extracts sublayer values by type & service for a
+// trace, and by the value of each of the given meta keys, e.g. db.instance
+func ComputeSublayersWithMeta(t *Trace, metaKeys []string) []SublayerValue {
+	spans, parents := reachableSpans(t)
+	if len(spans) == 0 {
 		// no root, skip sublayers
 		return []SublayerValue{}
 	}
 
-	ss := newSublayerSpans()
-	ss.Add(root)
-
-	for iter.NextLevel() == nil {
-		for cur, err := iter.NextSpan(); err == nil; cur, err = iter.NextSpan() {
-			ss.Add(cur)
-		}
+	var s []SublayerValue
+	s = appendSublayers(s, "type", exclusiveTimes(spans, parents, func(s *Span) string { return s.Type }))
+	s = appendSublayers(s, "service", exclusiveTimes(spans, parents, func(s *Span) string { return s.Service }))
+	for _, key := range metaKeys {
+		times := exclusiveTimes(spans, parents, func(s *Span) string { return s.Meta[key] })
+		s = appendSublayers(s, key, foldSublayers(times, MaxSublayerMetaValues))
 	}
-
-	s := ss.OutputSublayers()
 	s = append(s, SublayerValue{
 		Metric: "_sublayers.span_count",
 		Value:  float64(len(*t)),
@@ -37,6 +50,82 @@ func ComputeSublayers(t *Trace) []SublayerValue {
 	return s
 }
 
+// reachableSpans returns the spans reachable from the root of the trace,
+// parents first, with the index of the parent of each of them, -1 for the root
+func reachableSpans(t *Trace) ([]*Span, []int) {
+	iter := NewTraceLevelIterator(*t)
+	root, err := iter.NextSpan()
+	if err != nil {
+		return nil, nil
+	}
+
+	spans := []*Span{root}
+	parents := []int{-1}
+	index := map[uint64]int{root.SpanID: 0}
+	for iter.NextLevel() == nil {
+		for cur, err := iter.NextSpan(); err == nil; cur, err = iter.NextSpan() {
+			index[cur.SpanID] = len(spans)
+			spans = append(spans, cur)
+			parents = append(parents, index[cur.ParentID])
+		}
+	}
+	return spans, parents
+}
+
+// appendSublayers appends the times of the sublayers of the given dimension,
+// as `_sublayers.duration.by_<dimension>` values tagged with `sublayer_<dimension>`
+func appendSublayers(s []SublayerValue, dimension string, times map[string]int64) []SublayerValue {
+	for k, v := range times {
+		s = append(s, SublayerValue{
+			Metric: "_sublayers.duration.by_" + dimension,
+			Tag:    Tag{"sublayer_" + dimension, k},
+			Value:  float64(v),
+		})
+	}
+	return s
+}
+
+// foldSublayers keeps the max-1 sublayers with the most time, folding the time
+// of the others into SublayerOther, so that the values of meta keys don't add
+// an unbounded number of metrics to the root
+func foldSublayers(times map[string]int64, max int) map[string]int64 {
+	if len(times) <= max {
+		return times
+	}
+	layers := make(sublayerTimes, 0, len(times))
+	for k, v := range times {
+		layers = append(layers, sublayerTime{k, v})
+	}
+	sort.Sort(layers)
+
+	folded := make(map[string]int64, max)
+	for i, l := range layers {
+		if i < max-1 {
+			folded[l.name] = l.time
+		} else {
+			folded[SublayerOther] += l.time
+		}
+	}
+	return folded
+}
+
+type sublayerTime struct {
+	name string
+	time int64
+}
+
+// sublayerTimes sorts the sublayers by decreasing time, then by name
+type sublayerTimes []sublayerTime
+
+func (t sublayerTimes) Len() int      { return len(t) }
+func (t sublayerTimes) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t sublayerTimes) Less(i, j int) bool {
+	if t[i].time != t[j].time {
+		return t[i].time > t[j].time
+	}
+	return t[i].name < t[j].name
+}
+
 // SetSublayersOnSpan takes some sublayers and pins them on the given span.Metrics
 func SetSublayersOnSpan(span *Span, sv []SublayerValue) {
 	var b bytes.Buffer
@@ -58,96 +147,134 @@ func SetSublayersOnSpan(span *Span, sv []SublayerValue) {
 	}
 }
 
-type timeSpan struct {
-	Name     string
-	Start    int64
-	Duration int64
+// timelineEvent is the start or the end of a span in the timeline of a trace
+type timelineEvent struct {
+	time  int64
+	span  int
+	start bool
 }
 
-func insertTS(sts []timeSpan, ts timeSpan) []timeSpan {
-	// don't do anything with unnamed
-	if ts.Name == "" {
-		return sts
-	}
+type timelineEvents []timelineEvent
 
-	if len(sts) == 0 {
-		sts = append(sts, ts)
-	} else {
-		// find the timeSpan that contains that one (we go down in the tree, so
-		// it should exist) - if not just skip
-		// FIXME does NOT work for parallel stuff
-		for i, ots := range sts {
-			// >======================< ots
-			//          >======<        ts
-			if ots.Start <= ts.Start && ots.Start+ots.Duration >= ts.Start+ts.Duration {
-				// do not account for if same name
-				if ots.Name == ts.Name {
-					return sts
-				}
+func (e timelineEvents) Len() int           { return len(e) }
+func (e timelineEvents) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e timelineEvents) Less(i, j int) bool { return e[i].time < e[j].time }
 
-				// transform into
-				// >========<               [i]   ots
-				//          >======<        [i+1] ts
-				//                 >======< [i+2] newts
-				newts := timeSpan{ots.Name, ts.Start + ts.Duration, ots.Start + ots.Duration - (ts.Start + ts.Duration)}
-				ots.Duration = ts.Start - ots.Start
-				sts = append(sts, timeSpan{}, timeSpan{})
-				copy(sts[i+2:], sts[i:])
-				sts[i] = ots
-				sts[i+1] = ts
-				sts[i+2] = newts
-				break
-			}
-		}
-	}
-	return sts
+// timelineSpan is the state of a span along the timeline
+type timelineSpan struct {
+	layer           int   // index of its sublayer name
+	owner           int   // span starting its sublayer, itself or a named ancestor
+	start, end      int64 // limited to the root, and to the owner of its sublayer
+	open            bool
+	openDescendants int
 }
 
-type sublayerSpans struct {
-	byType    []timeSpan
-	byService []timeSpan
-}
+// exclusiveTimes returns the time spent in each sublayer of the trace, by the
+// sublayer name of the spans. The spans, reachable from the root, are given
+// parents first.
+//
+// The timeline of the root is split into the intervals between the starts and
+// ends of the spans. The duration of each interval is attributed to the spans
+// open during it with no open descendant, so that concurrent children are all
+// accounted for: the sum of the sublayers is the root duration for sequential
+// traces, and at most the root duration times the concurrency otherwise.
+//
+// A span without sublayer name, or with the one of its closest named ancestor,
+// is part of that ancestor's sublayer. It is limited to the time of that
+// ancestor, as it can't make it last longer. Unnamed top spans are not counted.
+func exclusiveTimes(spans []*Span, parents []int, name func(*Span) string) map[string]int64 {
+	tl := make([]timelineSpan, len(spans))
+	events := make(timelineEvents, 0, 2*len(spans))
+	var layers []string
 
-func newSublayerSpans() *sublayerSpans {
-	return &sublayerSpans{
-		byType:    []timeSpan{},
-		byService: []timeSpan{},
-	}
-}
+	for i, s := range spans {
+		t := &tl[i]
+		t.start, t.end = s.Start, s.End()
+		t.owner = i
+		t.layer = -1
 
-func (ss *sublayerSpans) Add(s *Span) {
-	tsType := timeSpan{s.Type, s.Start, s.Duration}
-	tsService := timeSpan{s.Service, s.Start, s.Duration}
+		layer := name(s)
+		if p := parents[i]; p >= 0 {
+			owner := &tl[tl[p].owner]
+			if layer == "" || layer == layers[owner.layer] {
+				t.owner = tl[p].owner
+				t.layer = owner.layer
+			} else {
+				// new sublayers are limited to the root only
+				owner = &tl[0]
+			}
+			if t.start < owner.start {
+				t.start = owner.start
+			}
+			if t.end > owner.end {
+				t.end = owner.end
+			}
+		}
+		if t.layer == -1 {
+			t.layer = layerIndex(&layers, layer)
+		}
 
-	ss.byType = insertTS(ss.byType, tsType)
-	ss.byService = insertTS(ss.byService, tsService)
-}
+		if t.start < t.end {
+			events = append(events, timelineEvent{t.start, i, true}, timelineEvent{t.end, i, false})
+		}
+	}
+	sort.Sort(events)
 
-func (ss *sublayerSpans) OutputSublayers() []SublayerValue {
-	mType := make(map[string]float64)
-	mService := make(map[string]float64)
+	// spans are active while open without open descendant
+	active := make([]int64, len(layers))
+	times := make([]int64, len(layers))
 
-	for _, ts := range ss.byType {
-		mType[ts.Name] += float64(ts.Duration)
-	}
-	for _, ts := range ss.byService {
-		mService[ts.Name] += float64(ts.Duration)
+	var last int64
+	for _, e := range events {
+		if d := e.time - last; d > 0 {
+			for l, count := range active {
+				times[l] += d * count
+			}
+		}
+		last = e.time
+
+		t := &tl[e.span]
+		if e.start {
+			t.open = true
+			if t.openDescendants == 0 {
+				active[t.layer]++
+			}
+			for p := parents[e.span]; p >= 0; p = parents[p] {
+				tl[p].openDescendants++
+				if tl[p].openDescendants == 1 && tl[p].open {
+					active[tl[p].layer]--
+				}
+			}
+		} else {
+			if t.openDescendants == 0 {
+				active[t.layer]--
+			}
+			t.open = false
+			for p := parents[e.span]; p >= 0; p = parents[p] {
+				tl[p].openDescendants--
+				if tl[p].openDescendants == 0 && tl[p].open {
+					active[tl[p].layer]++
+				}
+			}
+		}
 	}
 
-	sublayers := make([]SublayerValue, 0, len(mType)+len(mService)+1)
-	for k, v := range mType {
-		sublayers = append(sublayers, SublayerValue{
-			Metric: "_sublayers.duration.by_type",
-			Tag:    Tag{"sublayer_type", k},
-			Value:  v,
-		})
+	m := make(map[string]int64, len(layers))
+	for l, layer := range layers {
+		if layer != "" && times[l] > 0 {
+			m[layer] = times[l]
+		}
 	}
-	for k, v := range mService {
-		sublayers = append(sublayers, SublayerValue{
-			Metric: "_sublayers.duration.by_service",
-			Tag:    Tag{"sublayer_service", k},
-			Value:  v,
-		})
+	return m
+}
+
+// layerIndex returns the index of the layer in layers, adding it if needed
+func layerIndex(layers *[]string, layer string) int {
+	for i, l := range *layers {
+		if l == layer {
+			return i
+		}
 	}
-	return sublayers
+	*layers = append(*layers, layer)
+	return len(*layers) - 1
 }
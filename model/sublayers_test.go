@@ -1,7 +1,10 @@
 package model
 
 import (
+	"fmt"
+	"math/rand"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -101,3 +104,241 @@ func BenchmarkSublayerThru(b *testing.B) {
 		ComputeSublayers(&tr)
 	}
 }
+
+// sublayerMetrics returns the sublayers of the trace as their span metrics
+func sublayerMetrics(tr Trace) map[string]float64 {
+	var s Span
+	SetSublayersOnSpan(&s, ComputeSublayers(&tr))
+	delete(s.Metrics, "_sublayers.span_count")
+	return s.Metrics
+}
+
+func TestSublayerParallel(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tc := range []struct {
+		name     string
+		trace    Trace
+		expected map[string]float64
+	}{
+		{
+			// >================================< web
+			//    >==============<                 db
+			//       >=================<           cache
+			name: "fan-out",
+			trace: Trace{
+				Span{SpanID: 1, Start: 0, Duration: 100, Service: "web", Type: "web"},
+				Span{SpanID: 2, ParentID: 1, Start: 10, Duration: 50, Service: "db", Type: "sql"},
+				Span{SpanID: 3, ParentID: 1, Start: 20, Duration: 60, Service: "cache", Type: "redis"},
+			},
+			expected: map[string]float64{
+				"_sublayers.duration.by_service.sublayer_service:web":   30,
+				"_sublayers.duration.by_service.sublayer_service:db":    50,
+				"_sublayers.duration.by_service.sublayer_service:cache": 60,
+				"_sublayers.duration.by_type.sublayer_type:web":         30,
+				"_sublayers.duration.by_type.sublayer_type:sql":         50,
+				"_sublayers.duration.by_type.sublayer_type:redis":       60,
+			},
+		},
+		{
+			// parallel children of the same sublayer are all counted
+			name: "same sublayer",
+			trace: Trace{
+				Span{SpanID: 1, Start: 0, Duration: 100, Service: "web", Type: "web"},
+				Span{SpanID: 2, ParentID: 1, Start: 10, Duration: 40, Service: "db", Type: "sql"},
+				Span{SpanID: 3, ParentID: 1, Start: 20, Duration: 40, Service: "db", Type: "sql"},
+				Span{SpanID: 4, ParentID: 1, Start: 20, Duration: 40, Service: "web", Type: "web"},
+			},
+			expected: map[string]float64{
+				"_sublayers.duration.by_service.sublayer_service:web": 10 + 40 + 40,
+				"_sublayers.duration.by_service.sublayer_service:db":  80,
+				"_sublayers.duration.by_type.sublayer_type:web":       10 + 40 + 40,
+				"_sublayers.duration.by_type.sublayer_type:sql":       80,
+			},
+		},
+		{
+			// async children are only counted while the root lasts
+			name: "async",
+			trace: Trace{
+				Span{SpanID: 1, Start: 0, Duration: 100, Service: "web", Type: "web"},
+				Span{SpanID: 2, ParentID: 1, Start: 60, Duration: 200, Service: "worker", Type: "queue"},
+				Span{SpanID: 3, ParentID: 2, Start: 150, Duration: 50, Service: "db", Type: "sql"},
+			},
+			expected: map[string]float64{
+				"_sublayers.duration.by_service.sublayer_service:web":    60,
+				"_sublayers.duration.by_service.sublayer_service:worker": 40,
+				"_sublayers.duration.by_type.sublayer_type:web":          60,
+				"_sublayers.duration.by_type.sublayer_type:queue":        40,
+			},
+		},
+		{
+			// children of an unnamed span are still accounted for, concurrently
+			name: "unnamed parent",
+			trace: Trace{
+				Span{SpanID: 1, Start: 0, Duration: 100, Service: "web", Type: "web"},
+				Span{SpanID: 2, ParentID: 1, Start: 10, Duration: 80, Service: "web"},
+				Span{SpanID: 3, ParentID: 2, Start: 20, Duration: 20, Service: "db", Type: "sql"},
+				Span{SpanID: 4, ParentID: 2, Start: 30, Duration: 40, Service: "db", Type: "sql"},
+			},
+			expected: map[string]float64{
+				"_sublayers.duration.by_service.sublayer_service:web": 100 - 50,
+				"_sublayers.duration.by_service.sublayer_service:db":  60,
+				"_sublayers.duration.by_type.sublayer_type:web":       100 - 50,
+				"_sublayers.duration.by_type.sublayer_type:sql":       60,
+			},
+		},
+	} {
+		assert.Equal(tc.expected, sublayerMetrics(tc.trace), tc.name)
+	}
+}
+
+// randomSublayerTrace returns a random trace of n spans. Unless parallel,
+// children are within their parent and siblings don't overlap.
+func randomSublayerTrace(r *rand.Rand, n int, parallel bool) Trace {
+	services := []string{"web", "db", "cache", "worker"}
+	types := []string{"web", "sql", "redis", ""}
+
+	names := []string{"request", "query", "get", "job"}
+
+	tr := Trace{Span{SpanID: 1, Start: 0, Duration: 1000 + r.Int63n(1e6), Service: "web", Name: "request", Type: "web"}}
+	free := []int64{0} // end of the last child of each span
+	for i := 1; i < n; i++ {
+		p := r.Intn(len(tr))
+		parent := tr[p]
+		s := Span{
+			SpanID:   uint64(i + 1),
+			ParentID: parent.SpanID,
+			Service:  services[r.Intn(len(services))],
+			Name:     names[r.Intn(len(names))],
+			Type:     types[r.Intn(len(types))],
+		}
+		if parallel {
+			s.Start = parent.Start + r.Int63n(parent.Duration+1) - parent.Duration/4
+			s.Duration = r.Int63n(parent.Duration + 1)
+		} else {
+			start := parent.Start + free[p]
+			if start >= parent.End() {
+				continue
+			}
+			s.Start = start + r.Int63n(parent.End()-start)
+			s.Duration = r.Int63n(parent.End() - s.Start + 1)
+			free[p] = s.End() - parent.Start
+		}
+		tr = append(tr, s)
+		free = append(free, 0)
+	}
+	return tr
+}
+
+// maxConcurrency returns the maximum number of spans open at once during the root
+func maxConcurrency(tr Trace) int {
+	var max int
+	for _, s := range tr {
+		if s.Start < tr[0].Start || s.Start >= tr[0].End() {
+			continue
+		}
+		open := 0
+		for _, o := range tr {
+			if o.Start <= s.Start && o.End() > s.Start {
+				open++
+			}
+		}
+		if open > max {
+			max = open
+		}
+	}
+	return max
+}
+
+func TestSublayerProperties(t *testing.T) {
+	assert := assert.New(t)
+	r := rand.New(rand.NewSource(42))
+
+	for i := 0; i < 500; i++ {
+		parallel := i%2 == 0
+		tr := randomSublayerTrace(r, 1+r.Intn(30), parallel)
+		root := tr[0]
+
+		totals := map[string]float64{}
+		for _, sub := range ComputeSublayers(&tr) {
+			assert.True(sub.Value >= 0, "negative sublayer %v", sub)
+			totals[sub.Metric] += sub.Value
+		}
+
+		for _, metric := range []string{"_sublayers.duration.by_service", "_sublayers.duration.by_type"} {
+			total := totals[metric]
+			if parallel {
+				// there's always a span of the root sublayer or below running
+				assert.True(total >= float64(root.Duration), "%s: %f < %d", metric, total, root.Duration)
+				limit := float64(root.Duration) * float64(maxConcurrency(tr))
+				assert.True(total <= limit, "%s: %f > %f", metric, total, limit)
+			} else {
+				assert.Equal(float64(root.Duration), total, metric)
+			}
+		}
+	}
+}
+
+func TestSublayerMeta(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := Trace{
+		Span{SpanID: 1, Start: 0, Duration: 100, Service: "web", Type: "web"},
+		Span{SpanID: 2, ParentID: 1, Start: 10, Duration: 30, Service: "pg", Type: "sql", Meta: map[string]string{"db.instance": "users"}},
+		Span{SpanID: 3, ParentID: 1, Start: 50, Duration: 20, Service: "pg", Type: "sql", Meta: map[string]string{"db.instance": "orders", "out.host": "db1"}},
+		Span{SpanID: 4, ParentID: 3, Start: 55, Duration: 5, Service: "pg", Type: "sql", Meta: map[string]string{"out.host": "db2"}},
+	}
+
+	sublayers := ComputeSublayersWithMeta(&tr, []string{"db.instance", "out.host"})
+	var s Span
+	SetSublayersOnSpan(&s, sublayers)
+
+	for k, v := range map[string]float64{
+		"_sublayers.duration.by_db.instance.sublayer_db.instance:users":  30,
+		"_sublayers.duration.by_db.instance.sublayer_db.instance:orders": 20,
+		"_sublayers.duration.by_out.host.sublayer_out.host:db1":          15,
+		"_sublayers.duration.by_out.host.sublayer_out.host:db2":          5,
+		"_sublayers.duration.by_service.sublayer_service:pg":             50,
+	} {
+		assert.Equal(v, s.Metrics[k], k)
+	}
+	// spans without the key don't start a sublayer of their own
+	assert.Equal(2+2+2+2+1, len(s.Metrics))
+
+	expected := sortableSublayers(ComputeSublayers(&tr))
+	sort.Sort(expected)
+	actual := sortableSublayers(ComputeSublayersWithMeta(&tr, nil))
+	sort.Sort(actual)
+	assert.Equal(expected, actual)
+}
+
+func TestSublayerMetaMaxValues(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := Trace{Span{SpanID: 1, Start: 0, Duration: 1000, Service: "web"}}
+	for i := 0; i < 2*MaxSublayerMetaValues; i++ {
+		tr = append(tr, Span{SpanID: uint64(i + 2), ParentID: 1, Start: int64(i * 40), Duration: int64(i + 1), Service: "web",
+			Meta: map[string]string{"out.host": fmt.Sprintf("host%d", i)}})
+	}
+
+	var s Span
+	SetSublayersOnSpan(&s, ComputeSublayersWithMeta(&tr, []string{"out.host"}))
+
+	hosts := 0
+	for k := range s.Metrics {
+		if strings.HasPrefix(k, "_sublayers.duration.by_out.host.") {
+			hosts++
+		}
+	}
+	assert.Equal(MaxSublayerMetaValues, hosts)
+	// the hosts with the most time are kept, the time of the others is folded
+	last := 2*MaxSublayerMetaValues - 1
+	assert.Equal(float64(last+1), s.Metrics[fmt.Sprintf("_sublayers.duration.by_out.host.sublayer_out.host:host%d", last)])
+	_, ok := s.Metrics["_sublayers.duration.by_out.host.sublayer_out.host:host0"]
+	assert.False(ok)
+	other := 0.0
+	for i := 0; i <= last-(MaxSublayerMetaValues-1); i++ {
+		other += float64(i + 1)
+	}
+	assert.Equal(other, s.Metrics["_sublayers.duration.by_out.host.sublayer_out.host:"+SublayerOther])
+}
@@ -0,0 +1,49 @@
+package model
+
+const (
+	// TopLevelKey is the span metric flagging top-level spans, i.e. the entry
+	// points of a service in a trace. Only those are used to compute stats.
+	TopLevelKey = "_top_level"
+
+	// MeasuredKey is the meta flag set by tracers on internal spans which
+	// should be used to compute stats even though they are not top-level
+	MeasuredKey = "_dd.measured"
+)
+
+// ComputeTopLevel flags the top-level spans of the trace: roots, and spans
+// whose parent belongs to another service or is unknown (e.g. in another part
+// of a distributed trace)
+func (t Trace) ComputeTopLevel() {
+	spanIDToIndex := make(map[uint64]int, len(t))
+	for i, s := range t {
+		spanIDToIndex[s.SpanID] = i
+	}
+
+	for i := range t {
+		if t[i].ParentID != 0 {
+			if parent, ok := spanIDToIndex[t[i].ParentID]; ok && t[parent].Service == t[i].Service {
+				continue
+			}
+		}
+		t[i].setTopLevel()
+	}
+}
+
+func (s *Span) setTopLevel() {
+	if s.Metrics == nil {
+		s.Metrics = make(map[string]float64, 1)
+	}
+	s.Metrics[TopLevelKey] = 1
+}
+
+// TopLevel tells if the span has been flagged as top-level by ComputeTopLevel
+func (s *Span) TopLevel() bool {
+	return s.Metrics[TopLevelKey] == 1
+}
+
+// Measured tells if stats should be computed for this span even though it is
+// not top-level
+func (s *Span) Measured() bool {
+	v, ok := s.Meta[MeasuredKey]
+	return ok && (v == "1" || v == "true")
+}
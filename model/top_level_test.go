@@ -0,0 +1,54 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputeTopLevel(t *testing.T) {
+	assert := assert.New(t)
+
+	trace := Trace{
+		Span{TraceID: 1, SpanID: 1, Service: "web"},
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "web"},
+		Span{TraceID: 1, SpanID: 3, ParentID: 2, Service: "db"},
+		Span{TraceID: 1, SpanID: 4, ParentID: 3, Service: "db"},
+		Span{TraceID: 1, SpanID: 5, ParentID: 1, Service: "cache", Metrics: map[string]float64{"rows": 3}},
+	}
+	trace.ComputeTopLevel()
+
+	assert.True(trace[0].TopLevel())
+	assert.False(trace[1].TopLevel())
+	assert.True(trace[2].TopLevel())
+	assert.False(trace[3].TopLevel())
+	assert.True(trace[4].TopLevel())
+	assert.Equal(3.0, trace[4].Metrics["rows"])
+
+	// non top-level spans are not flagged at all
+	_, ok := trace[1].Metrics[TopLevelKey]
+	assert.False(ok)
+}
+
+func TestComputeTopLevelPartialTrace(t *testing.T) {
+	assert := assert.New(t)
+
+	// the parent of the local root is in another part of the distributed trace
+	trace := Trace{
+		Span{TraceID: 1, SpanID: 2, ParentID: 1, Service: "web"},
+		Span{TraceID: 1, SpanID: 3, ParentID: 2, Service: "web"},
+	}
+	trace.ComputeTopLevel()
+
+	assert.True(trace[0].TopLevel())
+	assert.False(trace[1].TopLevel())
+}
+
+func TestSpanMeasured(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.False((&Span{}).Measured())
+	assert.False((&Span{Meta: map[string]string{MeasuredKey: "0"}}).Measured())
+	assert.True((&Span{Meta: map[string]string{MeasuredKey: "1"}}).Measured())
+	assert.True((&Span{Meta: map[string]string{MeasuredKey: "true"}}).Measured())
+}
@@ -0,0 +1,361 @@
+package quantile
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+/*
+Compact binary encoding of the sketches, much smaller than their JSON:
+integers are varints, the sorted values of the summaries are encoded as deltas
+from their predecessor, and the span IDs of the samples, which are random, are
+packed as fixed 8 bytes after the entries.
+
+The first byte is the kind of the sketch:
+
+	SliceSummary: kind | value mode | N | #entries | entries (v delta, g, delta, #samples) | samples
+	LogSketch:    kind | alpha | N | min | max | zero bin | #positive | bins | #negative | bins | samples
+
+with bins encoded as (key delta, n, #samples). Values are integer deltas when
+they are all integers, like the durations of spans, and deltas of their IEEE
+754 bits otherwise, so that the decoding is always exact.
+
+As the sketches implement encoding.BinaryMarshaler, gob uses this encoding too:
+the gob encoding of a SliceSummary is not the one of its fields anymore, and
+gob streams written before it can't be decoded.
+*/
+
+const (
+	binarySliceSummary byte = 1
+	binaryLogSketch    byte = 2
+
+	// value modes of the SliceSummary encoding
+	binaryIntegerValues byte = 0
+	binaryFloatValues   byte = 1
+)
+
+// maxExactInteger is the highest integer a float64 represents exactly, along
+// with all the integers below it
+const maxExactInteger = 1 << 53
+
+var errBinarySketch = errors.New("invalid binary sketch")
+
+// binaryWriter appends to a buffer the fields of a binary sketch
+type binaryWriter struct {
+	buf []byte
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (w *binaryWriter) byte(b byte) {
+	w.buf = append(w.buf, b)
+}
+
+func (w *binaryWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(w.tmp[:], v)
+	w.buf = append(w.buf, w.tmp[:n]...)
+}
+
+func (w *binaryWriter) varint(v int64) {
+	n := binary.PutVarint(w.tmp[:], v)
+	w.buf = append(w.buf, w.tmp[:n]...)
+}
+
+func (w *binaryWriter) fixed64(v uint64) {
+	binary.LittleEndian.PutUint64(w.tmp[:8], v)
+	w.buf = append(w.buf, w.tmp[:8]...)
+}
+
+// samples packs the samples after the entries or bins
+func (w *binaryWriter) samples(samples []uint64) {
+	for _, id := range samples {
+		w.fixed64(id)
+	}
+}
+
+// binaryReader reads the fields of a binary sketch, its first error making
+// all the following reads fail
+type binaryReader struct {
+	buf []byte
+	err error
+}
+
+func (r *binaryReader) byte() byte {
+	if r.err != nil || len(r.buf) < 1 {
+		r.err = errBinarySketch
+		return 0
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errBinarySketch
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = errBinarySketch
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *binaryReader) fixed64() uint64 {
+	if r.err != nil || len(r.buf) < 8 {
+		r.err = errBinarySketch
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(r.buf)
+	r.buf = r.buf[8:]
+	return v
+}
+
+// count reads a number of elements each encoded in at least size bytes,
+// checking that they fit in the buffer before they are allocated
+func (r *binaryReader) count(size int) int {
+	n := r.uvarint()
+	if r.err == nil && n > uint64(len(r.buf)/size) {
+		r.err = errBinarySketch
+		return 0
+	}
+	return int(n)
+}
+
+// samples reads the n packed samples of an entry or bin
+func (r *binaryReader) samples(n int) []uint64 {
+	if n == 0 || r.err != nil {
+		return nil
+	}
+	if n > len(r.buf)/8 {
+		r.err = errBinarySketch
+		return nil
+	}
+	samples := make([]uint64, n)
+	for i := range samples {
+		samples[i] = r.fixed64()
+	}
+	return samples
+}
+
+// integerValues tells if all the values of the entries are exactly encoded as integers
+func integerValues(entries []Entry) bool {
+	for _, e := range entries {
+		if e.V != math.Trunc(e.V) || math.Abs(e.V) > maxExactInteger {
+			return false
+		}
+	}
+	return true
+}
+
+// MarshalBinary returns the compact binary encoding of the summary
+func (s *SliceSummary) MarshalBinary() ([]byte, error) {
+	w := binaryWriter{buf: make([]byte, 0, 16+len(s.Entries)*20)}
+	w.byte(binarySliceSummary)
+
+	mode := binaryFloatValues
+	if integerValues(s.Entries) {
+		mode = binaryIntegerValues
+	}
+	w.byte(mode)
+	w.uvarint(uint64(s.N))
+	w.uvarint(uint64(len(s.Entries)))
+
+	var prevInt int64
+	var prevBits uint64
+	for _, e := range s.Entries {
+		if mode == binaryIntegerValues {
+			w.varint(int64(e.V) - prevInt)
+			prevInt = int64(e.V)
+		} else {
+			// wrapping arithmetic keeps the deltas exact whatever the signs
+			bits := math.Float64bits(e.V)
+			w.varint(int64(bits - prevBits))
+			prevBits = bits
+		}
+		w.varint(int64(e.G))
+		w.varint(int64(e.Delta))
+		w.uvarint(uint64(len(e.Samples)))
+	}
+	for _, e := range s.Entries {
+		w.samples(e.Samples)
+	}
+	return w.buf, nil
+}
+
+// UnmarshalBinary decodes a summary encoded by MarshalBinary
+func (s *SliceSummary) UnmarshalBinary(b []byte) error {
+	r := binaryReader{buf: b}
+	if kind := r.byte(); r.err == nil && kind != binarySliceSummary {
+		return fmt.Errorf("cannot decode a binary sketch of kind %d into a SliceSummary", kind)
+	}
+	mode := r.byte()
+	if r.err == nil && mode != binaryIntegerValues && mode != binaryFloatValues {
+		return errBinarySketch
+	}
+	n := int(r.uvarint())
+	// an entry takes at least 4 bytes
+	entries := make([]Entry, r.count(4))
+
+	var prevInt int64
+	var prevBits uint64
+	sampleCounts := make([]int, len(entries))
+	for i := range entries {
+		if mode == binaryIntegerValues {
+			prevInt += r.varint()
+			entries[i].V = float64(prevInt)
+		} else {
+			prevBits += uint64(r.varint())
+			entries[i].V = math.Float64frombits(prevBits)
+		}
+		entries[i].G = int(r.varint())
+		entries[i].Delta = int(r.varint())
+		sampleCounts[i] = int(r.uvarint())
+	}
+	for i := range entries {
+		entries[i].Samples = r.samples(sampleCounts[i])
+	}
+
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.buf) > 0 {
+		return errBinarySketch
+	}
+	if len(entries) == 0 {
+		entries = nil
+	}
+	s.N = n
+	s.Entries = entries
+	return nil
+}
+
+// writeBins writes the bins, their samples being packed later
+func writeBins(w *binaryWriter, bins []LogBin) {
+	w.uvarint(uint64(len(bins)))
+	prev := 0
+	for _, b := range bins {
+		w.varint(int64(b.K - prev))
+		prev = b.K
+		w.uvarint(uint64(b.N))
+		w.uvarint(uint64(len(b.Samples)))
+	}
+}
+
+// readBins reads the bins written by writeBins, and the number of samples of each of them
+func readBins(r *binaryReader) ([]LogBin, []int) {
+	// a bin takes at least 3 bytes
+	bins := make([]LogBin, r.count(3))
+	sampleCounts := make([]int, len(bins))
+	prev := 0
+	for i := range bins {
+		prev += int(r.varint())
+		bins[i].K = prev
+		bins[i].N = int(r.uvarint())
+		sampleCounts[i] = int(r.uvarint())
+	}
+	if len(bins) == 0 {
+		bins = nil
+	}
+	return bins, sampleCounts
+}
+
+// MarshalBinary returns the compact binary encoding of the sketch
+func (s *LogSketch) MarshalBinary() ([]byte, error) {
+	w := binaryWriter{buf: make([]byte, 0, 48+(len(s.Positive)+len(s.Negative))*16)}
+	w.byte(binaryLogSketch)
+	w.fixed64(math.Float64bits(s.Alpha))
+	w.uvarint(uint64(s.N))
+	w.fixed64(math.Float64bits(s.Min))
+	w.fixed64(math.Float64bits(s.Max))
+	w.uvarint(uint64(s.Zero.N))
+	w.uvarint(uint64(len(s.Zero.Samples)))
+	writeBins(&w, s.Positive)
+	writeBins(&w, s.Negative)
+
+	w.samples(s.Zero.Samples)
+	for _, b := range s.Positive {
+		w.samples(b.Samples)
+	}
+	for _, b := range s.Negative {
+		w.samples(b.Samples)
+	}
+	return w.buf, nil
+}
+
+// UnmarshalBinary decodes a sketch encoded by MarshalBinary
+func (s *LogSketch) UnmarshalBinary(b []byte) error {
+	r := binaryReader{buf: b}
+	if kind := r.byte(); r.err == nil && kind != binaryLogSketch {
+		return fmt.Errorf("cannot decode a binary sketch of kind %d into a LogSketch", kind)
+	}
+	s2 := LogSketch{
+		Alpha: math.Float64frombits(r.fixed64()),
+		N:     int(r.uvarint()),
+		Min:   math.Float64frombits(r.fixed64()),
+		Max:   math.Float64frombits(r.fixed64()),
+	}
+	s2.Zero.N = int(r.uvarint())
+	zeroSamples := int(r.uvarint())
+	var positiveSamples, negativeSamples []int
+	s2.Positive, positiveSamples = readBins(&r)
+	s2.Negative, negativeSamples = readBins(&r)
+
+	s2.Zero.Samples = r.samples(zeroSamples)
+	for i := range s2.Positive {
+		s2.Positive[i].Samples = r.samples(positiveSamples[i])
+	}
+	for i := range s2.Negative {
+		s2.Negative[i].Samples = r.samples(negativeSamples[i])
+	}
+
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.buf) > 0 {
+		return errBinarySketch
+	}
+	s2.init()
+	*s = s2
+	return nil
+}
+
+// UnmarshalSketchBinary decodes a sketch encoded by its MarshalBinary method
+func UnmarshalSketchBinary(b []byte) (Sketch, error) {
+	if len(b) == 0 {
+		return nil, errBinarySketch
+	}
+
+	var s interface {
+		Sketch
+		UnmarshalBinary([]byte) error
+	}
+	switch b[0] {
+	case binarySliceSummary:
+		s = NewSliceSummary()
+	case binaryLogSketch:
+		s = &LogSketch{}
+	default:
+		return nil, fmt.Errorf("unknown binary sketch kind %d", b[0])
+	}
+	if err := s.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,116 @@
+package quantile
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSliceSummaryBinary(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+
+	for name, gen := range map[string]func(i int) float64{
+		"constant": ConstantGenerator,
+		"uniform":  UniformGenerator,
+		"durations": func(i int) float64 {
+			return float64(r.Int63n(1e9))
+		},
+		"floats": func(i int) float64 {
+			return r.NormFloat64() * 1e3
+		},
+		"extremes": func(i int) float64 {
+			return []float64{-math.MaxFloat64, -1, 0, 1e-300, 1 << 60, math.MaxFloat64}[i%6]
+		},
+	} {
+		s := NewSliceSummary()
+		for i := 0; i < 10000; i++ {
+			s.Insert(gen(i), uint64(r.Int63())<<1)
+		}
+
+		blob, err := s.MarshalBinary()
+		assert.Nil(t, err, name)
+		decoded, err := UnmarshalSketchBinary(blob)
+		assert.Nil(t, err, name)
+		assert.Equal(t, s, decoded, name)
+
+		js, _ := json.Marshal(s)
+		assert.True(t, len(blob) < len(js)/2, "%s: %d bytes in binary, %d in JSON", name, len(blob), len(js))
+	}
+
+	// empty summaries
+	blob, err := NewSliceSummary().MarshalBinary()
+	assert.Nil(t, err)
+	decoded, err := UnmarshalSketchBinary(blob)
+	assert.Nil(t, err)
+	assert.Equal(t, NewSliceSummary(), decoded)
+}
+
+func TestLogSketchBinary(t *testing.T) {
+	assert := assert.New(t)
+	r := rand.New(rand.NewSource(42))
+
+	s := NewLogSketch(0.005)
+	for i := 0; i < 10000; i++ {
+		v := r.NormFloat64() * 1e6
+		if i%100 == 0 {
+			v = 0
+		}
+		s.Insert(v, uint64(r.Int63()))
+	}
+
+	blob, err := s.MarshalBinary()
+	assert.Nil(err)
+	decoded, err := UnmarshalSketchBinary(blob)
+	assert.Nil(err)
+	assert.Equal(s.Positive, decoded.(*LogSketch).Positive)
+	for _, q := range testQuantiles {
+		exp, expSamples := s.Quantile(q)
+		v, samples := decoded.Quantile(q)
+		assert.Equal(exp, v)
+		assert.Equal(expSamples, samples)
+	}
+
+	empty := NewLogSketch(DefaultRelativeAccuracy)
+	blob, err = empty.MarshalBinary()
+	assert.Nil(err)
+	decoded, err = UnmarshalSketchBinary(blob)
+	assert.Nil(err)
+	assert.Equal(empty, decoded)
+}
+
+func TestSketchBinaryErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	gk := NewSliceSummary()
+	ls := NewLogSketch(DefaultRelativeAccuracy)
+	for i := 0; i < 100; i++ {
+		gk.Insert(float64(i), uint64(i))
+		ls.Insert(float64(i), uint64(i))
+	}
+
+	for _, s := range []Sketch{gk, ls} {
+		blob, _ := s.MarshalBinary()
+		// truncated or extended encodings are rejected
+		for i := 0; i < len(blob); i++ {
+			_, err := UnmarshalSketchBinary(blob[:i])
+			assert.NotNil(err, "%T truncated to %d bytes", s, i)
+		}
+		_, err := UnmarshalSketchBinary(append(blob, 0))
+		assert.NotNil(err)
+	}
+
+	// sketches of the other kind are rejected
+	blob, _ := ls.MarshalBinary()
+	assert.NotNil(NewSliceSummary().UnmarshalBinary(blob))
+	blob, _ = gk.MarshalBinary()
+	assert.NotNil((&LogSketch{}).UnmarshalBinary(blob))
+
+	_, err := UnmarshalSketchBinary([]byte{42})
+	assert.NotNil(err)
+	// huge counts don't allocate
+	_, err = UnmarshalSketchBinary([]byte{binarySliceSummary, binaryIntegerValues, 1, 0xff, 0xff, 0xff, 0xff, 0x0f})
+	assert.NotNil(err)
+}
@@ -0,0 +1,292 @@
+package quantile
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// DefaultRelativeAccuracy is the relative accuracy of the values returned by
+// the quantile queries of a LogSketch, when none is given
+const DefaultRelativeAccuracy float64 = 0.01
+
+// maxLogSketchBins bounds the number of bins of each sign of a LogSketch, the
+// bins of the values closest to 0 are collapsed beyond it
+const maxLogSketchBins = 2048
+
+/*
+LogSketch is a sketch whose quantiles have a relative error on their value,
+unlike the GK summaries whose error is on their rank, which makes it precise on
+the tail of long distributions such as latencies, even after merges.
+
+"DDSketch: A Fast and Fully-Mergeable Quantile Sketch with Relative-Error
+Guarantees" (Masson, Rim, Lee 2019)
+
+http://www.vldb.org/pvldb/vol12/p2195-masson.pdf
+
+Values are counted in bins with logarithmic bounds: with
+gamma = (1+alpha)/(1-alpha), the bin of key k holds the values in
+(gamma^(k-1), gamma^k], all of them within alpha of the value returned for it.
+Negative values are counted in bins of their absolute value.
+*/
+type LogSketch struct {
+	Alpha    float64  `json:"alpha"` // relative accuracy
+	N        int      `json:"n"`
+	Min      float64  `json:"min"`
+	Max      float64  `json:"max"`
+	Zero     LogBin   `json:"zero"`     // values equal to 0
+	Positive []LogBin `json:"positive"` // sorted by key
+	Negative []LogBin `json:"negative"` // sorted by key of the absolute value
+
+	// derived from Alpha when the sketch is created or decoded, and only read
+	// afterwards so that concurrent queries don't race
+	lnGamma float64
+}
+
+// LogBin counts the values of a bin of a LogSketch
+type LogBin struct {
+	K       int      `json:"k"`
+	N       int      `json:"n"`
+	Samples []uint64 `json:"samples"` // Span ID of a trace with a value in this bin
+}
+
+// NewLogSketch returns a new sketch with relative accuracy alpha (0 < alpha < 1)
+func NewLogSketch(alpha float64) *LogSketch {
+	if alpha <= 0 || alpha >= 1 {
+		alpha = DefaultRelativeAccuracy
+	}
+	s := &LogSketch{Alpha: alpha}
+	s.init()
+	return s
+}
+
+// init derives the parameters of the sketch from its relative accuracy
+func (s *LogSketch) init() {
+	if s.Alpha <= 0 || s.Alpha >= 1 {
+		s.Alpha = DefaultRelativeAccuracy
+	}
+	s.lnGamma = math.Log((1 + s.Alpha) / (1 - s.Alpha))
+}
+
+// UnmarshalJSON decodes a sketch encoded in JSON and derives its parameters
+func (s *LogSketch) UnmarshalJSON(b []byte) error {
+	// the alias doesn't have this method, not to recurse
+	type logSketch LogSketch
+	var s2 logSketch
+	if err := json.Unmarshal(b, &s2); err != nil {
+		return err
+	}
+	*s = LogSketch(s2)
+	s.init()
+	return nil
+}
+
+// key returns the key of the bin of v > 0
+func (s *LogSketch) key(v float64) int {
+	return int(math.Ceil(math.Log(v) / s.lnGamma))
+}
+
+// value returns the value of the bin of key k, the one with the lowest
+// relative error to all the values of the bin
+func (s *LogSketch) value(k int) float64 {
+	return 2 * math.Exp(float64(k)*s.lnGamma) / (math.Exp(s.lnGamma) + 1)
+}
+
+// Insert inserts a new value v in the sketch paired with t (the ID of the span it was reported from)
+func (s *LogSketch) Insert(v float64, t uint64) {
+	b := LogBin{N: 1, Samples: []uint64{t}}
+	switch {
+	case v > 0:
+		b.K = s.key(v)
+		s.Positive = mergeLogBins(s.Positive, []LogBin{b})
+	case v < 0:
+		b.K = s.key(-v)
+		s.Negative = mergeLogBins(s.Negative, []LogBin{b})
+	default:
+		s.Zero = mergeLogBin(s.Zero, b)
+	}
+
+	if s.N == 0 || v < s.Min {
+		s.Min = v
+	}
+	if s.N == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.N++
+}
+
+// Merge merges the values of another LogSketch with the same accuracy in the sketch
+func (s *LogSketch) Merge(other Sketch) error {
+	s2, ok := other.(*LogSketch)
+	if !ok {
+		return fmt.Errorf("cannot merge a %T into a LogSketch", other)
+	}
+	if s.lnGamma != s2.lnGamma {
+		return fmt.Errorf("cannot merge LogSketches of accuracies %v and %v", s.Alpha, s2.Alpha)
+	}
+	if s2.N == 0 {
+		return nil
+	}
+
+	s.Positive = mergeLogBins(s.Positive, s2.Positive)
+	s.Negative = mergeLogBins(s.Negative, s2.Negative)
+	s.Zero = mergeLogBin(s.Zero, s2.Zero)
+
+	if s.N == 0 || s2.Min < s.Min {
+		s.Min = s2.Min
+	}
+	if s.N == 0 || s2.Max > s.Max {
+		s.Max = s2.Max
+	}
+	s.N += s2.N
+	return nil
+}
+
+// mergeLogBin adds the values of b2 to b, keeping the sample of b if any
+func mergeLogBin(b, b2 LogBin) LogBin {
+	b.N += b2.N
+	if len(b.Samples) == 0 {
+		b.Samples = b2.Samples
+	}
+	return b
+}
+
+// mergeLogBins merges the sorted bins of b2 in the sorted bins of b, and
+// collapses the lowest keys if they are too many
+func mergeLogBins(b, b2 []LogBin) []LogBin {
+	if len(b2) == 1 {
+		// fast path of inserts
+		i := sort.Search(len(b), func(i int) bool { return b[i].K >= b2[0].K })
+		if i < len(b) && b[i].K == b2[0].K {
+			b[i] = mergeLogBin(b[i], b2[0])
+			return b
+		}
+		b = append(b, LogBin{})
+		copy(b[i+1:], b[i:])
+		b[i] = b2[0]
+	} else if len(b2) > 0 {
+		merged := make([]LogBin, 0, len(b)+len(b2))
+		i, j := 0, 0
+		for i < len(b) || j < len(b2) {
+			switch {
+			case j == len(b2) || (i < len(b) && b[i].K < b2[j].K):
+				merged = append(merged, b[i])
+				i++
+			case i == len(b) || b2[j].K < b[i].K:
+				merged = append(merged, b2[j])
+				j++
+			default:
+				merged = append(merged, mergeLogBin(b[i], b2[j]))
+				i++
+				j++
+			}
+		}
+		b = merged
+	}
+
+	if extra := len(b) - maxLogSketchBins; extra > 0 {
+		collapsed := b[extra]
+		for _, lb := range b[:extra] {
+			collapsed = mergeLogBin(collapsed, lb)
+		}
+		b[extra] = collapsed
+		b = b[extra:]
+	}
+	return b
+}
+
+// clamp bounds the estimate of a value by the exact min and max of the sketch
+func (s *LogSketch) clamp(v float64) float64 {
+	return math.Max(s.Min, math.Min(s.Max, v))
+}
+
+// Quantile returns an estimate of the element at quantile 'q' (0 <= q <= 1),
+// within Alpha of the exact value
+func (s *LogSketch) Quantile(q float64) (float64, []uint64) {
+	if s.N == 0 {
+		return 0, []uint64{}
+	}
+
+	// nearest rank, starting at 0
+	rank := int(math.Ceil(q*float64(s.N))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+
+	v, samples := s.binAt(rank)
+	// the extremes are known exactly
+	switch rank {
+	case 0:
+		v = s.Min
+	case s.N - 1:
+		v = s.Max
+	}
+	return v, samples
+}
+
+// binAt returns the value and samples of the bin of the value at the given rank
+func (s *LogSketch) binAt(rank int) (float64, []uint64) {
+	// values by increasing order: negative bins from the highest key, zeros,
+	// then positive bins
+	n := 0
+	for i := len(s.Negative) - 1; i >= 0; i-- {
+		b := s.Negative[i]
+		if n += b.N; n > rank {
+			return s.clamp(-s.value(b.K)), b.Samples
+		}
+	}
+	if n += s.Zero.N; n > rank {
+		return s.clamp(0), s.Zero.Samples
+	}
+	for _, b := range s.Positive {
+		if n += b.N; n > rank {
+			return s.clamp(s.value(b.K)), b.Samples
+		}
+	}
+	// only reached if the bins don't account for N, e.g. a badly decoded sketch
+	return s.Max, []uint64{}
+}
+
+// Rank returns an estimate of the number of values lower or equal to v
+func (s *LogSketch) Rank(v float64) int {
+	if s.N == 0 || v < s.Min {
+		return 0
+	}
+	if v >= s.Max {
+		return s.N
+	}
+
+	rank := 0
+	for i := len(s.Negative) - 1; i >= 0; i-- {
+		b := s.Negative[i]
+		if s.clamp(-s.value(b.K)) > v {
+			return rank
+		}
+		rank += b.N
+	}
+	if v < 0 {
+		return rank
+	}
+	rank += s.Zero.N
+	for _, b := range s.Positive {
+		if s.clamp(s.value(b.K)) > v {
+			return rank
+		}
+		rank += b.N
+	}
+	return rank
+}
+
+// Count returns the number of values inserted in the sketch
+func (s *LogSketch) Count() int {
+	return s.N
+}
+
+// Copy allocates a new sketch with the same data
+func (s *LogSketch) Copy() Sketch {
+	s2 := *s
+	s2.Positive = append([]LogBin(nil), s.Positive...)
+	s2.Negative = append([]LogBin(nil), s.Negative...)
+	return &s2
+}
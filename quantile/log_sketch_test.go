@@ -0,0 +1,202 @@
+package quantile
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// exactQuantile returns the nearest-rank quantile of sorted values
+func exactQuantile(sorted []float64, q float64) float64 {
+	rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+func assertRelativeAccuracy(t *testing.T, s Sketch, vals []float64, alpha float64) {
+	sorted := append([]float64(nil), vals...)
+	sort.Float64s(sorted)
+
+	for _, q := range testQuantiles {
+		exp := exactQuantile(sorted, q)
+		v, _ := s.Quantile(q)
+		assert.InDelta(t, exp, v, alpha*math.Abs(exp)+1e-12, "quantile %f failed, exp: %f, val: %f", q, exp, v)
+	}
+}
+
+func TestLogSketchLongTail(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	s := NewLogSketch(DefaultRelativeAccuracy)
+
+	// latencies with a long tail, from 1µs to hours
+	vals := make([]float64, 0, 100000)
+	for i := 0; i < 100000; i++ {
+		v := 1e-6 * math.Exp(r.ExpFloat64()*3)
+		vals = append(vals, v)
+		s.Insert(v, uint64(i))
+	}
+	assertRelativeAccuracy(t, s, vals, DefaultRelativeAccuracy)
+}
+
+func TestLogSketchNegative(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	s := NewLogSketch(0.02)
+
+	vals := make([]float64, 0, 10000)
+	for i := 0; i < 10000; i++ {
+		v := r.NormFloat64() * 100
+		if i%10 == 0 {
+			v = 0
+		}
+		vals = append(vals, v)
+		s.Insert(v, uint64(i))
+	}
+	assertRelativeAccuracy(t, s, vals, 0.02)
+}
+
+func TestLogSketchMerge(t *testing.T) {
+	assert := assert.New(t)
+	r := rand.New(rand.NewSource(42))
+
+	// merges don't degrade the accuracy
+	s := NewLogSketch(DefaultRelativeAccuracy)
+	var vals []float64
+	for n := 0; n < 100; n++ {
+		s2 := NewLogSketch(DefaultRelativeAccuracy)
+		for i := 0; i < 100; i++ {
+			v := r.ExpFloat64() * float64(n+1)
+			vals = append(vals, v)
+			s2.Insert(v, uint64(n*100+i))
+		}
+		s.Merge(s2)
+	}
+	assert.Equal(10000, s.Count())
+	assertRelativeAccuracy(t, s, vals, DefaultRelativeAccuracy)
+
+	// other kinds and accuracies are not merged
+	assert.NotNil(s.Merge(NewLogSketch(0.05)))
+	assert.NotNil(s.Merge(NewSliceSummary()))
+	assert.NotNil(NewSliceSummary().Merge(s))
+	assert.Equal(10000, s.Count())
+}
+
+func TestLogSketchCopy(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewLogSketch(DefaultRelativeAccuracy)
+	s.Insert(1, 1)
+	s2 := s.Copy()
+	s2.Insert(1, 2)
+	s2.Insert(2, 3)
+
+	assert.Equal(1, s.Count())
+	assert.Equal(1, s.Positive[0].N)
+	assert.Len(s.Positive, 1)
+	assert.Equal(3, s2.Count())
+}
+
+func TestLogSketchSamples(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewLogSketch(DefaultRelativeAccuracy)
+	for i := 1; i <= 100; i++ {
+		s.Insert(float64(i), uint64(i))
+	}
+
+	v, samples := s.Quantile(0.5)
+	assert.InDelta(50, v, 0.5)
+	assert.Equal([]uint64{50}, samples)
+	_, samples = s.Quantile(1)
+	assert.Equal([]uint64{100}, samples)
+
+	// the first value of a bin keeps its sample
+	s.Insert(100.1, 1000)
+	_, samples = s.Quantile(1)
+	assert.Equal([]uint64{100}, samples)
+}
+
+func TestLogSketchRank(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewLogSketch(DefaultRelativeAccuracy)
+	for i := 1; i <= 100; i++ {
+		s.Insert(float64(i), uint64(i))
+	}
+	// values are estimated by the one of their bin
+	assert.Equal(0, s.Rank(0.5))
+	assert.InDelta(10, s.Rank(10), 1)
+	assert.InDelta(50, s.Rank(50), 1)
+	assert.InDelta(50, s.Rank(50.4), 1)
+	assert.Equal(100, s.Rank(100))
+	assert.Equal(100, s.Rank(1000))
+}
+
+func TestLogSketchMaxBins(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewLogSketch(DefaultRelativeAccuracy)
+	for i := 0; i < 2*maxLogSketchBins; i++ {
+		s.Insert(math.Pow(1.1, float64(i)), uint64(i))
+	}
+	assert.Len(s.Positive, maxLogSketchBins)
+	assert.Equal(2*maxLogSketchBins, s.Count())
+
+	// the highest values are still accurate
+	max := math.Pow(1.1, float64(2*maxLogSketchBins-1))
+	v, _ := s.Quantile(0.99)
+	assert.InDelta(max/math.Pow(1.1, 40), v, DefaultRelativeAccuracy*v)
+}
+
+func TestLogSketchEncoding(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewLogSketch(0.005)
+	for i := 0; i < 1000; i++ {
+		s.Insert(float64(i-100)*1.5, uint64(i))
+	}
+
+	js, err := json.Marshal(s)
+	assert.Nil(err)
+	fromJSON, err := UnmarshalSketchJSON(js)
+	assert.Nil(err)
+
+	var buf bytes.Buffer
+	assert.Nil(gob.NewEncoder(&buf).Encode(s))
+	fromGob := &LogSketch{}
+	assert.Nil(gob.NewDecoder(&buf).Decode(fromGob))
+
+	fromRawJSON := &LogSketch{}
+	assert.Nil(json.Unmarshal(js, fromRawJSON))
+
+	for _, decoded := range []Sketch{fromJSON, fromGob, fromRawJSON} {
+		if !assert.IsType(&LogSketch{}, decoded) {
+			continue
+		}
+		// derived when decoding, not lazily by the queries
+		assert.Equal(s.lnGamma, decoded.(*LogSketch).lnGamma)
+		assert.Equal(s.Count(), decoded.Count())
+		for _, q := range testQuantiles {
+			exp, expSamples := s.Quantile(q)
+			v, samples := decoded.Quantile(q)
+			assert.Equal(exp, v)
+			assert.Equal(expSamples, samples)
+		}
+	}
+
+	// GK summaries are decoded as such
+	gk := NewSliceSummary()
+	gk.Insert(1, 1)
+	js, err = json.Marshal(gk)
+	assert.Nil(err)
+	decoded, err := UnmarshalSketchJSON(js)
+	assert.Nil(err)
+	assert.Equal(gk, decoded)
+}
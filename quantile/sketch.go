@@ -0,0 +1,46 @@
+package quantile
+
+import "encoding/json"
+
+// Sketch is the common interface of the summaries approximating a distribution
+// of values, each value being paired with the ID of the span it was reported
+// from. Sketches can only be merged with sketches of the same kind and accuracy.
+type Sketch interface {
+	// Insert inserts a new value v paired with the span ID t
+	Insert(v float64, t uint64)
+	// Merge merges the values of s2 in the sketch, or returns an error leaving
+	// the sketch untouched if s2 is of another kind or accuracy
+	Merge(s2 Sketch) error
+	// Quantile returns an estimate of the value at quantile q (0 <= q <= 1),
+	// and the IDs of spans with about this value
+	Quantile(q float64) (float64, []uint64)
+	// Rank returns an estimate of the number of values lower or equal to v
+	Rank(v float64) int
+	// Count returns the number of values inserted in the sketch
+	Count() int
+	// Copy returns a sketch with the same data
+	Copy() Sketch
+	// MarshalBinary returns the compact binary encoding of the sketch, see
+	// UnmarshalSketchBinary
+	MarshalBinary() ([]byte, error)
+}
+
+// UnmarshalSketchJSON decodes a sketch encoded in JSON, which is a LogSketch
+// if it has a relative accuracy and a GK SliceSummary otherwise
+func UnmarshalSketchJSON(b []byte) (Sketch, error) {
+	var kind struct {
+		Alpha *float64 `json:"alpha"`
+	}
+	if err := json.Unmarshal(b, &kind); err != nil {
+		return nil, err
+	}
+
+	var s Sketch = NewSliceSummary()
+	if kind.Alpha != nil {
+		s = NewLogSketch(*kind.Alpha)
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -118,16 +118,20 @@ func (s *SliceSummary) Quantile(q float64) (float64, []uint64) {
 	return s.Entries[len(s.Entries)-1].V, s.Entries[len(s.Entries)-1].Samples
 }
 
-// Merge two summaries entries together
-func (s *SliceSummary) Merge(s2 *SliceSummary) {
+// Merge two summaries entries together, s2 has to be a SliceSummary too
+func (s *SliceSummary) Merge(other Sketch) error {
+	s2, ok := other.(*SliceSummary)
+	if !ok {
+		return fmt.Errorf("cannot merge a %T into a SliceSummary", other)
+	}
 	if s2.N == 0 {
-		return
+		return nil
 	}
 	if s.N == 0 {
 		s.N = s2.N
 		s.Entries = make([]Entry, 0, len(s2.Entries))
 		s.Entries = append(s.Entries, s2.Entries...)
-		return
+		return nil
 	}
 
 	pos := 0
@@ -156,10 +160,27 @@ func (s *SliceSummary) Merge(s2 *SliceSummary) {
 	s.N += s2.N
 
 	s.compress()
+	return nil
+}
+
+// Rank returns an estimate of the number of values lower or equal to v
+func (s *SliceSummary) Rank(v float64) int {
+	// entries are sorted by value, and the ranks of their values are
+	// estimated by summing the g of the entries
+	rank := 0
+	for i := 0; i < len(s.Entries) && s.Entries[i].V <= v; i++ {
+		rank += s.Entries[i].G
+	}
+	return rank
+}
+
+// Count returns the number of values inserted in the summary
+func (s *SliceSummary) Count() int {
+	return s.N
 }
 
 // Copy allocates a new summary with the same data
-func (s *SliceSummary) Copy() *SliceSummary {
+func (s *SliceSummary) Copy() Sketch {
 	s2 := NewSliceSummary()
 	s2.Entries = make([]Entry, len(s.Entries))
 	copy(s2.Entries, s.Entries)
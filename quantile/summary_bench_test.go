@@ -1,6 +1,8 @@
 package quantile
 
 import (
+	"bytes"
+	"encoding/gob"
 	"encoding/json"
 	"math/rand"
 	"testing"
@@ -43,6 +45,19 @@ func BenchmarkGKSliceInsertion(b *testing.B) {
 	}
 }
 
+func BenchmarkLogSketchInsertion(b *testing.B) {
+	s := NewLogSketch(DefaultRelativeAccuracy)
+
+	vals := randSlice(randlen)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for n := 0; n < b.N; n++ {
+		s.Insert(vals[n%randlen], uint64(n))
+	}
+}
+
 func BenchmarkGKSliceInsertionPreallocd(b *testing.B) {
 	s := NewSliceSummary()
 	s.Entries = make([]Entry, 0, 100)
@@ -174,3 +189,88 @@ func BenchmarkGKSliceEncoding100(b *testing.B) {
 func BenchmarkGKSliceEncoding1000(b *testing.B) {
 	BGKSliceEncoding(b, 1000)
 }
+
+// Compact binary encoding, compared to JSON and gob
+
+// durationSummary returns a summary of n span durations, integers in
+// nanoseconds, with random span IDs
+func durationSummary(n int) *SliceSummary {
+	r := rand.New(rand.NewSource(42))
+	s := NewSliceSummary()
+	for i := 0; i < n; i++ {
+		s.Insert(float64(r.Int63n(1e9)), uint64(r.Int63()))
+	}
+	return s
+}
+
+func BSliceSummaryEncode(b *testing.B, n int, encode func(s *SliceSummary) ([]byte, error)) {
+	s := durationSummary(n)
+	blob, err := encode(s)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if b.N == 1 {
+		b.Logf("%d entries encoded in %d bytes", len(s.Entries), len(blob))
+	}
+
+	b.SetBytes(int64(len(blob)))
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		encode(s)
+	}
+}
+
+func encodeJSON(s *SliceSummary) ([]byte, error) {
+	return json.Marshal(s)
+}
+
+// gobSliceSummary mirrors SliceSummary without its MarshalBinary method, which
+// gob would use instead of its own encoding
+type gobSliceSummary struct {
+	Entries []Entry
+	N       int
+}
+
+func encodeGob(s *SliceSummary) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(gobSliceSummary{Entries: s.Entries, N: s.N})
+	return buf.Bytes(), err
+}
+
+func encodeBinary(s *SliceSummary) ([]byte, error) {
+	return s.MarshalBinary()
+}
+
+func BenchmarkSliceSummaryEncodeJSON100(b *testing.B) {
+	BSliceSummaryEncode(b, 100, encodeJSON)
+}
+func BenchmarkSliceSummaryEncodeGob100(b *testing.B) {
+	BSliceSummaryEncode(b, 100, encodeGob)
+}
+func BenchmarkSliceSummaryEncodeBinary100(b *testing.B) {
+	BSliceSummaryEncode(b, 100, encodeBinary)
+}
+func BenchmarkSliceSummaryEncodeJSON10000(b *testing.B) {
+	BSliceSummaryEncode(b, 10000, encodeJSON)
+}
+func BenchmarkSliceSummaryEncodeGob10000(b *testing.B) {
+	BSliceSummaryEncode(b, 10000, encodeGob)
+}
+func BenchmarkSliceSummaryEncodeBinary10000(b *testing.B) {
+	BSliceSummaryEncode(b, 10000, encodeBinary)
+}
+
+func BenchmarkSliceSummaryDecodeBinary10000(b *testing.B) {
+	blob, _ := durationSummary(10000).MarshalBinary()
+
+	b.SetBytes(int64(len(blob)))
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		var s SliceSummary
+		s.UnmarshalBinary(blob)
+	}
+}
@@ -15,6 +15,10 @@ import (
 
 var testQuantiles = []float64{0, 0.1, 0.25, 0.5, 0.75, 0.90, 0.95, 0.99, 0.999, 0.9999, 1}
 
+// sketches sharing the accuracy tests
+func newSliceSketch() Sketch { return NewSliceSummary() }
+func newLogSketch() Sketch   { return NewLogSketch(DefaultRelativeAccuracy) }
+
 func GenSummarySkiplist(n int, gen func(i int) float64) ([]float64, []uint64) {
 	s := NewSummary()
 
@@ -33,8 +37,9 @@ func GenSummarySkiplist(n int, gen func(i int) float64) ([]float64, []uint64) {
 	return vals, samps
 }
 
-func GenSummarySlice(n int, gen func(i int) float64) ([]float64, []uint64) {
-	s := NewSliceSummary()
+// GenSketch inserts n generated values in a new sketch and returns its test quantiles
+func GenSketch(newSketch func() Sketch, n int, gen func(i int) float64) ([]float64, []uint64) {
+	s := newSketch()
 
 	for i := 0; i < n; i++ {
 		s.Insert(gen(i), uint64(i))
@@ -64,11 +69,11 @@ func SummarySkiplistConstantN(t *testing.T, n int) {
 		assert.Equal(42, v)
 	}
 }
-func SummarySliceConstantN(t *testing.T, n int) {
+func SketchConstantN(t *testing.T, newSketch func() Sketch, n int) {
 	assert := assert.New(t)
-	vals, _ := GenSummarySlice(n, ConstantGenerator)
+	vals, _ := GenSketch(newSketch, n, ConstantGenerator)
 	for _, v := range vals {
-		assert.Equal(42, v)
+		assert.Equal(42.0, v)
 	}
 }
 func TestSummarySkiplistConstant10(t *testing.T) {
@@ -87,19 +92,34 @@ func TestSummarySkiplistConstant100000(t *testing.T) {
 	SummarySkiplistConstantN(t, 100000)
 }
 func TestSummarySliceConstant10(t *testing.T) {
-	SummarySliceConstantN(t, 10)
+	SketchConstantN(t, newSliceSketch, 10)
 }
 func TestSummarySliceConstant100(t *testing.T) {
-	SummarySliceConstantN(t, 100)
+	SketchConstantN(t, newSliceSketch, 100)
 }
 func TestSummarySliceConstant1000(t *testing.T) {
-	SummarySliceConstantN(t, 1000)
+	SketchConstantN(t, newSliceSketch, 1000)
 }
 func TestSummarySliceConstant10000(t *testing.T) {
-	SummarySliceConstantN(t, 10000)
+	SketchConstantN(t, newSliceSketch, 10000)
 }
 func TestSummarySliceConstant100000(t *testing.T) {
-	SummarySliceConstantN(t, 100000)
+	SketchConstantN(t, newSliceSketch, 100000)
+}
+func TestLogSketchConstant10(t *testing.T) {
+	SketchConstantN(t, newLogSketch, 10)
+}
+func TestLogSketchConstant100(t *testing.T) {
+	SketchConstantN(t, newLogSketch, 100)
+}
+func TestLogSketchConstant1000(t *testing.T) {
+	SketchConstantN(t, newLogSketch, 1000)
+}
+func TestLogSketchConstant10000(t *testing.T) {
+	SketchConstantN(t, newLogSketch, 10000)
+}
+func TestLogSketchConstant100000(t *testing.T) {
+	SketchConstantN(t, newLogSketch, 100000)
 }
 
 /* uniform distribution
@@ -126,9 +146,9 @@ func SummarySkiplistUniformN(t *testing.T, n int) {
 		assert.InDelta(exp, v, EPSILON*float64(n), "quantile %f failed, exp: %f, val: %f", testQuantiles[i], exp, v)
 	}
 }
-func SummarySliceUniformN(t *testing.T, n int) {
+func SketchUniformN(t *testing.T, newSketch func() Sketch, n int) {
 	assert := assert.New(t)
-	vals, _ := GenSummarySlice(n, UniformGenerator)
+	vals, _ := GenSketch(newSketch, n, UniformGenerator)
 
 	for i, v := range vals {
 		var exp float64
@@ -159,19 +179,34 @@ func TestSummarySkiplistUniform100000(t *testing.T) {
 	SummarySkiplistUniformN(t, 100000)
 }
 func TestSummarySliceUniform10(t *testing.T) {
-	SummarySliceUniformN(t, 10)
+	SketchUniformN(t, newSliceSketch, 10)
 }
 func TestSummarySliceUniform100(t *testing.T) {
-	SummarySliceUniformN(t, 100)
+	SketchUniformN(t, newSliceSketch, 100)
 }
 func TestSummarySliceUniform1000(t *testing.T) {
-	SummarySliceUniformN(t, 1000)
+	SketchUniformN(t, newSliceSketch, 1000)
 }
 func TestSummarySliceUniform10000(t *testing.T) {
-	SummarySliceUniformN(t, 10000)
+	SketchUniformN(t, newSliceSketch, 10000)
 }
 func TestSummarySliceUniform100000(t *testing.T) {
-	SummarySliceUniformN(t, 100000)
+	SketchUniformN(t, newSliceSketch, 100000)
+}
+func TestLogSketchUniform10(t *testing.T) {
+	SketchUniformN(t, newLogSketch, 10)
+}
+func TestLogSketchUniform100(t *testing.T) {
+	SketchUniformN(t, newLogSketch, 100)
+}
+func TestLogSketchUniform1000(t *testing.T) {
+	SketchUniformN(t, newLogSketch, 1000)
+}
+func TestLogSketchUniform10000(t *testing.T) {
+	SketchUniformN(t, newLogSketch, 10000)
+}
+func TestLogSketchUniform100000(t *testing.T) {
+	SketchUniformN(t, newLogSketch, 100000)
 }
 
 func NewSummaryWithTestData() *Summary {
@@ -0,0 +1,132 @@
+package quantizer
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/DataDog/datadog-trace-agent/statsd"
+)
+
+// cacheEntryOverhead is a rough estimate of the memory used by a cache entry
+// besides its strings (list element, map bucket, struct fields)
+const cacheEntryOverhead = 128
+
+type cacheKey struct {
+	resource string
+	spanType string
+	dialect  Dialect
+}
+
+type cacheEntry struct {
+	key       cacheKey
+	quantized string
+	resource  string // resource of the span, e.g. the summary of a CQL batch
+	failed    bool   // the tokenizer could not process the resource
+	size      int
+}
+
+// resourceCache is a LRU cache of quantized resources, bounded by the
+// approximate memory used by its entries
+type resourceCache struct {
+	maxSize int
+	size    int
+	ll      *list.List
+	items   map[cacheKey]*list.Element
+
+	hits      int64
+	misses    int64
+	evictions int64
+
+	mu sync.Mutex
+}
+
+func newResourceCache(maxSize int) *resourceCache {
+	return &resourceCache{
+		maxSize: maxSize,
+		ll:      list.New(),
+		items:   make(map[cacheKey]*list.Element),
+	}
+}
+
+// Get returns the quantized resource cached for the given key, if any
+func (c *resourceCache) Get(key cacheKey) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.hits++
+		c.ll.MoveToFront(el)
+		return el.Value.(*cacheEntry), true
+	}
+	c.misses++
+	return nil, false
+}
+
+// Add caches the quantized query and resource for the given key, evicting the
+// least recently used entries if the cache gets too big
+func (c *resourceCache) Add(key cacheKey, quantized, resource string, failed bool) {
+	size := len(key.resource) + len(key.spanType) + len(quantized) + cacheEntryOverhead
+	if resource != quantized {
+		size += len(resource)
+	}
+	if size > c.maxSize {
+		// would evict everything else, don't bother
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.items[key]; ok {
+		return
+	}
+
+	e := &cacheEntry{key: key, quantized: quantized, resource: resource, failed: failed, size: size}
+	c.items[key] = c.ll.PushFront(e)
+	c.size += size
+
+	for c.size > c.maxSize {
+		el := c.ll.Back()
+		old := el.Value.(*cacheEntry)
+		c.ll.Remove(el)
+		delete(c.items, old.key)
+		c.size -= old.size
+		c.evictions++
+	}
+}
+
+// flushStats reports and resets the cache counters
+func (c *resourceCache) flushStats() {
+	c.mu.Lock()
+	hits, misses, evictions, size, entries := c.hits, c.misses, c.evictions, c.size, c.ll.Len()
+	c.hits, c.misses, c.evictions = 0, 0, 0
+	c.mu.Unlock()
+
+	statsd.Client.Count("trace_agent.quantizer.cache.hits", hits, nil, 1)
+	statsd.Client.Count("trace_agent.quantizer.cache.misses", misses, nil, 1)
+	statsd.Client.Count("trace_agent.quantizer.cache.evictions", evictions, nil, 1)
+	statsd.Client.Gauge("trace_agent.quantizer.cache.size", float64(size), nil, 1)
+	statsd.Client.Gauge("trace_agent.quantizer.cache.entries", float64(entries), nil, 1)
+}
+
+// sqlCache memoizes QuantizeSQL and QuantizeCQL, nil when caching is disabled
+var sqlCache *resourceCache
+
+// SetCacheMaxSize sets the memory cap, in bytes, of the cache of quantized SQL
+// resources, and empties it. A size of 0 disables caching. This is not safe to
+// call concurrently with Quantize.
+func SetCacheMaxSize(maxSize int) {
+	if maxSize <= 0 {
+		sqlCache = nil
+		return
+	}
+	sqlCache = newResourceCache(maxSize)
+}
+
+// FlushCacheStats reports the hit, miss and eviction counts of the cache of
+// quantized resources since the last call
+func FlushCacheStats() {
+	if sqlCache != nil {
+		sqlCache.flushStats()
+	}
+}
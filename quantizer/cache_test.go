@@ -0,0 +1,80 @@
+package quantizer
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+func TestResourceCacheLRU(t *testing.T) {
+	assert := assert.New(t)
+
+	key := func(i int) cacheKey {
+		return cacheKey{resource: fmt.Sprintf("SELECT %d", i), spanType: "sql"}
+	}
+	entrySize := len(key(0).resource) + len("sql") + len("SELECT ?") + cacheEntryOverhead
+
+	c := newResourceCache(3 * entrySize)
+	for i := 0; i < 3; i++ {
+		c.Add(key(i), "SELECT ?", "SELECT ?", false)
+	}
+	assert.Equal(3*entrySize, c.size)
+
+	// touch the oldest entry so that the second one is evicted next
+	e, ok := c.Get(key(0))
+	assert.True(ok)
+	assert.Equal("SELECT ?", e.quantized)
+
+	c.Add(key(3), "SELECT ?", "SELECT ?", false)
+	assert.Equal(3*entrySize, c.size)
+	assert.Equal(int64(1), c.evictions)
+
+	_, ok = c.Get(key(1))
+	assert.False(ok)
+	for _, i := range []int{0, 2, 3} {
+		_, ok = c.Get(key(i))
+		assert.True(ok)
+	}
+	assert.Equal(int64(4), c.hits)
+	assert.Equal(int64(1), c.misses)
+
+	// entries bigger than the whole cache are never stored
+	c.Add(cacheKey{resource: string(make([]byte, 3*entrySize))}, "?", "?", false)
+	assert.Equal(3, c.ll.Len())
+
+	c.flushStats()
+	assert.Equal(int64(0), c.hits)
+	assert.Equal(int64(0), c.misses)
+	assert.Equal(int64(0), c.evictions)
+}
+
+func TestQuantizeSQLCached(t *testing.T) {
+	assert := assert.New(t)
+	SetCacheMaxSize(1024 * 1024)
+	defer SetCacheMaxSize(0)
+
+	for i := 0; i < 2; i++ {
+		span := Quantize(SQLSpan("SELECT * FROM users WHERE id = 42"))
+		assert.Equal("SELECT * FROM users WHERE id = ?", span.Resource)
+		assert.Equal("SELECT * FROM users WHERE id = 42", span.Meta["sql.query"])
+
+		span = Quantize(model.Span{Resource: "SELECT * FROM users WHERE id = 42", Type: "sql"})
+		assert.Equal("SELECT * FROM users WHERE id = ?", span.Resource)
+		assert.Equal("SELECT * FROM users WHERE id = ?", span.Meta["sql.query"])
+
+		span = Quantize(SQLSpan("SELECT * FROM users WHERE id = '' AND '"))
+		assert.Equal("Non-parsable SQL query", span.Resource)
+		assert.Equal("Query not parsed", span.Meta["agent.parse.error"])
+	}
+	// both valid spans share the same cache entry
+	assert.Equal(int64(4), sqlCache.hits)
+	assert.Equal(int64(2), sqlCache.misses)
+
+	// the dialect is part of the key
+	span := Quantize(PostgresSpan("SELECT * FROM users WHERE id = 42"))
+	assert.Equal("SELECT * FROM users WHERE id = ?", span.Resource)
+	assert.Equal(int64(3), sqlCache.misses)
+}
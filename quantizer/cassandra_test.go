@@ -55,3 +55,155 @@ func TestCassQuantizer(t *testing.T) {
 		assert.Equal(testCase.expected, Quantize(CassSpan(testCase.in)).Resource)
 	}
 }
+
+func TestCassQuantizerCQL(t *testing.T) {
+	assert := assert.New(t)
+
+	queryToExpected := []struct{ in, expected string }{
+		// collection literals are replaced as a whole
+		{
+			"INSERT INTO users (id, emails, props) VALUES (1, {'a@b.c', 'd@e.f'}, {'age': 42, 'tags': [1, 2]})",
+			"INSERT INTO users ( id, emails, props ) VALUES ( ? )",
+		},
+		{
+			"UPDATE users SET emails = emails + {'x@y.z'} WHERE id = 1",
+			"UPDATE users SET emails = emails + ? WHERE id = ?",
+		},
+		{
+			"UPDATE users SET scores = [1, 2, 3] WHERE id = 1",
+			"UPDATE users SET scores = ? WHERE id = ?",
+		},
+		{
+			"UPDATE users SET addr = {street: 'Main st', zip: {code: 12345}} WHERE id = 1",
+			"UPDATE users SET addr = ? WHERE id = ?",
+		},
+		// element access is not a collection
+		{
+			"UPDATE users SET props['age'] = 43 WHERE id = 1 IF props['age'] = 42",
+			"UPDATE users SET props [ ? ] = ? WHERE id = ? IF props [ ? ] = ?",
+		},
+		// TTL, timestamps and lightweight transactions
+		{
+			"INSERT INTO users (id, name) VALUES (1, 'john') USING TTL 3600",
+			"INSERT INTO users ( id, name ) VALUES ( ? ) USING TTL ?",
+		},
+		{
+			"UPDATE users USING TTL 86400 AND TIMESTAMP 1518000000 SET name = 'john' WHERE id = 1",
+			"UPDATE users USING TTL ? AND TIMESTAMP ? SET name = ? WHERE id = ?",
+		},
+		{
+			"INSERT INTO users (id, name) VALUES (:id, :name) IF NOT EXISTS",
+			"INSERT INTO users ( id, name ) VALUES ( :id, :name ) IF NOT EXISTS",
+		},
+		{
+			"CREATE TABLE IF NOT EXISTS ks.users (id uuid PRIMARY KEY, tags set<text>)",
+			"CREATE TABLE IF NOT EXISTS ks.users ( id uuid PRIMARY KEY, tags set < text > )",
+		},
+		// token ranges, with negative bounds
+		{
+			"SELECT * FROM events WHERE token(user_id) > token(42) AND token(user_id) <= -9223372036854775808",
+			"SELECT * FROM events WHERE token ( user_id ) > token ( ? ) AND token ( user_id ) <= ?",
+		},
+		// subtractions keep their operator
+		{
+			"UPDATE counters SET x = y -1 WHERE id = -2 AND z IN (-3, 4)",
+			"UPDATE counters SET x = y - ? WHERE id = ? AND z IN ( ? )",
+		},
+		// uuid, blob and dollar-quoted literals
+		{
+			"SELECT * FROM events WHERE id = 123e4567-e89b-12d3-a456-426655440000 AND data = 0xCAFE",
+			"SELECT * FROM events WHERE id = ? AND data = ?",
+		},
+		{
+			"SELECT * FROM events WHERE id = f47ac10b-58cc-4372-a567-0e02b2c3d479",
+			"SELECT * FROM events WHERE id = ?",
+		},
+		{
+			"CREATE FUNCTION ks.twice(a int) CALLED ON NULL INPUT RETURNS int LANGUAGE java AS $$ return 2 * a; $$",
+			"CREATE FUNCTION ks.twice ( a int ) CALLED ON ? INPUT RETURNS int LANGUAGE java AS ?",
+		},
+	}
+
+	for _, testCase := range queryToExpected {
+		span := Quantize(CassSpan(testCase.in))
+		assert.Equal(testCase.expected, span.Resource, testCase.in)
+		assert.Equal(testCase.expected, span.Meta["sql.query"], testCase.in)
+	}
+}
+
+func TestCassQuantizerBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	queryToExpected := []struct{ in, expected, query string }{
+		{
+			"BEGIN BATCH INSERT INTO users (id, name) VALUES (1, 'a'); INSERT INTO users (id, name) VALUES (2, 'b'); APPLY BATCH",
+			"BEGIN BATCH INSERT INTO users; APPLY BATCH",
+			"BEGIN BATCH INSERT INTO users ( id, name ) VALUES ( ? ) INSERT INTO users ( id, name ) VALUES ( ? ) APPLY BATCH",
+		},
+		{
+			"begin unlogged batch using timestamp 1518000000\n" +
+				"  insert into users (id, name) values (1, 'a')\n" +
+				"  update users_by_name set id = 1 where name = 'a'\n" +
+				"  delete email from users_by_email where email = 'a@b.c'\n" +
+				"apply batch;",
+			"BEGIN UNLOGGED BATCH INSERT INTO users; UPDATE users_by_name; DELETE FROM users_by_email; APPLY BATCH",
+			"begin unlogged batch using timestamp ? insert into users ( id, name ) values ( ? ) update users_by_name set id = ? where name = ? delete email from users_by_email where email = ? apply batch",
+		},
+		// the resource doesn't depend on the number of statements
+		{
+			"BEGIN COUNTER BATCH UPDATE a SET c = c + 1 WHERE id = 1; UPDATE b SET c = c + 1 WHERE id = 1; " +
+				"UPDATE ks.c SET c = c + 1 WHERE id = 1; UPDATE d SET c = c + 1 WHERE id = 1; APPLY BATCH",
+			"BEGIN COUNTER BATCH UPDATE a; UPDATE b; UPDATE ks.c; ... APPLY BATCH",
+			"BEGIN COUNTER BATCH UPDATE a SET c = c + ? WHERE id = ? UPDATE b SET c = c + ? WHERE id = ? UPDATE ks.c SET c = c + ? WHERE id = ? UPDATE d SET c = c + ? WHERE id = ? APPLY BATCH",
+		},
+	}
+
+	for _, testCase := range queryToExpected {
+		span := Quantize(CassSpan(testCase.in))
+		assert.Equal(testCase.expected, span.Resource, testCase.in)
+		assert.Equal(testCase.query, span.Meta["sql.query"], testCase.in)
+	}
+
+	// unparsable batches are reported as such
+	span := Quantize(CassSpan("BEGIN BATCH INSERT INTO users (id) VALUES ('a); APPLY BATCH"))
+	assert.Equal("Non-parsable SQL query", span.Resource)
+}
+
+func TestCassQuantizerBatchCached(t *testing.T) {
+	assert := assert.New(t)
+	SetCacheMaxSize(1024 * 1024)
+	defer SetCacheMaxSize(0)
+
+	query := "BEGIN BATCH INSERT INTO users (id) VALUES (1); UPDATE emails SET a = 1 WHERE id = 1; APPLY BATCH"
+	for i := 0; i < 2; i++ {
+		span := Quantize(CassSpan(query))
+		assert.Equal("BEGIN BATCH INSERT INTO users; UPDATE emails; APPLY BATCH", span.Resource)
+		assert.Equal("BEGIN BATCH INSERT INTO users ( id ) VALUES ( ? ) UPDATE emails SET a = ? WHERE id = ? APPLY BATCH", span.Meta["sql.query"])
+	}
+	assert.Equal(int64(1), sqlCache.hits)
+	assert.Equal(int64(1), sqlCache.misses)
+}
+
+func TestCQLUUIDAhead(t *testing.T) {
+	assert := assert.New(t)
+
+	for in, expected := range map[string]bool{
+		"123e4567-e89b-12d3-a456-426655440000":       true,
+		"123e4567-e89b-12d3-a456-426655440000 AND x": true,
+		"123e4567-e89b-12d3-a456-426655440000abc":    false,
+		"123e4567-e89b-12d3-a456-42665544000":        false,
+		"1234 AND x":                                 false,
+	} {
+		tkn := NewStringTokenizer(in)
+		tkn.SetDialect(CQLDialect)
+		tkn.next()
+		assert.Equal(expected, tkn.isUUIDAhead(), in)
+		// the input isn't consumed
+		assert.Equal(len(in)-1, tkn.InStream.Len(), in)
+	}
+
+	tkn := NewStringTokenizer("123e4567-e89b-12d3-a456-426655440000")
+	tkn.SetDialect(CQLDialect)
+	tkn.next()
+	assert.Equal(0.0, testing.AllocsPerRun(100, func() { tkn.isUUIDAhead() }))
+}
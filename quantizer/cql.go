@@ -0,0 +1,167 @@
+package quantizer
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// maxCQLBatchStatements is the number of distinct statements kept in the
+// resource of a batch, others being summarized with "..."
+const maxCQLBatchStatements = 3
+
+func init() {
+	RegisterQuantizer(cassandraType, QuantizeCQL)
+}
+
+// CollectionFilter implements the TokenFilter interface so that CQL collection
+// literals, e.g. {'a': 1, 'b': 2} or [1, 2, 3], are replaced by a single '?'
+// whatever their content, nested collections included. Element access like
+// m['key'] is not a collection and is left to the other filters.
+type CollectionFilter struct {
+	depth int
+}
+
+// Filter the given token so that a whole collection literal is replaced by
+// its opening token
+func (f *CollectionFilter) Filter(token, lastToken int, buffer []byte) (int, []byte) {
+	if f.depth == 0 {
+		if token == '{' || (token == '[' && lastToken != ID) {
+			f.depth++
+			return Filtered, []byte("?")
+		}
+		return token, buffer
+	}
+
+	switch token {
+	case '{', '[':
+		f.depth++
+	case '}', ']':
+		f.depth--
+	}
+	return Filtered, nil
+}
+
+// Reset in a CollectionFilter restores the collection depth
+func (f *CollectionFilter) Reset() {
+	f.depth = 0
+}
+
+// token consumer that quantizes CQL strings; on top of the SQL filters,
+// collection literals are collapsed
+var cqlQuantizer = NewTokenConsumer(
+	[]TokenFilter{
+		&DiscardFilter{},
+		&ReplaceFilter{},
+		&CollectionFilter{},
+		&GroupingFilter{},
+	})
+
+// QuantizeCQL generates resource and sql.query meta for Cassandra spans. Batches
+// are summarized by the statements they contain, e.g.
+// `BEGIN BATCH INSERT INTO users; UPDATE emails; APPLY BATCH`
+func QuantizeCQL(span model.Span) model.Span {
+	if span.Resource == "" {
+		return span
+	}
+
+	quantizedString, resource, err := processQuery(cqlQuantizer, span, CQLDialect, summarizeCQLBatch)
+	return setQuantizedQuery(span, quantizedString, resource, err)
+}
+
+// summarizeCQLBatch returns the resource of the given CQL query if it is a batch,
+// made of its distinct statements with their table, in order of appearance
+func summarizeCQLBatch(query string) (string, bool) {
+	tkn := NewStringTokenizer(query)
+	tkn.SetDialect(CQLDialect)
+
+	// scan returns the next meaningful token, with identifiers uppercased
+	scan := func() (int, string) {
+		for {
+			token, buff := tkn.Scan()
+			switch token {
+			case Comment:
+				continue
+			case ID:
+				return token, strings.ToUpper(string(buff))
+			}
+			return token, string(buff)
+		}
+	}
+
+	// table returns the table name following the current token
+	table := func() string {
+		if token, buff := tkn.Scan(); token == ID {
+			return string(buff)
+		}
+		return "?"
+	}
+
+	if token, word := scan(); token != ID || word != "BEGIN" {
+		return "", false
+	}
+
+	var resource bytes.Buffer
+	resource.WriteString("BEGIN")
+	for {
+		token, word := scan()
+		if token != ID {
+			return "", false
+		}
+		resource.WriteString(" " + word)
+		if word == "BATCH" {
+			break
+		}
+	}
+
+	var statements []string
+	seen := make(map[string]bool)
+	parens := 0
+	truncated := false
+	for token, word := scan(); token != EOFChar && token != LexError; token, word = scan() {
+		switch token {
+		case '(':
+			parens++
+		case ')':
+			parens--
+		}
+		if token != ID || parens > 0 {
+			continue
+		}
+
+		var statement string
+		switch word {
+		case "INSERT":
+			if token, word = scan(); word == "INTO" {
+				statement = "INSERT INTO " + table()
+			}
+		case "UPDATE":
+			statement = "UPDATE " + table()
+		case "DELETE":
+			// skip the deleted columns, if any
+			for token != EOFChar && token != LexError && word != "FROM" {
+				token, word = scan()
+			}
+			statement = "DELETE FROM " + table()
+		}
+		if statement == "" || seen[statement] {
+			continue
+		}
+		seen[statement] = true
+		if len(statements) == maxCQLBatchStatements {
+			truncated = true
+			break
+		}
+		statements = append(statements, statement)
+	}
+
+	for _, s := range statements {
+		resource.WriteString(" " + s + ";")
+	}
+	if truncated {
+		resource.WriteString(" ...")
+	}
+	resource.WriteString(" APPLY BATCH")
+	return resource.String(), true
+}
@@ -0,0 +1,52 @@
+package quantizer
+
+import (
+	"strings"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// Dialect is the SQL flavor the Tokenizer should understand on top of the
+// generic SQL syntax
+type Dialect int
+
+// list of supported dialects
+const (
+	GenericDialect Dialect = iota
+	PostgresDialect
+	MySQLDialect
+	MSSQLDialect
+	OracleDialect
+	CQLDialect // Cassandra Query Language
+)
+
+const (
+	sqlDialectTag = "sql.dialect"
+	dbTypeTag     = "db.type"
+)
+
+// dialectNames maps the values tracers report to the matching dialect
+var dialectNames = map[string]Dialect{
+	"postgres":   PostgresDialect,
+	"postgresql": PostgresDialect,
+	"pg":         PostgresDialect,
+	"mysql":      MySQLDialect,
+	"mariadb":    MySQLDialect,
+	"mssql":      MSSQLDialect,
+	"sqlserver":  MSSQLDialect,
+	"sql server": MSSQLDialect,
+	"oracle":     OracleDialect,
+}
+
+// DialectFromSpan returns the SQL dialect hinted by the span meta, the explicit
+// `sql.dialect` taking precedence over `db.type`. It defaults to GenericDialect.
+func DialectFromSpan(span model.Span) Dialect {
+	for _, key := range []string{sqlDialectTag, dbTypeTag} {
+		if v, ok := span.Meta[key]; ok {
+			if d, ok := dialectNames[strings.ToLower(strings.TrimSpace(v))]; ok {
+				return d
+			}
+		}
+	}
+	return GenericDialect
+}
@@ -0,0 +1,396 @@
+package quantizer
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+const (
+	graphqlType = "graphql"
+
+	graphqlQueryTag         = "graphql.query"
+	graphqlFieldsTag        = "graphql.fields"
+	graphqlOperationNameTag = "graphql.operation.name"
+)
+
+var errGraphQLNoOperation = errors.New("no operation found in the GraphQL document")
+
+// graphqlFields tells if the top-level fields selected by the operation
+// should be recorded in the span meta
+var graphqlFields bool
+
+func init() {
+	RegisterQuantizer(graphqlType, QuantizeGraphQL)
+}
+
+// SetGraphQLFields enables or disables recording the top-level selected fields
+// of GraphQL operations in the span meta. It is not safe to call concurrently
+// with Quantize.
+func SetGraphQLFields(enabled bool) {
+	graphqlFields = enabled
+}
+
+type graphqlTokenKind int
+
+const (
+	graphqlPunctuator graphqlTokenKind = iota
+	graphqlName
+	graphqlVariable
+	graphqlLiteral // string, block string, int or float
+)
+
+type graphqlToken struct {
+	kind  graphqlTokenKind
+	value string
+}
+
+func (t graphqlToken) is(punct string) bool {
+	return t.kind == graphqlPunctuator && t.value == punct
+}
+
+// tokenizeGraphQL splits a GraphQL document into tokens, dropping comments
+// and white space, literal values being replaced by `?`
+func tokenizeGraphQL(doc string) ([]graphqlToken, error) {
+	tokens, err := scanGraphQL(doc)
+	if err != nil {
+		return nil, err
+	}
+	obfuscateGraphQLNameValues(tokens)
+	return tokens, nil
+}
+
+// scanGraphQL splits a GraphQL document into tokens, replacing string and
+// number literals by `?`
+func scanGraphQL(doc string) ([]graphqlToken, error) {
+	var tokens []graphqlToken
+	for i := 0; i < len(doc); {
+		c := doc[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(doc) && doc[i] != '\n' && doc[i] != '\r' {
+				i++
+			}
+		case strings.HasPrefix(doc[i:], "..."):
+			tokens = append(tokens, graphqlToken{graphqlPunctuator, "..."})
+			i += 3
+		case strings.IndexByte("!&():=@[]{|},", c) != -1:
+			tokens = append(tokens, graphqlToken{graphqlPunctuator, string(c)})
+			i++
+		case c == '$':
+			j := scanGraphQLName(doc, i+1)
+			if j == i+1 {
+				return nil, errors.New("invalid GraphQL variable")
+			}
+			tokens = append(tokens, graphqlToken{graphqlVariable, doc[i:j]})
+			i = j
+		case isGraphQLNameStart(c):
+			j := scanGraphQLName(doc, i)
+			tokens = append(tokens, graphqlToken{graphqlName, doc[i:j]})
+			i = j
+		case c == '-' || isDigit(uint16(c)):
+			j := i + 1
+			for j < len(doc) && (isDigit(uint16(doc[j])) || strings.IndexByte(".eE+-", doc[j]) != -1) {
+				j++
+			}
+			tokens = append(tokens, graphqlToken{graphqlLiteral, "?"})
+			i = j
+		case strings.HasPrefix(doc[i:], `"""`):
+			j := strings.Index(doc[i+3:], `"""`)
+			for j != -1 && doc[i+3+j-1] == '\\' {
+				// escaped triple quote, keep looking
+				k := strings.Index(doc[i+3+j+3:], `"""`)
+				if k == -1 {
+					j = -1
+					break
+				}
+				j += 3 + k
+			}
+			if j == -1 {
+				return nil, errors.New("unterminated GraphQL block string")
+			}
+			tokens = append(tokens, graphqlToken{graphqlLiteral, "?"})
+			i += 3 + j + 3
+		case c == '"':
+			j := i + 1
+			for ; j < len(doc) && doc[j] != '"'; j++ {
+				if doc[j] == '\\' {
+					j++
+				} else if doc[j] == '\n' {
+					break
+				}
+			}
+			if j >= len(doc) || doc[j] != '"' {
+				return nil, errors.New("unterminated GraphQL string")
+			}
+			tokens = append(tokens, graphqlToken{graphqlLiteral, "?"})
+			i = j + 1
+		default:
+			return nil, errors.New("unexpected character in GraphQL document")
+		}
+	}
+	return tokens, nil
+}
+
+// obfuscateGraphQLNameValues replaces by `?` the values written as names:
+// booleans, null and enum values. They are found in the arguments of fields
+// and directives and in the default values of variables, after a `:` or `=`
+// or in a list.
+func obfuscateGraphQLNameValues(tokens []graphqlToken) {
+	type frame struct {
+		punct   string
+		vardefs bool // parentheses of variable definitions
+	}
+	var stack []frame
+	inDefault := false // default value of a variable
+
+	for i := range tokens {
+		t := tokens[i]
+		parens := -1
+		for j := len(stack) - 1; j >= 0; j-- {
+			if stack[j].punct == "(" {
+				parens = j
+				break
+			}
+		}
+
+		switch {
+		case t.is("("):
+			// variable definitions follow an operation, outside of any
+			// selection set, unlike the arguments of directives
+			vardefs := len(stack) == 0 && i > 0 && tokens[i-1].kind == graphqlName && (i < 2 || !tokens[i-2].is("@"))
+			stack = append(stack, frame{punct: "(", vardefs: vardefs})
+		case t.is("[") || t.is("{"):
+			stack = append(stack, frame{punct: t.value})
+		case t.is(")") || t.is("]") || t.is("}"):
+			if len(stack) > 0 {
+				if stack[len(stack)-1].punct == "(" {
+					inDefault = false
+				}
+				stack = stack[:len(stack)-1]
+			}
+		case parens == -1:
+			// selection sets
+		case t.is("="):
+			inDefault = true
+		case t.kind == graphqlVariable && parens == len(stack)-1:
+			inDefault = false
+		case t.kind == graphqlName:
+			if stack[parens].vardefs && !inDefault {
+				// types of the variables
+				continue
+			}
+			prev := tokens[i-1]
+			if prev.is(":") || prev.is("=") || stack[len(stack)-1].punct == "[" {
+				tokens[i] = graphqlToken{graphqlLiteral, "?"}
+			}
+		}
+	}
+}
+
+func isGraphQLNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// scanGraphQLName returns the index following the name starting at i
+func scanGraphQLName(doc string, i int) int {
+	for i < len(doc) && (isGraphQLNameStart(doc[i]) || isDigit(uint16(doc[i]))) {
+		i++
+	}
+	return i
+}
+
+// printGraphQL writes back the tokens as a compact, single-line document
+func printGraphQL(tokens []graphqlToken) string {
+	var buf bytes.Buffer
+	for i, t := range tokens {
+		if i > 0 && needsSpaceBefore(tokens[i-1], t) {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(t.value)
+	}
+	return buf.String()
+}
+
+func needsSpaceBefore(prev, t graphqlToken) bool {
+	if t.kind == graphqlPunctuator {
+		switch t.value {
+		case ")", "]", ":", ",", "!":
+			return false
+		case "(":
+			// arguments of a field or directive, variable definitions
+			return prev.kind != graphqlName
+		}
+	}
+	if prev.kind == graphqlPunctuator {
+		switch prev.value {
+		case "(", "[", "@", "...":
+			return false
+		}
+	}
+	return true
+}
+
+// graphqlOperation is an operation definition of a GraphQL document
+type graphqlOperation struct {
+	typ    string
+	name   string
+	fields []string // top-level selected fields
+}
+
+// parseGraphQLOperations returns the operations defined in the document, skipping fragments
+func parseGraphQLOperations(tokens []graphqlToken) ([]graphqlOperation, error) {
+	var ops []graphqlOperation
+	var op *graphqlOperation // operation whose selection set is being read, nil for fragments
+	depth, parens := 0, 0
+
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		switch {
+		case parens > 0 && (t.is("{") || t.is("}")):
+			// object value of an argument or a variable default value
+		case t.is("{"):
+			if depth == 0 && op == nil && (i == 0 || !isFragmentSelection(tokens[:i])) {
+				// query shorthand
+				ops = append(ops, graphqlOperation{typ: "query"})
+				op = &ops[len(ops)-1]
+			}
+			depth++
+		case t.is("}"):
+			depth--
+			if depth < 0 {
+				return nil, errors.New("unbalanced braces in GraphQL document")
+			}
+			if depth == 0 {
+				op = nil
+			}
+		case t.is("("):
+			parens++
+		case t.is(")"):
+			parens--
+		case depth == 0 && parens == 0 && t.kind == graphqlName:
+			switch t.value {
+			case "query", "mutation", "subscription":
+				ops = append(ops, graphqlOperation{typ: t.value})
+				op = &ops[len(ops)-1]
+				if i+1 < len(tokens) && tokens[i+1].kind == graphqlName {
+					op.name = tokens[i+1].value
+					i++
+				}
+			case "fragment":
+				op = nil
+			}
+		case depth == 1 && parens == 0 && op != nil && t.kind == graphqlName:
+			if i > 0 && (tokens[i-1].is("@") || tokens[i-1].is("...") || tokens[i-1].is(":") || tokens[i-1].value == "on") {
+				// directive, fragment spread or type condition, alias target already handled
+				continue
+			}
+			field := t.value
+			if i+2 < len(tokens) && tokens[i+1].is(":") && tokens[i+2].kind == graphqlName {
+				// aliased field, keep the actual field name
+				field = tokens[i+2].value
+				i += 2
+			}
+			op.fields = append(op.fields, field)
+		}
+	}
+
+	if depth != 0 || parens != 0 {
+		return nil, errors.New("unbalanced GraphQL document")
+	}
+	if len(ops) == 0 {
+		return nil, errGraphQLNoOperation
+	}
+	return ops, nil
+}
+
+// isFragmentSelection tells if the selection set opening after the given
+// tokens belongs to a fragment definition
+func isFragmentSelection(tokens []graphqlToken) bool {
+	for i := len(tokens) - 1; i >= 0; i-- {
+		if tokens[i].is("}") {
+			return false
+		}
+		if tokens[i].kind == graphqlName && tokens[i].value == "fragment" {
+			return true
+		}
+	}
+	return false
+}
+
+// QuantizeGraphQL generates a stable resource for GraphQL spans made of the
+// operation type and name, e.g. `query GetUser`, and keeps the document with
+// its literal values obfuscated in the span meta
+func QuantizeGraphQL(span model.Span) model.Span {
+	if span.Resource == "" {
+		return span
+	}
+
+	if span.Meta == nil {
+		span.Meta = make(map[string]string)
+	}
+
+	// a document set by the tracer is obfuscated too, or dropped in favor of the
+	// one of the resource if it can't be
+	if query, ok := span.Meta[graphqlQueryTag]; ok {
+		if tokens, err := tokenizeGraphQL(query); err == nil {
+			span.Meta[graphqlQueryTag] = printGraphQL(tokens)
+		} else {
+			delete(span.Meta, graphqlQueryTag)
+		}
+	}
+
+	tokens, err := tokenizeGraphQL(span.Resource)
+	var ops []graphqlOperation
+	if err == nil {
+		ops, err = parseGraphQLOperations(tokens)
+	}
+	if err != nil {
+		log.Debugf("Error parsing the GraphQL query: `%s`: %v", span.Resource, err)
+		span.Resource = "Non-parsable GraphQL query"
+		span.Meta[sqlQuantizeError] = "Query not parsed"
+		return span
+	}
+
+	// with several operations in the document, the executed one is given by name
+	op := ops[0]
+	if name := span.Meta[graphqlOperationNameTag]; name != "" {
+		for _, o := range ops {
+			if o.name == name {
+				op = o
+				break
+			}
+		}
+	}
+
+	if _, ok := span.Meta[graphqlQueryTag]; !ok {
+		span.Meta[graphqlQueryTag] = printGraphQL(tokens)
+	}
+
+	if graphqlFields && len(op.fields) > 0 {
+		// sorted and deduplicated so that the selection order doesn't matter
+		fields := append([]string(nil), op.fields...)
+		sort.Strings(fields)
+		n := 0
+		for i, f := range fields {
+			if i == 0 || f != fields[n-1] {
+				fields[n] = f
+				n++
+			}
+		}
+		span.Meta[graphqlFieldsTag] = strings.Join(fields[:n], ",")
+	}
+
+	span.Resource = op.typ
+	if op.name != "" {
+		span.Resource += " " + op.name
+	}
+	return span
+}
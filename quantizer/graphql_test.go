@@ -0,0 +1,160 @@
+package quantizer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+func GraphQLSpan(query string) model.Span {
+	return model.Span{
+		Resource: query,
+		Type:     "graphql",
+	}
+}
+
+func TestGraphQLQuantizer(t *testing.T) {
+	assert := assert.New(t)
+
+	queryToExpected := []struct{ in, resource, query string }{
+		{
+			`query GetUser { user(id: 42) { name } }`,
+			"query GetUser",
+			"query GetUser { user(id: ?) { name } }",
+		},
+		// literals of any kind are obfuscated, variables are kept
+		{
+			`query GetUser($id: ID!, $full: Boolean = false) {
+				user(id: $id, email: "john@example.com", score: -1.5e3) {
+					name
+					posts(first: 10, tags: ["a", "b"], filter: {after: "2018-01-01"}) @include(if: $full) { title }
+				}
+			}`,
+			"query GetUser",
+			`query GetUser($id: ID!, $full: Boolean = ?) { user(id: $id, email: ?, score: ?) { name posts(first: ?, tags: [?, ?], filter: { after: ? }) @include(if: $full) { title } } }`,
+		},
+		// booleans, null and enum values too, but not the types of variables
+		{
+			`query Feed($sort: [Order!] = [DESC], $n: Int) @cached(ttl: LONG) {
+				feed(order: ASC, archived: false, tags: [NEWS, SPORT], filter: {kind: VIDEO, owner: null}, first: $n) @skip(if: true) { id }
+			}`,
+			"query Feed",
+			`query Feed($sort: [Order!] = [?], $n: Int) @cached(ttl: ?) { feed(order: ?, archived: ?, tags: [?, ?], filter: { kind: ?, owner: ? }, first: $n) @skip(if: ?) { id } }`,
+		},
+		{
+			`mutation CreateUser($input: UserInput = {name: "john"}) { createUser(input: $input, note: """multi
+			line "quoted" \""" note""") { id } }`,
+			"mutation CreateUser",
+			`mutation CreateUser($input: UserInput = { name: ? }) { createUser(input: $input, note: ?) { id } }`,
+		},
+		// comments are dropped
+		{
+			"subscription OnComment # secret\n{ comment(postId: 7) { body } }",
+			"subscription OnComment",
+			"subscription OnComment { comment(postId: ?) { body } }",
+		},
+		// anonymous operations
+		{
+			`{ user(id: "abc") { name } }`,
+			"query",
+			"{ user(id: ?) { name } }",
+		},
+		{
+			`mutation { logout }`,
+			"mutation",
+			"mutation { logout }",
+		},
+		// fragments are not operations
+		{
+			`fragment UserFields on User { name } query GetUser { user(id: 1) { ...UserFields } }`,
+			"query GetUser",
+			"fragment UserFields on User { name } query GetUser { user(id: ?) { ...UserFields } }",
+		},
+	}
+
+	for _, testCase := range queryToExpected {
+		span := Quantize(GraphQLSpan(testCase.in))
+		assert.Equal(testCase.resource, span.Resource, testCase.in)
+		assert.Equal(testCase.query, span.Meta["graphql.query"], testCase.in)
+	}
+}
+
+func TestGraphQLQuantizerOperationName(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `query A { a } query B { b }`
+
+	span := Quantize(GraphQLSpan(doc))
+	assert.Equal("query A", span.Resource)
+
+	span = GraphQLSpan(doc)
+	span.Meta = map[string]string{"graphql.operation.name": "B"}
+	span = Quantize(span)
+	assert.Equal("query B", span.Resource)
+}
+
+func TestGraphQLQuantizerQueryTag(t *testing.T) {
+	assert := assert.New(t)
+
+	// a document set by the tracer is obfuscated too
+	span := GraphQLSpan(`query GetUser { user(id: 42) { name } }`)
+	span.Meta = map[string]string{"graphql.query": `query GetUser { user(id: 42, active: true) { name } }`}
+	span = Quantize(span)
+	assert.Equal("query GetUser", span.Resource)
+	assert.Equal("query GetUser { user(id: ?, active: ?) { name } }", span.Meta["graphql.query"])
+
+	// and replaced by the one of the resource if it can't be parsed
+	span = GraphQLSpan(`query GetUser { user(id: 42) { name } }`)
+	span.Meta = map[string]string{"graphql.query": `query GetUser { user(email: "john@example.com) }`}
+	span = Quantize(span)
+	assert.Equal("query GetUser { user(id: ?) { name } }", span.Meta["graphql.query"])
+}
+
+func TestGraphQLQuantizerFields(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `query Dashboard($id: ID!) {
+		viewer { name }
+		me: user(id: $id) { name }
+		notifications(first: 5) @skip(if: false) { id }
+		...on Query { hidden }
+		...Extra
+		user(id: 1) { email }
+	}`
+
+	span := Quantize(GraphQLSpan(doc))
+	_, ok := span.Meta["graphql.fields"]
+	assert.False(ok)
+
+	SetGraphQLFields(true)
+	defer SetGraphQLFields(false)
+
+	span = Quantize(GraphQLSpan(doc))
+	assert.Equal("query Dashboard", span.Resource)
+	// sorted and deduplicated, aliases are resolved
+	assert.Equal("notifications,user,viewer", span.Meta["graphql.fields"])
+
+	// the selection order doesn't change the outcome
+	span = Quantize(GraphQLSpan(`query Dashboard { viewer { name } user(id: 2) { email } notifications { id } }`))
+	assert.Equal("notifications,user,viewer", span.Meta["graphql.fields"])
+}
+
+func TestGraphQLQuantizerErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, doc := range []string{
+		`query GetUser { user(id: "42) { name } }`,
+		`query GetUser { user(id: 42) { name }`,
+		`query GetUser { user(id: 42 { name } }`,
+		`fragment F on User { name }`,
+		`query GetUser { user(id: 42) ~ }`,
+	} {
+		span := Quantize(GraphQLSpan(doc))
+		assert.Equal("Non-parsable GraphQL query", span.Resource, doc)
+		assert.Equal("Query not parsed", span.Meta["agent.parse.error"], doc)
+		_, ok := span.Meta["graphql.query"]
+		assert.False(ok, doc)
+	}
+}
@@ -21,28 +21,25 @@ var nonUniformSpacesRegexp = regexp.MustCompile("\\s+")
 // QuantizeFunction is a function which will return an updated span with a quantized resource
 type QuantizeFunction func(model.Span) model.Span
 
-var spanTypeToQuantizer = map[string]QuantizeFunction{
-	sqlType:       QuantizeSQL,
-	redisType:     QuantizeRedis,
-	cassandraType: QuantizeSQL,
+// spanTypeToQuantizer is the registry of quantizers, indexed by the span type
+// they handle. Built-in quantizers register themselves in their own file.
+var spanTypeToQuantizer = map[string]QuantizeFunction{}
+
+// RegisterQuantizer sets fn as the quantizer for spans of the given type,
+// replacing any quantizer previously registered for that type. It is not safe
+// to call concurrently with Quantize, so registering should happen at startup.
+func RegisterQuantizer(spanType string, fn QuantizeFunction) {
+	spanTypeToQuantizer[spanType] = fn
 }
 
-// Quantize generates meaningul resource for a span, depending on its type
+// Quantize generates meaningul resource for a span, depending on its type,
+// then applies the configured rewrite rules
 func Quantize(span model.Span) model.Span {
-	switch span.Type {
-	case sqlType:
-		//sql
-		return QuantizeSQL(span)
-	case cassandraType:
-		// sql
-		return QuantizeSQL(span)
-	case redisType:
-		// redis
-		return QuantizeRedis(span)
-	default:
-		return span
+	if quantize, ok := spanTypeToQuantizer[span.Type]; ok {
+		span = quantize(span)
 	}
 
+	return rewriteResource(span)
 }
 
 // compactAllSpaces transforms any sequence of space-like characters (including line breaks) into a single standard space
@@ -1,6 +1,7 @@
 package quantizer
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -69,3 +70,51 @@ func BenchmarkCompactAllSpacesWithoutRegexp(b *testing.B) {
 		compactAllSpacesWithoutRegexp("SELECT org_id,metric_key \n		FROM metrics_metadata \n		WHERE org_id = %(org_id)s 	AND 	metric_key = ANY(array[21, 25, 32])")
 	}
 }
+
+// Quantization of SQL resources, with and without the cache
+
+var benchQueries = []string{
+	"SELECT org_id, metric_key FROM metrics_metadata WHERE org_id = %(org_id)s AND metric_key = ANY(array[21, 25, 32])",
+	"SELECT DISTINCT host.id AS host_id FROM host JOIN host_alias ON host_alias.host_id = host.id WHERE host.org_id = %(org_id_1)s AND host.name NOT IN (%(name_1)s)",
+	"UPDATE user_dash_pref SET json_prefs = %(json_prefs)s, modified = '2015-08-27 22:10:32.492912' WHERE user_id = %(user_id)s AND url = %(url)s",
+	"INSERT INTO pages (id, name) VALUES (%(id0)s, %(name0)s), (%(id1)s, %(name1)s)",
+}
+
+func benchmarkQuantizeSQL(b *testing.B, cacheSize int) {
+	SetCacheMaxSize(cacheSize)
+	defer SetCacheMaxSize(0)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for n := 0; n < b.N; n++ {
+		QuantizeSQL(SQLSpan(benchQueries[n%len(benchQueries)]))
+	}
+}
+
+func BenchmarkQuantizeSQLNoCache(b *testing.B) {
+	benchmarkQuantizeSQL(b, 0)
+}
+
+func BenchmarkQuantizeSQLCache(b *testing.B) {
+	benchmarkQuantizeSQL(b, 1024*1024)
+}
+
+// BenchmarkQuantizeSQLCacheThrashing measures the worst case, where every
+// lookup misses
+func BenchmarkQuantizeSQLCacheThrashing(b *testing.B) {
+	SetCacheMaxSize(1024)
+	defer SetCacheMaxSize(0)
+
+	queries := make([]string, 1000)
+	for i := range queries {
+		queries[i] = fmt.Sprintf("SELECT * FROM users_%d WHERE id = %d", i, i)
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for n := 0; n < b.N; n++ {
+		QuantizeSQL(SQLSpan(queries[n%len(queries)]))
+	}
+}
@@ -17,6 +17,10 @@ const maxRedisNbCommands = 3
 var redisCompoundCommandSet = map[string]bool{
 	"CLIENT": true, "CLUSTER": true, "COMMAND": true, "CONFIG": true, "DEBUG": true, "SCRIPT": true}
 
+func init() {
+	RegisterQuantizer(redisType, QuantizeRedis)
+}
+
 // QuantizeRedis generates resource for Redis spans
 func QuantizeRedis(span model.Span) model.Span {
 	query := compactWhitespaces(span.Resource)
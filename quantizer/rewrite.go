@@ -0,0 +1,63 @@
+package quantizer
+
+import (
+	"regexp"
+
+	log "github.com/cihub/seelog"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+// rewriteRule is the compiled version of a config.ResourceRewriteRule
+type rewriteRule struct {
+	service     string
+	name        string
+	typ         string
+	re          *regexp.Regexp
+	replacement string
+}
+
+// matches tells if the rule should be applied to the given span, empty
+// criteria match any span
+func (r *rewriteRule) matches(span *model.Span) bool {
+	return (r.service == "" || r.service == span.Service) &&
+		(r.name == "" || r.name == span.Name) &&
+		(r.typ == "" || r.typ == span.Type)
+}
+
+// rewriteRules are the user-defined resource rewrite rules, in evaluation order
+var rewriteRules []rewriteRule
+
+// SetRewriteRules replaces the resource rewrite rules applied by Quantize.
+// Rules with an invalid pattern are skipped. As for RegisterQuantizer, this
+// is not safe to call concurrently with Quantize.
+func SetRewriteRules(rules []config.ResourceRewriteRule) {
+	compiled := make([]rewriteRule, 0, len(rules))
+	for _, r := range rules {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			log.Errorf("invalid pattern for resource rewrite rule %s, skipping it: %v", r.Name, err)
+			continue
+		}
+
+		compiled = append(compiled, rewriteRule{
+			service:     r.Service,
+			name:        r.SpanName,
+			typ:         r.Type,
+			re:          re,
+			replacement: r.Replacement,
+		})
+	}
+	rewriteRules = compiled
+}
+
+// rewriteResource applies in order every matching rewrite rule to the span resource
+func rewriteResource(span model.Span) model.Span {
+	for i := range rewriteRules {
+		if rewriteRules[i].matches(&span) {
+			span.Resource = rewriteRules[i].re.ReplaceAllString(span.Resource, rewriteRules[i].replacement)
+		}
+	}
+	return span
+}
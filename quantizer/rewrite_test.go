@@ -0,0 +1,60 @@
+package quantizer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/config"
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+func TestRewriteRules(t *testing.T) {
+	assert := assert.New(t)
+	defer SetRewriteRules(nil)
+
+	SetRewriteRules([]config.ResourceRewriteRule{
+		{Name: "user_ids", Service: "web", Pattern: `/users/[0-9]+`, Replacement: "/users/?"},
+		{Name: "invalid", Pattern: `(`},
+		{Name: "versions", SpanName: "http.request", Pattern: `^/v[0-9]+/`, Replacement: "/"},
+		{Name: "sql_tables", Type: "sql", Pattern: `events_[0-9]{8}`, Replacement: "events_?"},
+	})
+
+	testCases := []struct {
+		span     model.Span
+		expected string
+	}{
+		{model.Span{Service: "web", Name: "http.request", Resource: "GET /v2/users/42/posts"}, "GET /v2/users/?/posts"},
+		{model.Span{Service: "api", Name: "http.request", Resource: "/v2/users/42"}, "/users/42"},
+		// rules are evaluated in order and all matching ones are applied
+		{model.Span{Service: "web", Name: "http.request", Resource: "/v1/users/42"}, "/users/?"},
+		{model.Span{Service: "web", Name: "rack.request", Resource: "/v1/users/42"}, "/v1/users/?"},
+		// rewrite applies after the type quantizer
+		{model.Span{Service: "db", Type: "sql", Resource: "SELECT * FROM events_20170102 WHERE id = 42"}, "SELECT * FROM events_? WHERE id = ?"},
+		{model.Span{Service: "db", Type: "redis", Resource: "GET events_20170102"}, "GET"},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(tc.expected, Quantize(tc.span).Resource)
+	}
+}
+
+func TestRegisterQuantizer(t *testing.T) {
+	assert := assert.New(t)
+	defer delete(spanTypeToQuantizer, "custom")
+
+	span := model.Span{Type: "custom", Resource: "some resource"}
+	assert.Equal("some resource", Quantize(span).Resource)
+
+	RegisterQuantizer("custom", func(s model.Span) model.Span {
+		s.Resource = "quantized"
+		return s
+	})
+	assert.Equal("quantized", Quantize(span).Resource)
+
+	// built-in quantizers are registered
+	for _, typ := range []string{sqlType, redisType, cassandraType} {
+		_, ok := spanTypeToQuantizer[typ]
+		assert.True(ok, "no quantizer registered for %s", typ)
+	}
+}
@@ -13,6 +13,12 @@ const (
 	sqlQuantizeError = "agent.parse.error"
 )
 
+var errTokenizer = errors.New("the tokenizer was unable to process the string")
+
+func init() {
+	RegisterQuantizer(sqlType, QuantizeSQL)
+}
+
 // TokenFilter is a generic interface that a TokenConsumer expects. It defines
 // the Filter() function used to filter or replace given tokens.
 // A filter can be stateful and keep an internal state to apply the filter later;
@@ -127,8 +133,15 @@ type TokenConsumer struct {
 // function is generic and the behavior changes according to chosen TokenFilter implementations.
 // The process calls all filters inside the []TokenFilter.
 func (t *TokenConsumer) Process(in string) (string, error) {
+	return t.ProcessWithDialect(in, GenericDialect)
+}
+
+// ProcessWithDialect is the same as Process, but it tokenizes the string according to the given
+// SQL dialect.
+func (t *TokenConsumer) ProcessWithDialect(in string, d Dialect) (string, error) {
 	out := &bytes.Buffer{}
 	t.tokenizer.InStream.Reset(in)
+	t.tokenizer.SetDialect(d)
 
 	token, buff := t.tokenizer.Scan()
 	for ; token != EOFChar; token, buff = t.tokenizer.Scan() {
@@ -137,7 +150,7 @@ func (t *TokenConsumer) Process(in string) (string, error) {
 			// the tokenizer is unable  to process the SQL  string, so the output will be
 			// surely wrong. In this case we return an error and an empty string.
 			t.Reset()
-			return "", errors.New("the tokenizer was unable to process the string")
+			return "", errTokenizer
 		}
 
 		// apply all registered filters
@@ -148,8 +161,8 @@ func (t *TokenConsumer) Process(in string) (string, error) {
 		// write the resulting buffer
 		if buff != nil {
 			// ensure that whitespaces properly separate
-			// received tokens
-			if out.Len() != 0 && token != ',' {
+			// received tokens, casts stick to their operands
+			if out.Len() != 0 && token != ',' && token != ColonCast && t.lastToken != ColonCast {
 				out.WriteRune(' ')
 			}
 
@@ -190,14 +203,56 @@ var tokenQuantizer = NewTokenConsumer(
 		&GroupingFilter{},
 	})
 
+// processQuery quantizes the resource of the given query span with tq, using
+// the cache when enabled. It returns the quantized query, and the resource of
+// the span: a summary of the query if summarize, when given, returns one, the
+// quantized query otherwise.
+func processQuery(tq *TokenConsumer, span model.Span, dialect Dialect, summarize func(string) (string, bool)) (string, string, error) {
+	if sqlCache == nil {
+		return quantizeQuery(tq, span.Resource, dialect, summarize)
+	}
+
+	key := cacheKey{resource: span.Resource, spanType: span.Type, dialect: dialect}
+	if e, ok := sqlCache.Get(key); ok {
+		if e.failed {
+			return "", "", errTokenizer
+		}
+		return e.quantized, e.resource, nil
+	}
+
+	quantized, resource, err := quantizeQuery(tq, span.Resource, dialect, summarize)
+	sqlCache.Add(key, quantized, resource, err != nil)
+	return quantized, resource, err
+}
+
+// quantizeQuery quantizes the query with tq, and summarizes it if possible,
+// see processQuery
+func quantizeQuery(tq *TokenConsumer, query string, dialect Dialect, summarize func(string) (string, bool)) (string, string, error) {
+	quantized, err := tq.ProcessWithDialect(query, dialect)
+	if err != nil {
+		return "", "", err
+	}
+	if summarize != nil {
+		if summary, ok := summarize(query); ok {
+			return quantized, summary, nil
+		}
+	}
+	return quantized, quantized, nil
+}
+
 // QuantizeSQL generates resource and sql.query meta for SQL spans
 func QuantizeSQL(span model.Span) model.Span {
 	if span.Resource == "" {
 		return span
 	}
 
-	quantizedString, err := tokenQuantizer.Process(span.Resource)
+	quantizedString, resource, err := processQuery(tokenQuantizer, span, DialectFromSpan(span), nil)
+	return setQuantizedQuery(span, quantizedString, resource, err)
+}
 
+// setQuantizedQuery sets the resource and sql.query meta of a query span from
+// the outcome of its quantization
+func setQuantizedQuery(span model.Span, quantizedString, resource string, err error) model.Span {
 	if err != nil {
 		// if we have an error, the partially parsed SQL is discarded so that we don't pollute
 		// users resources. Here we provide more details to debug the problem.
@@ -212,7 +267,7 @@ func QuantizeSQL(span model.Span) model.Span {
 		return span
 	}
 
-	span.Resource = quantizedString
+	span.Resource = resource
 
 	// set the sql.query tag if and only if it's not already set by users. If a users set
 	// this value, we send that value AS IS to the backend. If the value is not set, we
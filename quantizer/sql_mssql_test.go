@@ -0,0 +1,65 @@
+package quantizer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+func MSSQLSpan(query string) model.Span {
+	return model.Span{
+		Resource: query,
+		Type:     "sql",
+		Meta: map[string]string{
+			"db.type": "mssql",
+		},
+	}
+}
+
+func TestMSSQLQuantizer(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []sqlTestCase{
+		// bracketed identifiers
+		{
+			"SELECT [Order ID], [Unit Price] FROM [Order Details] WHERE [Customer] = 'foo'",
+			"SELECT [Order ID], [Unit Price] FROM [Order Details] WHERE [Customer] = ?",
+		},
+		{
+			"SELECT [dbo].[Order Details].[Unit Price] FROM [dbo].[Order Details]",
+			"SELECT [dbo].[Order Details].[Unit Price] FROM [dbo].[Order Details]",
+		},
+		{
+			"SELECT * FROM dbo.[Order Details] JOIN [dbo].orders ON 1 = 1",
+			"SELECT * FROM dbo.[Order Details] JOIN [dbo].orders ON ? = ?",
+		},
+		{
+			"SELECT [a]]b] FROM t",
+			"SELECT [a]]b] FROM t",
+		},
+		// unicode strings and variables
+		{
+			"SELECT TOP 10 * FROM users WHERE name = N'José' AND id = @id",
+			"SELECT TOP ? * FROM users WHERE name = ? AND id = @id",
+		},
+		{
+			"SELECT * INTO #tmp FROM users WHERE id IN (1, 2, 3)",
+			"SELECT * INTO #tmp FROM users WHERE id IN ( ? )",
+		},
+	}
+
+	for _, c := range cases {
+		s := Quantize(MSSQLSpan(c.query))
+		assert.Equal(c.expected, s.Resource, "query: %s", c.query)
+		assert.Equal("", s.Meta[sqlQuantizeError], "query: %s", c.query)
+	}
+}
+
+func TestMSSQLQuantizerErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	s := Quantize(MSSQLSpan("SELECT [never closed FROM users"))
+	assert.Equal("Non-parsable SQL query", s.Resource)
+}
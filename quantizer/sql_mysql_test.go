@@ -0,0 +1,71 @@
+package quantizer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+func MySQLSpan(query string) model.Span {
+	return model.Span{
+		Resource: query,
+		Type:     "sql",
+		Meta: map[string]string{
+			"db.type": "mysql",
+		},
+	}
+}
+
+func TestMySQLQuantizer(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []sqlTestCase{
+		// backtick identifiers can contain anything
+		{
+			"SELECT `user id`, `weird``name` FROM `my-db`.`users` WHERE id = 42",
+			"SELECT user id, weird`name FROM my-db . users WHERE id = ?",
+		},
+		// double-quoted strings
+		{
+			`SELECT * FROM users WHERE name = "john smith" AND city = 'Paris'`,
+			"SELECT * FROM users WHERE name = ? AND city = ?",
+		},
+		{
+			`SELECT * FROM users WHERE name = "it\"s"`,
+			"SELECT * FROM users WHERE name = ?",
+		},
+		// hash comments
+		{
+			"SELECT * FROM users # find users\nWHERE id = 1",
+			"SELECT * FROM users WHERE id = ?",
+		},
+		{
+			"SELECT * FROM t WHERE a = 'it\\'s' AND b = 0x1F",
+			"SELECT * FROM t WHERE a = ? AND b = ?",
+		},
+		{
+			"INSERT INTO `orders` (`id`, `total`) VALUES (1, 9.99), (2, 19.99)",
+			"INSERT INTO orders ( id, total ) VALUES ( ? )",
+		},
+	}
+
+	for _, c := range cases {
+		s := Quantize(MySQLSpan(c.query))
+		assert.Equal(c.expected, s.Resource, "query: %s", c.query)
+		assert.Equal("", s.Meta[sqlQuantizeError], "query: %s", c.query)
+	}
+}
+
+func TestMySQLQuantizerErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, query := range []string{
+		"SELECT `never closed FROM users",
+		`SELECT * FROM users WHERE name = "never closed`,
+	} {
+		s := Quantize(MySQLSpan(query))
+		assert.Equal("Non-parsable SQL query", s.Resource, "query: %s", query)
+	}
+}
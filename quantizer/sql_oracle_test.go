@@ -0,0 +1,67 @@
+package quantizer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+func OracleSpan(query string) model.Span {
+	return model.Span{
+		Resource: query,
+		Type:     "sql",
+		Meta: map[string]string{
+			"db.type": "oracle",
+		},
+	}
+}
+
+func TestOracleQuantizer(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []sqlTestCase{
+		// alternative quoting
+		{
+			"SELECT * FROM users WHERE name = q'[it's]'",
+			"SELECT * FROM users WHERE name = ?",
+		},
+		{
+			"SELECT * FROM users WHERE a = Q'{x}' AND b = q'(y)' AND c = q'<z>' AND d = nq'!w!'",
+			"SELECT * FROM users WHERE a = ? AND b = ? AND c = ? AND d = ?",
+		},
+		{
+			"SELECT * FROM users WHERE name = q'[contains ] and ' alone]'",
+			"SELECT * FROM users WHERE name = ?",
+		},
+		// bind variables
+		{
+			"SELECT * FROM users WHERE id = :1 AND name = :name",
+			"SELECT * FROM users WHERE id = :1 AND name = :name",
+		},
+		// q as a regular identifier
+		{
+			"SELECT q FROM dual WHERE q = 'x'",
+			"SELECT q FROM dual WHERE q = ?",
+		},
+	}
+
+	for _, c := range cases {
+		s := Quantize(OracleSpan(c.query))
+		assert.Equal(c.expected, s.Resource, "query: %s", c.query)
+		assert.Equal("", s.Meta[sqlQuantizeError], "query: %s", c.query)
+	}
+}
+
+func TestOracleQuantizerErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, query := range []string{
+		"SELECT q'[never closed FROM dual",
+		"SELECT q' x' FROM dual",
+	} {
+		s := Quantize(OracleSpan(query))
+		assert.Equal("Non-parsable SQL query", s.Resource, "query: %s", query)
+	}
+}
@@ -0,0 +1,109 @@
+package quantizer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DataDog/datadog-trace-agent/model"
+)
+
+func PostgresSpan(query string) model.Span {
+	return model.Span{
+		Resource: query,
+		Type:     "sql",
+		Meta: map[string]string{
+			"db.type": "postgres",
+		},
+	}
+}
+
+func TestPostgresQuantizer(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []sqlTestCase{
+		// dollar-quoted strings
+		{
+			"SELECT $$hello 'world'$$ FROM users WHERE id = $1",
+			"SELECT ? FROM users WHERE id = ?",
+		},
+		{
+			"UPDATE functions SET body = $body$ BEGIN RETURN 'it''s'; END $body$ WHERE name = $1",
+			"UPDATE functions SET body = ? WHERE name = ?",
+		},
+		{
+			"SELECT * FROM notes WHERE text = $a$nested $b$ tags$b$ end$a$",
+			"SELECT * FROM notes WHERE text = ?",
+		},
+		// casts
+		{
+			"SELECT created_at::date FROM events WHERE id = '42'::int",
+			"SELECT created_at::date FROM events WHERE id = ?::int",
+		},
+		{
+			"SELECT * FROM events WHERE tags = ARRAY[1, 2, 3]::int[]",
+			"SELECT * FROM events WHERE tags = ARRAY [ ? ]::int [ ]",
+		},
+		// JSON operators
+		{
+			"SELECT data->>'name' FROM users WHERE data->'address'->>'city' = 'Paris'",
+			"SELECT data ->> ? FROM users WHERE data -> ? ->> ? = ?",
+		},
+		{
+			"SELECT data#>'{a,b}' FROM docs WHERE data#>>'{a}' = 'x'",
+			"SELECT data #> ? FROM docs WHERE data #>> ? = ?",
+		},
+		{
+			`SELECT * FROM docs WHERE data @> '{"a":1}' AND tags <@ ARRAY['x']`,
+			"SELECT * FROM docs WHERE data @> ? AND tags <@ ARRAY [ ? ]",
+		},
+		{
+			"SELECT * FROM docs WHERE data ?| array['a', 'b'] AND data ?& array['c']",
+			"SELECT * FROM docs WHERE data ?| array [ ? ] AND data ?& array [ ? ]",
+		},
+		{
+			"SELECT * FROM users WHERE name !~* 'admin' AND email !~ '@example'",
+			"SELECT * FROM users WHERE name !~* ? AND email !~ ?",
+		},
+		// arrays
+		{
+			"SELECT * FROM users WHERE id = ANY(ARRAY[1,2,3])",
+			"SELECT * FROM users WHERE id = ANY ( ARRAY [ ? ] )",
+		},
+	}
+
+	for _, c := range cases {
+		s := Quantize(PostgresSpan(c.query))
+		assert.Equal(c.expected, s.Resource, "query: %s", c.query)
+		assert.Equal("", s.Meta[sqlQuantizeError], "query: %s", c.query)
+	}
+}
+
+func TestPostgresQuantizerErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, query := range []string{
+		"SELECT $$never closed",
+		"SELECT $tag$mismatched$other$",
+		"SELECT $ta-g$x$ta-g$",
+	} {
+		s := Quantize(PostgresSpan(query))
+		assert.Equal("Non-parsable SQL query", s.Resource, "query: %s", query)
+	}
+}
+
+func TestDialectFromSpan(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(GenericDialect, DialectFromSpan(model.Span{}))
+	assert.Equal(GenericDialect, DialectFromSpan(model.Span{Meta: map[string]string{"db.type": "sqlite"}}))
+	assert.Equal(PostgresDialect, DialectFromSpan(model.Span{Meta: map[string]string{"db.type": "PostgreSQL"}}))
+	assert.Equal(MSSQLDialect, DialectFromSpan(model.Span{Meta: map[string]string{"db.type": "sqlserver"}}))
+	// sql.dialect takes precedence
+	assert.Equal(MySQLDialect, DialectFromSpan(model.Span{Meta: map[string]string{"db.type": "postgres", "sql.dialect": "mysql"}}))
+	assert.Equal(OracleDialect, DialectFromSpan(model.Span{Meta: map[string]string{"db.type": "oracle", "sql.dialect": "unknown"}}))
+
+	// dollar quotes are not understood without the dialect hint
+	s := Quantize(SQLSpan("SELECT $$hello$$"))
+	assert.Equal("Non-parsable SQL query", s.Resource)
+}
@@ -2,6 +2,7 @@ package quantizer
 
 import (
 	"bytes"
+	"io"
 	"strings"
 )
 
@@ -36,14 +37,18 @@ const (
 	GE                = 57362
 	NE                = 57363
 	Filtered          = 57364
+	ColonCast         = 57365
+	Operator          = 57366 // dialect-specific operators, e.g. Postgres ->>
 )
 
 // Tokenizer is the struct used to generate SQL
 // tokens for the parser.
 type Tokenizer struct {
-	InStream *strings.Reader
-	Position int
-	lastChar uint16
+	InStream  *strings.Reader
+	Position  int
+	lastChar  uint16
+	lastToken int // last token scanned, comments excluded
+	dialect   Dialect
 }
 
 // NewStringTokenizer creates a new Tokenizer for the
@@ -52,11 +57,28 @@ func NewStringTokenizer(sql string) *Tokenizer {
 	return &Tokenizer{InStream: strings.NewReader(sql)}
 }
 
-// Reset the underlying buffer and positions
+// SetDialect sets the SQL dialect used to tokenize the following strings
+func (tkn *Tokenizer) SetDialect(d Dialect) {
+	tkn.dialect = d
+}
+
+// Reset the underlying buffer, positions and dialect
 func (tkn *Tokenizer) Reset() {
 	tkn.InStream.Reset("")
 	tkn.Position = 0
 	tkn.lastChar = 0
+	tkn.lastToken = 0
+	tkn.dialect = GenericDialect
+}
+
+// operandAhead tells if the next token is an operand, which is the case at
+// the start, and after an operator, an opening bracket or a separator
+func (tkn *Tokenizer) operandAhead() bool {
+	switch tkn.lastToken {
+	case 0, '(', '[', '{', ',', ':', '=', '<', '>', '+', '-', '*', '/', '%', LE, GE, NE, NullSafeEqual, Operator:
+		return true
+	}
+	return false
 }
 
 // keywords used to recognize string tokens
@@ -74,12 +96,28 @@ var keywords = map[string]int{
 // for each Scan(). An improvement to reduce the overhead of
 // the Scan() is to return slices instead of buffers.
 func (tkn *Tokenizer) Scan() (int, []byte) {
+	token, buff := tkn.scan()
+	if token != Comment {
+		tkn.lastToken = token
+	}
+	return token, buff
+}
+
+func (tkn *Tokenizer) scan() (int, []byte) {
 	if tkn.lastChar == 0 {
 		tkn.next()
 	}
 	tkn.skipBlank()
 
 	switch ch := tkn.lastChar; {
+	case ch == '#' && tkn.dialect == MySQLDialect:
+		tkn.next()
+		return tkn.scanCommentType1("#")
+	case (ch == '#' || ch == '@') && tkn.dialect == PostgresDialect:
+		tkn.next()
+		return tkn.scanPostgresOperator(ch)
+	case tkn.dialect == CQLDialect && digitVal(ch) < 16 && tkn.isUUIDAhead():
+		return tkn.scanUUID()
 	case isLetter(ch):
 		return tkn.scanIdentifier()
 	case isDigit(ch):
@@ -91,7 +129,20 @@ func (tkn *Tokenizer) Scan() (int, []byte) {
 		switch ch {
 		case EOFChar:
 			return EOFChar, nil
-		case '=', ',', ';', '(', ')', '+', '*', '&', '|', '^', '~', '[', ']', '?':
+		case '[':
+			if tkn.dialect == MSSQLDialect {
+				return tkn.scanBracketIdentifier()
+			}
+			return int(ch), []byte{byte(ch)}
+		case '?':
+			// JSONB key existence operators
+			if tkn.dialect == PostgresDialect && (tkn.lastChar == '|' || tkn.lastChar == '&') {
+				op := []byte{byte(ch), byte(tkn.lastChar)}
+				tkn.next()
+				return Operator, op
+			}
+			return int(ch), []byte{byte(ch)}
+		case '=', ',', ';', '(', ')', '+', '*', '&', '|', '^', '~', ']':
 			return int(ch), []byte{byte(ch)}
 		case '.':
 			if isDigit(tkn.lastChar) {
@@ -114,8 +165,30 @@ func (tkn *Tokenizer) Scan() (int, []byte) {
 				tkn.next()
 				return tkn.scanCommentType1("--")
 			}
+			// fold the sign of negative CQL literals, e.g. token(id) > -42, into the
+			// number so that they are replaced by a single ? like positive ones and
+			// give the same resource. Only in operand position: in a -1 it's a
+			// subtraction, which keeps its operator.
+			if tkn.dialect == CQLDialect && isDigit(tkn.lastChar) && tkn.operandAhead() {
+				token, buff := tkn.scanNumber(false)
+				return token, append([]byte{'-'}, buff...)
+			}
+			// JSON field access operators -> and ->>
+			if tkn.dialect == PostgresDialect && tkn.lastChar == '>' {
+				tkn.next()
+				if tkn.lastChar == '>' {
+					tkn.next()
+					return Operator, []byte("->>")
+				}
+				return Operator, []byte("->")
+			}
 			return int(ch), []byte{byte(ch)}
 		case '<':
+			// "is contained by" operator
+			if tkn.dialect == PostgresDialect && tkn.lastChar == '@' {
+				tkn.next()
+				return Operator, []byte("<@")
+			}
 			switch tkn.lastChar {
 			case '>':
 				tkn.next()
@@ -143,12 +216,28 @@ func (tkn *Tokenizer) Scan() (int, []byte) {
 				tkn.next()
 				return NE, []byte("!=")
 			}
+			// regular expression operators !~ and !~*
+			if tkn.dialect == PostgresDialect && tkn.lastChar == '~' {
+				tkn.next()
+				if tkn.lastChar == '*' {
+					tkn.next()
+					return Operator, []byte("!~*")
+				}
+				return Operator, []byte("!~")
+			}
 			return LexError, []byte("!")
 		case '\'':
 			return tkn.scanString(ch, String)
 		case '`':
+			if tkn.dialect == MySQLDialect {
+				return tkn.scanDelimited('`', ID)
+			}
 			return tkn.scanLiteralIdentifier('`')
 		case '"':
+			if tkn.dialect == MySQLDialect {
+				// double-quoted literals are strings in MySQL (unless ANSI_QUOTES is set)
+				return tkn.scanString(ch, String)
+			}
 			return tkn.scanLiteralIdentifier('"')
 		case '%':
 			if tkn.lastChar == '(' {
@@ -156,9 +245,22 @@ func (tkn *Tokenizer) Scan() (int, []byte) {
 			}
 			return tkn.scanFormatParameter('%')
 		case '$':
+			if tkn.dialect == PostgresDialect && (tkn.lastChar == '$' || isLetter(tkn.lastChar)) ||
+				tkn.dialect == CQLDialect && tkn.lastChar == '$' {
+				return tkn.scanDollarQuotedString()
+			}
 			return tkn.scanPreparedStatement('$')
 		case '{':
+			if tkn.dialect == CQLDialect {
+				// map, set or user-defined type literal
+				return int(ch), []byte{byte(ch)}
+			}
 			return tkn.scanEscapeSequence('{')
+		case '}':
+			if tkn.dialect == CQLDialect {
+				return int(ch), []byte{byte(ch)}
+			}
+			return LexError, []byte{byte(ch)}
 		default:
 			return LexError, []byte{byte(ch)}
 		}
@@ -178,11 +280,30 @@ func (tkn *Tokenizer) scanIdentifier() (int, []byte) {
 	buffer.WriteByte(byte(tkn.lastChar))
 	tkn.next()
 
-	for isLetter(tkn.lastChar) || isDigit(tkn.lastChar) || tkn.lastChar == '.' || tkn.lastChar == '*' {
+	for tkn.isIdentifierPart(tkn.lastChar) {
 		buffer.WriteByte(byte(tkn.lastChar))
 		tkn.next()
 	}
 	upper := bytes.ToUpper(buffer.Bytes())
+	switch tkn.dialect {
+	case OracleDialect:
+		if tkn.lastChar == '\'' && (string(upper) == "Q" || string(upper) == "NQ") {
+			return tkn.scanOracleQuotedString()
+		}
+	case MSSQLDialect:
+		// unicode strings, e.g. N'foo'
+		if tkn.lastChar == '\'' && string(upper) == "N" {
+			tkn.next()
+			return tkn.scanString('\'', String)
+		}
+		// qualified names, e.g. dbo.[Order Details]
+		if tkn.lastChar == '[' && bytes.HasSuffix(buffer.Bytes(), []byte(".")) {
+			tkn.next()
+			token, buff := tkn.scanBracketIdentifier()
+			buffer.Write(buff)
+			return token, buffer.Bytes()
+		}
+	}
 	if keywordID, found := keywords[string(upper)]; found {
 		return keywordID, upper
 	}
@@ -290,11 +411,21 @@ func (tkn *Tokenizer) scanBindVar() (int, []byte) {
 	token := ValueArg
 	tkn.next()
 	if tkn.lastChar == ':' {
+		if tkn.dialect == PostgresDialect {
+			// type cast, e.g. '2017-01-01'::date
+			tkn.next()
+			return ColonCast, []byte("::")
+		}
 		token = ListArg
 		buffer.WriteByte(byte(tkn.lastChar))
 		tkn.next()
 	}
-	if !isLetter(tkn.lastChar) {
+	// key-value separator of CQL map literals, e.g. {'a': 1}
+	if tkn.dialect == CQLDialect && token == ValueArg && !isLetter(tkn.lastChar) {
+		return int(':'), []byte{':'}
+	}
+	// Oracle also allows positional bind variables, e.g. :1
+	if !isLetter(tkn.lastChar) && !(tkn.dialect == OracleDialect && isDigit(tkn.lastChar)) {
 		return LexError, buffer.Bytes()
 	}
 	for isLetter(tkn.lastChar) || isDigit(tkn.lastChar) || tkn.lastChar == '.' {
@@ -394,6 +525,186 @@ func (tkn *Tokenizer) scanString(delim uint16, typ int) (int, []byte) {
 	return typ, buffer.Bytes()
 }
 
+// scanPostgresOperator scans the Postgres operators starting with the already
+// consumed '#' or '@' character, e.g. #>>, @> or @@
+func (tkn *Tokenizer) scanPostgresOperator(first uint16) (int, []byte) {
+	buffer := &bytes.Buffer{}
+	buffer.WriteByte(byte(first))
+
+	switch {
+	case first == '#' && tkn.lastChar == '>':
+		tkn.consumeNext(buffer)
+		if tkn.lastChar == '>' {
+			tkn.consumeNext(buffer)
+		}
+		return Operator, buffer.Bytes()
+	case first == '#' && tkn.lastChar == '-':
+		tkn.consumeNext(buffer)
+		return Operator, buffer.Bytes()
+	case first == '@' && (tkn.lastChar == '>' || tkn.lastChar == '@'):
+		tkn.consumeNext(buffer)
+		return Operator, buffer.Bytes()
+	default:
+		// plain operator, e.g. bitwise XOR or absolute value
+		return int(first), buffer.Bytes()
+	}
+}
+
+// scanDollarQuotedString scans Postgres dollar-quoted strings like $$text$$ or
+// $tag$text$tag$, the first '$' being already consumed
+func (tkn *Tokenizer) scanDollarQuotedString() (int, []byte) {
+	delim := &bytes.Buffer{}
+	delim.WriteByte('$')
+	for tkn.lastChar != '$' {
+		if !isLetter(tkn.lastChar) && !isDigit(tkn.lastChar) {
+			return LexError, delim.Bytes()
+		}
+		tkn.consumeNext(delim)
+	}
+	tkn.consumeNext(delim)
+
+	buffer := &bytes.Buffer{}
+	for {
+		if tkn.lastChar == EOFChar {
+			return LexError, buffer.Bytes()
+		}
+		tkn.consumeNext(buffer)
+		if bytes.HasSuffix(buffer.Bytes(), delim.Bytes()) {
+			return String, buffer.Bytes()[:buffer.Len()-delim.Len()]
+		}
+	}
+}
+
+// isUUIDAhead tells if the string starting at the current character is a
+// UUID literal, e.g. 123e4567-e89b-12d3-a456-426655440000, without consuming it
+func (tkn *Tokenizer) isUUIDAhead() bool {
+	const uuidLen = 36
+	if !isUUIDChar(0, tkn.lastChar) {
+		return false
+	}
+	// read the input in place, stopping at the first mismatch, then rewind
+	offset := tkn.InStream.Size() - int64(tkn.InStream.Len())
+	uuid := true
+	for i := 1; i < uuidLen && uuid; i++ {
+		c, err := tkn.InStream.ReadByte()
+		uuid = err == nil && isUUIDChar(i, uint16(c))
+	}
+	// make sure the literal isn't the prefix of a longer identifier
+	if c, err := tkn.InStream.ReadByte(); uuid && err == nil && tkn.isIdentifierPart(uint16(c)) {
+		uuid = false
+	}
+	tkn.InStream.Seek(offset, io.SeekStart)
+	return uuid
+}
+
+// isUUIDChar tells if c can be the i-th character of a UUID literal
+func isUUIDChar(i int, c uint16) bool {
+	switch i {
+	case 8, 13, 18, 23:
+		return c == '-'
+	}
+	return digitVal(c) < 16
+}
+
+// scanUUID scans a CQL UUID literal, isUUIDAhead must be checked first
+func (tkn *Tokenizer) scanUUID() (int, []byte) {
+	buffer := &bytes.Buffer{}
+	for i := 0; i < 36; i++ {
+		tkn.consumeNext(buffer)
+	}
+	return String, buffer.Bytes()
+}
+
+// scanBracketIdentifier scans MSSQL [bracketed identifiers], the opening
+// bracket being already consumed. Brackets are kept as the identifier can
+// contain spaces, and qualified names like [dbo].[Order Details] are kept whole.
+func (tkn *Tokenizer) scanBracketIdentifier() (int, []byte) {
+	token, buff := tkn.scanDelimited(']', ID)
+	if token == LexError {
+		return token, buff
+	}
+	buffer := &bytes.Buffer{}
+	buffer.WriteByte('[')
+	buffer.Write(bytes.Replace(buff, []byte("]"), []byte("]]"), -1))
+	buffer.WriteByte(']')
+
+	if tkn.lastChar != '.' {
+		return ID, buffer.Bytes()
+	}
+	tkn.consumeNext(buffer)
+	switch {
+	case tkn.lastChar == '[':
+		tkn.next()
+		token, buff = tkn.scanBracketIdentifier()
+	case isLetter(tkn.lastChar):
+		token, buff = tkn.scanIdentifier()
+	default:
+		return ID, buffer.Bytes()
+	}
+	if token == LexError {
+		return token, buff
+	}
+	buffer.Write(buff)
+	return ID, buffer.Bytes()
+}
+
+// scanDelimited scans anything up to the closing delimiter, which can be
+// escaped by doubling it, e.g. [a]]b] stands for a]b
+func (tkn *Tokenizer) scanDelimited(delim uint16, typ int) (int, []byte) {
+	buffer := &bytes.Buffer{}
+	for {
+		ch := tkn.lastChar
+		if ch == EOFChar {
+			return LexError, buffer.Bytes()
+		}
+		tkn.next()
+		if ch == delim {
+			if tkn.lastChar != delim {
+				break
+			}
+			tkn.next()
+		}
+		buffer.WriteByte(byte(ch))
+	}
+	return typ, buffer.Bytes()
+}
+
+// scanOracleQuotedString scans Oracle alternative quoting literals like
+// q'[it's]', the q prefix being already consumed
+func (tkn *Tokenizer) scanOracleQuotedString() (int, []byte) {
+	buffer := &bytes.Buffer{}
+
+	// skip the quote, then find out the delimiter
+	tkn.next()
+	closing := tkn.lastChar
+	switch closing {
+	case EOFChar, ' ', '\t', '\n', '\r':
+		return LexError, buffer.Bytes()
+	case '[':
+		closing = ']'
+	case '{':
+		closing = '}'
+	case '(':
+		closing = ')'
+	case '<':
+		closing = '>'
+	}
+	tkn.next()
+
+	for {
+		ch := tkn.lastChar
+		if ch == EOFChar {
+			return LexError, buffer.Bytes()
+		}
+		tkn.next()
+		if ch == closing && tkn.lastChar == '\'' {
+			tkn.next()
+			return String, buffer.Bytes()
+		}
+		buffer.WriteByte(byte(ch))
+	}
+}
+
 func (tkn *Tokenizer) scanCommentType1(prefix string) (int, []byte) {
 	buffer := &bytes.Buffer{}
 	buffer.WriteString(prefix)
@@ -446,6 +757,16 @@ func (tkn *Tokenizer) next() {
 	tkn.Position++
 }
 
+// isIdentifierPart tells if the given character can be part of an identifier
+// that has already started
+func (tkn *Tokenizer) isIdentifierPart(ch uint16) bool {
+	if tkn.dialect == PostgresDialect && (ch == '#' || ch == '@') {
+		// operators in Postgres, e.g. data#>'{a}'
+		return false
+	}
+	return isLetter(ch) || isDigit(ch) || ch == '.' || ch == '*'
+}
+
 func isLetter(ch uint16) bool {
 	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_' || ch == '@' || ch == '#'
 }